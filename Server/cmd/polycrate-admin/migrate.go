@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shatwik7/polycrate/lib/db"
+)
+
+func migrate(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("migrate takes up, down, status or to VERSION")
+	}
+	migrations, err := db.Migrations()
+	if err != nil {
+		return err
+	}
+	database, err := db.NewDB(databaseURL())
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	migrator := db.NewMigrator(database, migrations)
+
+	switch args[0] {
+	case "up":
+		ran, err := migrator.Up(ctx)
+		printMigrations("applied", ran)
+		return err
+	case "down":
+		reverted, err := migrator.Down(ctx)
+		if reverted != nil && err == nil {
+			printMigrations("reverted", []db.Migration{*reverted})
+		}
+		if reverted == nil && err == nil {
+			fmt.Println("no migrations applied")
+		}
+		return err
+	case "to":
+		if len(args) != 2 {
+			return errors.New("migrate to takes exactly one VERSION")
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		ran, err := migrator.To(ctx, version)
+		printMigrations("ran", ran)
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, st := range statuses {
+			applied := "pending"
+			switch {
+			case st.Applied && st.Up == "":
+				applied = st.AppliedAt.Local().Format(time.DateTime) + " (not in this build)"
+			case st.Modified:
+				applied = st.AppliedAt.Local().Format(time.DateTime) + " (file modified since)"
+			case st.Applied:
+				applied = st.AppliedAt.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", st.Version, st.Name, applied)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
+
+func printMigrations(verb string, migrations []db.Migration) {
+	if len(migrations) == 0 {
+		fmt.Println("schema is up to date")
+		return
+	}
+	for _, m := range migrations {
+		fmt.Printf("%s %04d_%s\n", verb, m.Version, m.Name)
+	}
+}
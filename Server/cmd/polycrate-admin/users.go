@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/shatwik7/polycrate/lib/db"
+	service "github.com/shatwik7/polycrate/services/user_service"
+)
+
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+	// maxJSONLine bounds a single JSON Lines record; bios can be long.
+	maxJSONLine = 1 << 20
+)
+
+var csvColumns = []string{"username", "email", "full_name", "bio", "website", "location", "password_hash"}
+
+func importUsers(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("users import", flag.ExitOnError)
+	format := flags.String("format", "", "input format, csv or jsonl (default: from the file extension)")
+	onConflict := flags.String("on-conflict", string(service.ConflictFail), "what to do with existing usernames or emails: skip, update or fail")
+	batchSize := flags.Int("batch-size", service.DefaultImportBatchSize, "users written per transaction")
+	dryRun := flags.Bool("dry-run", false, "validate and report without writing anything")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("users import takes exactly one FILE, or - for stdin")
+	}
+
+	strategy := service.ConflictStrategy(*onConflict)
+	switch strategy {
+	case service.ConflictSkip, service.ConflictUpdate, service.ConflictFail:
+	default:
+		return fmt.Errorf("unknown -on-conflict %q", *onConflict)
+	}
+
+	path := flags.Arg(0)
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	next, err := newRecordReader(in, formatFor(*format, path))
+	if err != nil {
+		return err
+	}
+
+	database, err := db.NewDB(databaseURL())
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	users := service.NewUserService(database)
+	importer := users.NewImporter(service.ImportOptions{
+		OnConflict: strategy,
+		BatchSize:  *batchSize,
+		DryRun:     *dryRun,
+	})
+
+	var importErr error
+	for importErr == nil {
+		record, err := next()
+		if err == io.EOF {
+			importErr = importer.Flush(ctx)
+			break
+		}
+		var rowErr service.RowError
+		if errors.As(err, &rowErr) {
+			importer.RecordError(rowErr.Line, rowErr.Message)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		importErr = importer.Add(ctx, record)
+	}
+
+	report := importer.Report()
+	for _, e := range report.Errors {
+		fmt.Fprintln(os.Stderr, e.Error())
+	}
+	verb := "imported"
+	if *dryRun {
+		verb = "would import"
+	}
+	fmt.Printf("%s: %d inserted, %d updated, %d skipped, %d failed\n",
+		verb, report.Inserted, report.Updated, report.Skipped, len(report.Errors))
+
+	if importErr != nil {
+		return importErr
+	}
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%d records failed", len(report.Errors))
+	}
+	return nil
+}
+
+func exportUsers(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("users export", flag.ExitOnError)
+	format := flags.String("format", "", "output format, csv or jsonl (default: from the file extension, csv for stdout)")
+	withHash := flags.Bool("with-password-hash", false, "include bcrypt password hashes")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		return errors.New("users export takes at most one FILE")
+	}
+
+	out := os.Stdout
+	path := flags.Arg(0)
+	if path != "" && path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	buf := bufio.NewWriter(out)
+
+	database, err := db.NewDB(databaseURL())
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	users := service.NewUserService(database)
+
+	var write func(service.UserRecord) error
+	var finish func() error
+	switch formatFor(*format, path) {
+	case formatJSONL:
+		enc := json.NewEncoder(buf)
+		write = func(r service.UserRecord) error { return enc.Encode(r) }
+		finish = func() error { return nil }
+	default:
+		w := csv.NewWriter(buf)
+		if err := w.Write(csvColumns); err != nil {
+			return err
+		}
+		write = func(r service.UserRecord) error {
+			return w.Write([]string{r.Username, r.Email, r.FullName, r.Bio, r.Website, r.Location, r.PasswordHash})
+		}
+		finish = func() error {
+			w.Flush()
+			return w.Error()
+		}
+	}
+
+	count := 0
+	err = users.ExportUsers(ctx, *withHash, func(r service.UserRecord) error {
+		count++
+		return write(r)
+	})
+	if err != nil {
+		return err
+	}
+	if err := finish(); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d users\n", count)
+	return nil
+}
+
+// formatFor returns the explicit format, or guesses it from path.
+func formatFor(format, path string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		return formatJSONL
+	}
+	return formatCSV
+}
+
+// newRecordReader returns a function yielding one record per call. A
+// record that can't be parsed is returned as a service.RowError so the
+// caller can report it and carry on; io.EOF marks the end of the input.
+func newRecordReader(in io.Reader, format string) (func() (service.UserRecord, error), error) {
+	switch format {
+	case formatCSV:
+		return csvRecords(in)
+	case formatJSONL:
+		return jsonRecords(in), nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func csvRecords(in io.Reader) (func() (service.UserRecord, error), error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if !slices.Contains(csvColumns, name) {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		index[name] = i
+	}
+	for _, name := range []string{"username", "email"} {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("CSV header has no %q column", name)
+		}
+	}
+
+	return func() (service.UserRecord, error) {
+		row, err := r.Read()
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return service.UserRecord{}, service.RowError{Line: parseErr.Line, Message: parseErr.Err.Error()}
+		}
+		if err != nil {
+			return service.UserRecord{}, err
+		}
+		line, _ := r.FieldPos(0)
+		if len(row) != len(header) {
+			return service.UserRecord{}, service.RowError{Line: line, Message: fmt.Sprintf("has %d fields, header has %d", len(row), len(header))}
+		}
+		get := func(name string) string {
+			if i, ok := index[name]; ok {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		return service.UserRecord{
+			Line:         line,
+			Username:     get("username"),
+			Email:        get("email"),
+			FullName:     get("full_name"),
+			Bio:          get("bio"),
+			Website:      get("website"),
+			Location:     get("location"),
+			PasswordHash: get("password_hash"),
+		}, nil
+	}, nil
+}
+
+func jsonRecords(in io.Reader) func() (service.UserRecord, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxJSONLine)
+	line := 0
+	return func() (service.UserRecord, error) {
+		for scanner.Scan() {
+			line++
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+			dec := json.NewDecoder(bytes.NewReader(text))
+			dec.DisallowUnknownFields()
+			record := service.UserRecord{Line: line}
+			if err := dec.Decode(&record); err != nil {
+				return service.UserRecord{}, service.RowError{Line: line, Message: err.Error()}
+			}
+			return record, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return service.UserRecord{}, err
+		}
+		return service.UserRecord{}, io.EOF
+	}
+}
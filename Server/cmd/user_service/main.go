@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/shatwik7/polycrate/lib/db"
+	"github.com/shatwik7/polycrate/lib/events"
 	userpb "github.com/shatwik7/polycrate/lib/protos/user"
 	service "github.com/shatwik7/polycrate/services/user_service"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
 	grpcserver "google.golang.org/grpc"
 )
 
@@ -20,8 +30,29 @@ func main() {
 		log.Fatal("DATABASE_URL is not set")
 	}
 
-	// Connect to database
-	database, err := db.NewDB(dataSourceName)
+	jwtSecret := os.Getenv("JWT_SECRET")
+	if jwtSecret == "" {
+		log.Fatal("JWT_SECRET is not set")
+	}
+
+	registration, err := service.ParseRegistrationMode(os.Getenv("REGISTRATION_MODE"))
+	if err != nil {
+		log.Fatalf("Invalid REGISTRATION_MODE: %v", err)
+	}
+
+	shutdownTelemetry, err := setupTelemetry(context.Background())
+	if err != nil {
+		log.Fatalf("Error setting up telemetry: %v", err)
+	}
+
+	poolOpts, err := poolOptionsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid database pool setting: %v", err)
+	}
+
+	// Connect to database, waiting for it to come up if the service
+	// started first
+	database, err := db.NewDB(dataSourceName, poolOpts...)
 	if err != nil {
 		log.Fatalf("Error initializing database: %v", err)
 	}
@@ -36,6 +67,77 @@ func main() {
 		log.Fatalf("Error pinging database: %v", err)
 	}
 
+	// Bring the schema up to date. Instances starting together wait on the
+	// migration lock, so each migration runs once.
+	migrations, err := db.Migrations()
+	if err != nil {
+		log.Fatalf("Error loading migrations: %v", err)
+	}
+	applied, err := db.NewMigrator(database, migrations).Up(context.Background())
+	if err != nil {
+		log.Fatalf("Error migrating database: %v", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+	}
+
+	// Load the token signing keys, creating the first one if needed, and
+	// keep rotating them in the background.
+	keys := auth.NewKeyRing(service.NewUserRepository(database), []byte(jwtSecret),
+		auth.DefaultRotationInterval, auth.DefaultRetirementGrace)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := keys.Rotate(ctx, time.Now()); err != nil {
+		log.Fatalf("Error loading signing keys: %v", err)
+	}
+	go keys.Run(ctx, time.Hour)
+	tokens := auth.NewTokenManager(keys, auth.DefaultTokenTTL)
+
+	// Publish the domain events written to the outbox. Instances can all
+	// run a relay; they split the pending events between them.
+	if brokerURL := os.Getenv("EVENT_BROKER_URL"); brokerURL != "" {
+		broker, err := events.OpenBroker(brokerURL)
+		if err != nil {
+			log.Fatalf("Invalid EVENT_BROKER_URL: %v", err)
+		}
+		go events.NewRelay(database, broker).Run(ctx)
+	} else {
+		log.Println("EVENT_BROKER_URL is not set, domain events stay in the outbox")
+	}
+
+	// Publish the public keys for services that verify tokens themselves
+	httpAddr := os.Getenv("HTTP_ADDR")
+	if httpAddr == "" {
+		httpAddr = ":8080"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/.well-known/jwks.json", keys)
+	httpServer := &http.Server{Addr: httpAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Printf("HTTP server running on %s", httpAddr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to serve HTTP: %v", err)
+		}
+	}()
+
+	// Pool statistics and replica health for the metrics scraper, under
+	// "db" and "db_replicas" in /debug/vars. They name hosts and load, so
+	// they go on their own listener, which is off unless DEBUG_ADDR is set
+	var debugServer *http.Server
+	if debugAddr := os.Getenv("DEBUG_ADDR"); debugAddr != "" {
+		expvar.Publish("db", expvar.Func(func() any { return database.Stats() }))
+		expvar.Publish("db_replicas", expvar.Func(func() any { return database.Replicas() }))
+		debugMux := http.NewServeMux()
+		debugMux.Handle("/debug/vars", expvar.Handler())
+		debugServer = &http.Server{Addr: debugAddr, Handler: debugMux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			log.Printf("Debug server running on %s", debugAddr)
+			if err := debugServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Failed to serve debug HTTP: %v", err)
+			}
+		}()
+	}
+
 	// Start TCP listener
 	lis, err := net.Listen("tcp", ":50051")
 	if err != nil {
@@ -43,8 +145,15 @@ func main() {
 	}
 
 	// Create gRPC server and register services
-	grpcServer := grpcserver.NewServer()
-	userService := service.NewUserServer(database)
+	userService := service.NewUserServer(database, tokens)
+	userService.Service.Registration = registration
+	grpcServer := grpcserver.NewServer(
+		grpcserver.ChainUnaryInterceptor(
+			auth.UnaryServerInterceptor(tokens, auth.WithAccountCheck(userService.CheckAccount)),
+			userService.AuditInterceptor(),
+			service.ValidationInterceptor(),
+		),
+	)
 	userpb.RegisterUserServiceServer(grpcServer, userService)
 
 	// Run gRPC server in a goroutine
@@ -62,5 +171,65 @@ func main() {
 
 	log.Println("Shutting down server...")
 	grpcServer.GracefulStop()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+	if debugServer != nil {
+		if err := debugServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down debug server: %v", err)
+		}
+	}
+	if err := shutdownTelemetry(shutdownCtx); err != nil {
+		log.Printf("Error flushing telemetry: %v", err)
+	}
 	log.Println("Server shut down cleanly")
 }
+
+// poolOptionsFromEnv reads the DB_* pool settings. Unset variables keep the
+// lib/db defaults.
+func poolOptionsFromEnv() ([]db.Option, error) {
+	opts := []db.Option{db.WithStartupRetry(30 * time.Second)}
+	if raw := os.Getenv("DB_REPLICA_URLS"); raw != "" {
+		opts = append(opts, db.WithReplicas(strings.Split(raw, ",")...))
+	}
+	ints := []struct {
+		name string
+		opt  func(int) db.Option
+	}{
+		{"DB_MAX_OPEN_CONNS", db.WithMaxOpenConns},
+		{"DB_MAX_IDLE_CONNS", db.WithMaxIdleConns},
+	}
+	for _, v := range ints {
+		if raw := os.Getenv(v.name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", v.name, err)
+			}
+			opts = append(opts, v.opt(n))
+		}
+	}
+	durations := []struct {
+		name string
+		opt  func(time.Duration) db.Option
+	}{
+		{"DB_CONN_MAX_LIFETIME", db.WithConnMaxLifetime},
+		{"DB_CONN_MAX_IDLE_TIME", db.WithConnMaxIdleTime},
+		{"DB_CONNECT_TIMEOUT", db.WithConnectTimeout},
+		{"DB_STARTUP_TIMEOUT", db.WithStartupRetry},
+		{"DB_MAX_REPLICA_LAG", db.WithMaxReplicaLag},
+		{"DB_REPLICA_CHECK_INTERVAL", db.WithReplicaCheckInterval},
+		{"DB_SLOW_QUERY_THRESHOLD", db.WithSlowQueryThreshold},
+	}
+	for _, v := range durations {
+		if raw := os.Getenv(v.name); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", v.name, err)
+			}
+			opts = append(opts, v.opt(d))
+		}
+	}
+	return opts, nil
+}
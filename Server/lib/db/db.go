@@ -1,54 +1,133 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
 
-	_ "github.com/lib/pq" // PostgreSQL driver
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 )
 
 // DB is a struct that holds the database connection
 type DB struct {
+	// Conn serves the database/sql API on top of Pool.
 	Conn *sql.DB
+	// Pool is the pgx connection pool. Use it, or the methods in pgx.go,
+	// for batches, COPY, LISTEN/NOTIFY and native pgx types.
+	Pool *pgxpool.Pool
+
+	// replicas serve reads made with a ReadOnly context; see replica.go.
+	replicas    []*replica
+	nextReplica atomic.Uint64
+	stopChecks  context.CancelFunc
+	checksDone  chan struct{}
 }
 
-// NewDB initializes a new database connection
-func NewDB(dataSourceName string) (*DB, error) {
-	conn, err := sql.Open("postgres", dataSourceName)
+// NewDB initializes a new database connection pool. Pool sizes and
+// timeouts default to the Default* constants and can be changed with
+// opts; WithReplicas adds read replicas. It doesn't touch the schema; run
+// a Migrator for that.
+func NewDB(dataSourceName string, opts ...Option) (*DB, error) {
+	o := poolOptions{
+		maxOpen:            DefaultMaxOpenConns,
+		maxIdle:            DefaultMaxIdleConns,
+		maxLifetime:        DefaultConnMaxLifetime,
+		maxIdleTime:        DefaultConnMaxIdleTime,
+		connectTimeout:     DefaultConnectTimeout,
+		maxReplicaLag:      DefaultMaxReplicaLag,
+		checkInterval:      DefaultReplicaCheckInterval,
+		slowQueryThreshold: DefaultSlowQueryThreshold,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var err error
+	if o.tracer, err = newTracer(o.tracerProvider, o.meterProvider, o.slowQueryThreshold); err != nil {
+		return nil, fmt.Errorf("failed to set up instrumentation: %w", err)
+	}
+	db, err := openPool(dataSourceName, o)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, err
+	}
+	if o.startupTimeout > 0 {
+		if err := db.waitReady(context.Background(), o.startupTimeout); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if len(o.replicas) == 0 {
+		return db, nil
 	}
 
-	// schemaBytes, err := os.ReadFile("./schema.sql") // read schema file
-	// if err != nil {
-	// 	return nil, fmt.Errorf("failed to read schema.sql: %w", err)
-	// }
-
-	// schema := string(schemaBytes)
-	// queries := strings.Split(schema, ";")
-
-	// // Execute each statement
-	// for _, query := range queries {
-	// 	query = strings.TrimSpace(query)
-	// 	if query == "" {
-	// 		continue
-	// 	}
-	// 	if _, err := conn.Exec(query); err != nil {
-	// 		return nil, fmt.Errorf("failed to execute schema statement: %w\nQuery: %s", err, query)
-	// 	}
-	// }
+	if o.checkInterval <= 0 {
+		db.Close()
+		return nil, fmt.Errorf("replica check interval must be positive, got %s", o.checkInterval)
+	}
+	for _, dsn := range o.replicas {
+		replicaDB, err := openPool(dsn, o)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("replica: %w", err)
+		}
+		config := replicaDB.Pool.Config().ConnConfig
+		db.replicas = append(db.replicas, &replica{
+			db:     replicaDB,
+			status: ReplicaStatus{Host: net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))},
+		})
+	}
+	// Replicas only take reads once a check has found them healthy.
+	ctx, cancel := context.WithCancel(context.Background())
+	db.stopChecks, db.checksDone = cancel, make(chan struct{})
+	go func() {
+		defer close(db.checksDone)
+		db.checkReplicas(ctx, o.checkInterval, o.connectTimeout, o.maxReplicaLag)
+	}()
+	return db, nil
+}
 
-	return &DB{Conn: conn}, nil
+func openPool(dataSourceName string, o poolOptions) (*DB, error) {
+	config, err := pgxpool.ParseConfig(dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database URL: %w", err)
+	}
+	db := &DB{}
+	if err := o.apply(config, func() int32 { return db.Pool.Stat().IdleConns() }); err != nil {
+		return nil, err
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	db.Pool, db.Conn = pool, stdlib.OpenDBFromPool(pool)
+	return db, nil
 }
 
-// Close closes the database connection
+// Close closes the database connection and those to the replicas.
 func (db *DB) Close() error {
+	if db.stopChecks != nil {
+		db.stopChecks()
+		<-db.checksDone
+	}
+	var errs []error
+	for _, r := range db.replicas {
+		if err := r.db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("replica %s: %w", r.status.Host, err))
+		}
+	}
 	if db.Conn != nil {
 		if err := db.Conn.Close(); err != nil {
-			return fmt.Errorf("failed to close database connection: %w", err)
+			errs = append(errs, fmt.Errorf("failed to close database connection: %w", err))
 		}
 	}
-	return nil
+	if db.Pool != nil {
+		db.Pool.Close()
+	}
+	return errors.Join(errs...)
 }
 
 // Ping checks if the database connection is alive
@@ -64,10 +143,16 @@ func (db *DB) Ping() error {
 
 // Exec executes a query without returning any rows
 func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext executes a query without returning any rows. The query is
+// cancelled when ctx is done.
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
 	if db.Conn == nil {
 		return nil, fmt.Errorf("database connection is nil")
 	}
-	result, err := db.Conn.Exec(query, args...)
+	result, err := db.Conn.ExecContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute query: %w", err)
 	}
@@ -76,18 +161,31 @@ func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
 
 // QueryRow executes a query that is expected to return a single row
 func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+// QueryRowContext executes a query that is expected to return a single
+// row. ctx must stay live until the row has been scanned. A ReadOnly ctx
+// lets a replica serve it.
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
 	if db.Conn == nil {
 		return nil
 	}
-	return db.Conn.QueryRow(query, args...)
+	return db.reader(ctx).QueryRowContext(ctx, query, args...)
 }
 
 // Query executes a query that returns multiple rows
 func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext executes a query that returns multiple rows. ctx must stay
+// live until the rows are closed. A ReadOnly ctx lets a replica serve it.
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
 	if db.Conn == nil {
 		return nil, fmt.Errorf("database connection is nil")
 	}
-	rows, err := db.Conn.Query(query, args...)
+	rows, err := db.reader(ctx).QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute query: %w", err)
 	}
@@ -96,10 +194,16 @@ func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
 
 // Begin starts a new transaction
 func (db *DB) Begin() (*sql.Tx, error) {
+	return db.BeginTx(context.Background(), nil)
+}
+
+// BeginTx starts a new transaction with the given options, which may be
+// nil. The transaction is rolled back if ctx is done before it commits.
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
 	if db.Conn == nil {
 		return nil, fmt.Errorf("database connection is nil")
 	}
-	tx, err := db.Conn.Begin()
+	tx, err := db.Conn.BeginTx(ctx, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
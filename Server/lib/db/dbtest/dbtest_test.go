@@ -0,0 +1,61 @@
+package dbtest_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/shatwik7/polycrate/lib/db/dbtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaName(t *testing.T) {
+	name := dbtest.SchemaName("TestImportUsers/Dry-Run")
+	assert.Regexp(t, `^test_testimportusers_dry_run_[0-9a-f]{8}$`, name)
+	assert.NotEqual(t, name, dbtest.SchemaName("TestImportUsers/Dry-Run"))
+
+	long := dbtest.SchemaName(strings.Repeat("TestVeryLongName", 10))
+	assert.LessOrEqual(t, len(long), 63)
+}
+
+func TestWithSearchPath(t *testing.T) {
+	for _, tt := range []struct{ dsn, want string }{
+		{
+			"postgres://u:p@localhost:5432/app?sslmode=disable",
+			"postgres://u:p@localhost:5432/app?search_path=test_a%2Cpublic&sslmode=disable",
+		},
+		{
+			"postgresql://localhost/app?search_path=other",
+			"postgresql://localhost/app?search_path=test_a%2Cpublic",
+		},
+		{
+			"host=localhost dbname=app",
+			"host=localhost dbname=app search_path='test_a,public'",
+		},
+	} {
+		got, err := dbtest.WithSearchPath(tt.dsn, "test_a,public")
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+	first := dbtest.New(t)
+	second := dbtest.New(t)
+
+	var schema string
+	assert.NoError(t, first.QueryRow(`SELECT current_schema()`).Scan(&schema))
+	assert.True(t, strings.HasPrefix(schema, "test_testnew_"), schema)
+
+	_, err := first.Exec(`INSERT INTO users (username, email) VALUES ('alice', 'alice@site.com')`)
+	assert.NoError(t, err)
+	var n int
+	assert.NoError(t, second.QueryRow(`SELECT count(*) FROM users`).Scan(&n))
+	assert.Zero(t, n, "schemas must not share rows")
+
+	// The migrations' extensions resolve through public.
+	var sim float32
+	assert.NoError(t, first.QueryRowContext(context.Background(), `SELECT similarity('sculptor', 'sculptr')`).Scan(&sim))
+	assert.Greater(t, sim, float32(0))
+}
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultSlowQueryThreshold is how long a statement may take before it is
+// logged as slow.
+const DefaultSlowQueryThreshold = 200 * time.Millisecond
+
+const instrumentationName = "github.com/shatwik7/polycrate/lib/db"
+
+// The instrumentation never records statement arguments. Spans, metrics
+// and the slow-query log carry the statement name and its SQL text with
+// literals replaced by ?, so values such as password hashes, which are
+// always passed as arguments, can't leak through them.
+
+// WithSlowQueryThreshold sets how long a statement may take before it is
+// logged as slow. Zero turns the slow-query log off.
+func WithSlowQueryThreshold(d time.Duration) Option {
+	return func(o *poolOptions) { o.slowQueryThreshold = d }
+}
+
+// WithTracerProvider sets where statement spans go, instead of the global
+// OpenTelemetry tracer provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *poolOptions) { o.tracerProvider = tp }
+}
+
+// WithMeterProvider sets where statement durations are recorded, instead
+// of the global OpenTelemetry meter provider.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(o *poolOptions) { o.meterProvider = mp }
+}
+
+type statementKey struct{}
+
+// Named names the statements run with ctx in metrics, spans and the slow
+// query log. Without it a statement is named after the function that ran
+// it, such as "UserRepository.ListUsers".
+func Named(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, statementKey{}, name)
+}
+
+// tracer is the pgx tracer installed on every pool. It times each
+// statement, batch and COPY.
+type tracer struct {
+	spans         trace.Tracer
+	duration      metric.Float64Histogram
+	slowThreshold time.Duration
+}
+
+func newTracer(tp trace.TracerProvider, mp metric.MeterProvider, slowThreshold time.Duration) (*tracer, error) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	duration, err := mp.Meter(instrumentationName).Float64Histogram("db.client.operation.duration",
+		metric.WithDescription("Duration of database statements."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10))
+	if err != nil {
+		return nil, err
+	}
+	return &tracer{spans: tp.Tracer(instrumentationName), duration: duration, slowThreshold: slowThreshold}, nil
+}
+
+var (
+	_ pgx.QueryTracer    = (*tracer)(nil)
+	_ pgx.BatchTracer    = (*tracer)(nil)
+	_ pgx.CopyFromTracer = (*tracer)(nil)
+)
+
+type traceKey struct{}
+
+// statement is what TraceXStart hands to TraceXEnd through the context.
+type statement struct {
+	name   string
+	sql    string
+	caller string
+	start  time.Time
+	span   trace.Span
+}
+
+func (t *tracer) start(ctx context.Context, conn *pgx.Conn, operation, sql string) context.Context {
+	caller, fn := callerOutsideDB()
+	name, _ := ctx.Value(statementKey{}).(string)
+	if name == "" {
+		name = fn
+	}
+	if name == "" {
+		name = operation
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation.name", operation),
+		attribute.String("db.query.text", sql),
+		attribute.String("code.caller", caller),
+	}
+	if conn != nil {
+		config := conn.Config()
+		attrs = append(attrs, attribute.String("server.address", net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))))
+	}
+	ctx, span := t.spans.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return context.WithValue(ctx, traceKey{}, &statement{name: name, sql: sql, caller: caller, start: time.Now(), span: span})
+}
+
+func (t *tracer) end(ctx context.Context, err error) {
+	st, ok := ctx.Value(traceKey{}).(*statement)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(st.start)
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+		recordError(st.span, err)
+	}
+	st.span.End()
+	t.duration.Record(context.WithoutCancel(ctx), elapsed.Seconds(), metric.WithAttributes(
+		attribute.String("db.statement.name", st.name),
+		attribute.String("outcome", outcome)))
+	if t.slowThreshold > 0 && elapsed >= t.slowThreshold {
+		log.Printf("db: slow query %s took %s (caller %s): %s", st.name, elapsed.Round(time.Millisecond), st.caller, st.sql)
+	}
+}
+
+// recordError marks span as failed. A Postgres error is recorded by its
+// SQLSTATE and constraint only: its message and detail can quote the row,
+// such as the email in a unique violation.
+func recordError(span trace.Span, err error) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	desc := "SQLSTATE " + pgErr.Code
+	attrs := []attribute.KeyValue{attribute.String("db.response.status_code", pgErr.Code)}
+	if pgErr.ConstraintName != "" {
+		desc += " (constraint " + pgErr.ConstraintName + ")"
+		attrs = append(attrs, attribute.String("db.constraint.name", pgErr.ConstraintName))
+	}
+	span.SetAttributes(attrs...)
+	span.RecordError(errors.New(desc))
+	span.SetStatus(codes.Error, desc)
+}
+
+func (t *tracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return t.start(ctx, conn, operationName(data.SQL), sanitizeSQL(data.SQL))
+}
+
+func (t *tracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	t.end(ctx, data.Err)
+}
+
+func (t *tracer) TraceBatchStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	sqls := make([]string, len(data.Batch.QueuedQueries))
+	for i, q := range data.Batch.QueuedQueries {
+		sqls[i] = sanitizeSQL(q.SQL)
+	}
+	return t.start(ctx, conn, "BATCH", strings.Join(sqls, "; "))
+}
+
+func (t *tracer) TraceBatchQuery(context.Context, *pgx.Conn, pgx.TraceBatchQueryData) {}
+
+func (t *tracer) TraceBatchEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchEndData) {
+	t.end(ctx, data.Err)
+}
+
+func (t *tracer) TraceCopyFromStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	sql := "COPY " + data.TableName.Sanitize() + " (" + strings.Join(data.ColumnNames, ", ") + ") FROM STDIN"
+	return t.start(ctx, conn, "COPY", sql)
+}
+
+func (t *tracer) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	t.end(ctx, data.Err)
+}
+
+// Frames of these functions are skipped when looking for the caller.
+var driverFrames = []string{
+	reflect.TypeOf(DB{}).PkgPath() + ".(*DB).",
+	reflect.TypeOf(DB{}).PkgPath() + ".(*Tx).",
+	reflect.TypeOf(DB{}).PkgPath() + ".(*tracer).",
+	"database/sql.",
+	"github.com/jackc/pgx/",
+}
+
+// callerOutsideDB returns the file:line and short function name, such as
+// "UserRepository.ListUsers", of the first caller that isn't a DB or Tx
+// method or part of a driver.
+func callerOutsideDB() (caller, fn string) {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !isDriverFrame(frame.Function) {
+			return frame.File + ":" + strconv.Itoa(frame.Line), shortFuncName(frame.Function)
+		}
+		if !more {
+			return "", ""
+		}
+	}
+}
+
+func isDriverFrame(function string) bool {
+	for _, prefix := range driverFrames {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var closureSuffix = regexp.MustCompile(`\.func\d+(\.\d+)*$`)
+
+// shortFuncName turns "example.com/pkg.(*Repo).Method.func1" into
+// "Repo.Method".
+func shortFuncName(function string) string {
+	function = function[strings.LastIndex(function, "/")+1:]
+	function = function[strings.Index(function, ".")+1:]
+	function = closureSuffix.ReplaceAllString(function, "")
+	return strings.NewReplacer("(*", "", ")", "").Replace(function)
+}
+
+func operationName(sql string) string {
+	fields := strings.Fields(stripComments(sql))
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+var (
+	sqlLineComment = regexp.MustCompile(`--[^\n]*`)
+	sqlDollarTag   = regexp.MustCompile(`\$(?:[A-Za-z_]\w*)?\$`)
+	sqlStringLit   = regexp.MustCompile(`[EeBbXx]?'(?:[^']|'')*'`)
+	sqlNumberLit   = regexp.MustCompile(`([^\w$.]|^)\d+(?:\.\d+)?(?:[eE][-+]?\d+)?\b`)
+	sqlSpace       = regexp.MustCompile(`\s+`)
+)
+
+func stripComments(sql string) string {
+	return sqlLineComment.ReplaceAllString(sql, "")
+}
+
+// sanitizeSQL replaces string, dollar-quoted and numeric literals with ?
+// and collapses whitespace. Placeholders such as $1 are kept.
+func sanitizeSQL(sql string) string {
+	sql = stripDollarQuoted(stripComments(sql))
+	sql = sqlStringLit.ReplaceAllString(sql, "?")
+	sql = sqlNumberLit.ReplaceAllString(sql, "${1}?")
+	return strings.TrimSpace(sqlSpace.ReplaceAllString(sql, " "))
+}
+
+// stripDollarQuoted replaces $$...$$ and $tag$...$tag$ bodies with ?.
+func stripDollarQuoted(sql string) string {
+	var b strings.Builder
+	for {
+		loc := sqlDollarTag.FindStringIndex(sql)
+		if loc == nil {
+			b.WriteString(sql)
+			return b.String()
+		}
+		tag := sql[loc[0]:loc[1]]
+		end := strings.Index(sql[loc[1]:], tag)
+		if end < 0 {
+			b.WriteString(sql)
+			return b.String()
+		}
+		b.WriteString(sql[:loc[0]])
+		b.WriteString("?")
+		sql = sql[loc[1]+end+len(tag):]
+	}
+}
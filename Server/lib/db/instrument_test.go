@@ -0,0 +1,180 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSanitizeSQL(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"SELECT id FROM users WHERE id = $1", "SELECT id FROM users WHERE id = $1"},
+		{"SELECT *\n\t FROM users LIMIT 100 OFFSET $2", "SELECT * FROM users LIMIT ? OFFSET $2"},
+		{"UPDATE users SET bio = 'it''s me', age = 3.5 WHERE username LIKE 'bench_%'", "UPDATE users SET bio = ?, age = ? WHERE username LIKE ?"},
+		{"SAVEPOINT sp_1 -- nested", "SAVEPOINT sp_1"},
+		{"SELECT $1::float8, ts + interval '5 minutes'", "SELECT $1::float8, ts + interval ?"},
+		{"CREATE FUNCTION f() RETURNS trigger AS $$ BEGIN RAISE 'x'; END $$ LANGUAGE plpgsql", "CREATE FUNCTION f() RETURNS trigger AS ? LANGUAGE plpgsql"},
+		{"DO $body$ SELECT 1 $body$", "DO ?"},
+		{"INSERT INTO t VALUES ($1,$2)", "INSERT INTO t VALUES ($1,$2)"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, sanitizeSQL(tt.in), tt.in)
+	}
+}
+
+func TestShortFuncName(t *testing.T) {
+	assert.Equal(t, "UserRepository.ListUsers", shortFuncName("github.com/shatwik7/polycrate/services/user_service.(*UserRepository).ListUsers"))
+	assert.Equal(t, "UserService.CreateUser", shortFuncName("github.com/shatwik7/polycrate/services/user_service.(*UserService).CreateUser.func1.2"))
+	assert.Equal(t, "Migrator.apply", shortFuncName("github.com/shatwik7/polycrate/lib/db.(*Migrator).apply.func1"))
+	assert.Equal(t, "migrate", shortFuncName("main.migrate"))
+}
+
+func TestOperationName(t *testing.T) {
+	assert.Equal(t, "SELECT", operationName("  select 1"))
+	assert.Equal(t, "INSERT", operationName("-- name: x\nINSERT INTO t VALUES ($1)"))
+	assert.Equal(t, "", operationName(""))
+}
+
+func newTestTracer(t *testing.T, slow time.Duration) (*tracer, *tracetest.SpanRecorder, *sdkmetric.ManualReader) {
+	t.Helper()
+	spans := tracetest.NewSpanRecorder()
+	reader := sdkmetric.NewManualReader()
+	tr, err := newTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)),
+		sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)), slow)
+	assert.NoError(t, err)
+	return tr, spans, reader
+}
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestTracerRecordsStatements(t *testing.T) {
+	tr, spans, reader := newTestTracer(t, 0)
+	logs := captureLog(t)
+
+	ctx := tr.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{
+		SQL:  "SELECT id FROM users WHERE email = $1 LIMIT 10",
+		Args: []any{"someone@site.com"},
+	})
+	tr.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+	ctx = tr.TraceQueryStart(Named(context.Background(), "users.delete"), nil, pgx.TraceQueryStartData{SQL: "DELETE FROM users"})
+	tr.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{Err: errors.New("boom")})
+
+	ended := spans.Ended()
+	assert.Len(t, ended, 2)
+	// Statements run from a test are named after the test function.
+	assert.Equal(t, "TestTracerRecordsStatements", ended[0].Name())
+	attrs := map[string]string{}
+	for _, kv := range ended[0].Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	assert.Equal(t, "SELECT id FROM users WHERE email = $1 LIMIT ?", attrs["db.query.text"])
+	assert.Equal(t, "SELECT", attrs["db.operation.name"])
+	assert.Contains(t, attrs["code.caller"], "instrument_test.go:")
+	assert.Equal(t, "users.delete", ended[1].Name())
+	assert.Equal(t, "boom", ended[1].Status().Description)
+
+	var rm metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	hist := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Histogram[float64])
+	assert.Len(t, hist.DataPoints, 2)
+	names := map[string]string{}
+	for _, dp := range hist.DataPoints {
+		name, _ := dp.Attributes.Value("db.statement.name")
+		outcome, _ := dp.Attributes.Value("outcome")
+		names[name.AsString()] = outcome.AsString()
+		assert.Equal(t, uint64(1), dp.Count)
+	}
+	assert.Equal(t, map[string]string{"TestTracerRecordsStatements": "ok", "users.delete": "error"}, names)
+
+	assert.Empty(t, logs.String(), "slow-query log is off")
+}
+
+func TestTracerLeavesOutErrorValues(t *testing.T) {
+	tr, spans, _ := newTestTracer(t, 0)
+
+	ctx := tr.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "INSERT INTO users (email) VALUES ($1)"})
+	tr.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{Err: fmt.Errorf("failed to create user: %w", &pgconn.PgError{
+		Code:           "23505",
+		Message:        "duplicate key value violates unique constraint \"users_email_key\"",
+		Detail:         "Key (email)=(someone@site.com) already exists.",
+		ConstraintName: "users_email_key",
+	})})
+
+	span := spans.Ended()[0]
+	assert.Equal(t, "SQLSTATE 23505 (constraint users_email_key)", span.Status().Description)
+	if assert.Len(t, span.Events(), 1) {
+		for _, kv := range span.Events()[0].Attributes {
+			assert.NotContains(t, kv.Value.Emit(), "someone@site.com")
+		}
+	}
+	attrs := map[string]string{}
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	assert.Equal(t, "23505", attrs["db.response.status_code"])
+	assert.Equal(t, "users_email_key", attrs["db.constraint.name"])
+}
+
+func TestSlowQueryLogLeavesOutArguments(t *testing.T) {
+	tr, _, _ := newTestTracer(t, time.Nanosecond)
+	logs := captureLog(t)
+
+	hash := "$2a$10$abcdefghijklmnopqrstuuABCDEFGHIJKLMNOPQRSTUVWXYZ01234"
+	ctx := tr.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{
+		SQL:  "UPDATE user_credentials SET password_hash = $2 WHERE user_id = $1",
+		Args: []any{"8d5c6f2e-0000-0000-0000-000000000000", hash},
+	})
+	time.Sleep(time.Millisecond)
+	tr.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+
+	out := logs.String()
+	assert.Contains(t, out, "slow query TestSlowQueryLogLeavesOutArguments")
+	assert.Contains(t, out, "instrument_test.go:")
+	assert.Contains(t, out, "SET password_hash = $2 WHERE user_id = $1")
+	assert.NotContains(t, out, hash)
+	assert.NotContains(t, out, "8d5c6f2e")
+}
+
+func TestTracerCopyAndBatch(t *testing.T) {
+	tr, spans, _ := newTestTracer(t, 0)
+
+	ctx := tr.TraceCopyFromStart(context.Background(), nil, pgx.TraceCopyFromStartData{
+		TableName: pgx.Identifier{"users"}, ColumnNames: []string{"username", "email"},
+	})
+	tr.TraceCopyFromEnd(ctx, nil, pgx.TraceCopyFromEndData{})
+
+	b := &pgx.Batch{}
+	b.Queue("SELECT 1")
+	b.Queue("SELECT $1", "secret")
+	ctx = tr.TraceBatchStart(context.Background(), nil, pgx.TraceBatchStartData{Batch: b})
+	tr.TraceBatchEnd(ctx, nil, pgx.TraceBatchEndData{})
+
+	ended := spans.Ended()
+	assert.Len(t, ended, 2)
+	for i, want := range []string{`COPY "users" (username, email) FROM STDIN`, "SELECT ?; SELECT $1"} {
+		for _, kv := range ended[i].Attributes() {
+			if kv.Key == "db.query.text" {
+				assert.Equal(t, want, kv.Value.AsString())
+			}
+		}
+	}
+}
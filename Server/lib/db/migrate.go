@@ -0,0 +1,341 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the Postgres advisory lock held while migrating, so
+// service instances starting at the same time apply each migration once.
+const migrationLockID = 7_302_115_001
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var (
+	ErrChecksumMismatch = errors.New("applied migration has been modified")
+	ErrUnknownMigration = errors.New("database has a migration this build doesn't know")
+	ErrNoDownMigration  = errors.New("migration has no down file")
+)
+
+// Migration is one numbered schema change.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+	// Checksum is the SHA-256 of Up, recorded when the migration is applied
+	// so later edits to an applied file are caught.
+	Checksum string
+}
+
+// MigrationStatus describes a migration and whether it has been applied.
+// Migrations found in the database but not in the build have an empty Up.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	// Modified is set when the applied checksum differs from the file's.
+	Modified bool
+}
+
+// Migrations returns the migrations embedded in this package, in order.
+func Migrations() ([]Migration, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return LoadMigrations(sub)
+}
+
+// LoadMigrations reads NNNN_name.up.sql and NNNN_name.down.sql files from
+// the root of fsys. Every version needs an up file; the down file is
+// optional.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, e := range entries {
+		m := migrationFileName.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: version must be a positive number", e.Name())
+		}
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d is named both %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+			sum := sha256.Sum256(body)
+			mig.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Checksum == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies and reverts migrations, recording them in the
+// schema_migrations table.
+type Migrator struct {
+	db         *DB
+	migrations []Migration
+}
+
+func NewMigrator(db *DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// Latest returns the version of the newest known migration, or 0.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies every pending migration and returns the ones it applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.To(ctx, m.Latest())
+}
+
+// Down reverts the newest applied migration. It returns nil if nothing is
+// applied.
+func (m *Migrator) Down(ctx context.Context) (*Migration, error) {
+	var reverted *Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.checkApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok {
+				reverted = &m.migrations[i]
+				return m.revert(ctx, conn, *reverted)
+			}
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// To applies or reverts migrations until version is the newest one
+// applied. Version 0 reverts everything. It returns the migrations it ran,
+// in the order it ran them.
+func (m *Migrator) To(ctx context.Context, version int64) ([]Migration, error) {
+	if version != 0 && !m.known(version) {
+		return nil, fmt.Errorf("no migration with version %d", version)
+	}
+	var ran []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.checkApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; !ok && mig.Version <= version {
+				if err := m.apply(ctx, conn, mig); err != nil {
+					return err
+				}
+				ran = append(ran, mig)
+			}
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; ok && mig.Version > version {
+				if err := m.revert(ctx, conn, mig); err != nil {
+					return err
+				}
+				ran = append(ran, mig)
+			}
+		}
+		return nil
+	})
+	return ran, err
+}
+
+// Status lists every known migration and any applied migration the build
+// doesn't know, in version order.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			st := MigrationStatus{Migration: mig}
+			if a, ok := applied[mig.Version]; ok {
+				st.Applied, st.AppliedAt, st.Modified = true, a.AppliedAt, a.Checksum != mig.Checksum
+				delete(applied, mig.Version)
+			}
+			statuses = append(statuses, st)
+		}
+		for _, a := range applied {
+			statuses = append(statuses, a)
+		}
+		return nil
+	})
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, err
+}
+
+func (m *Migrator) known(version int64) bool {
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// withLock runs fn on a single connection holding the migration lock, with
+// the schema_migrations table in place.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) (err error) {
+	if m.db.Conn == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+	conn, err := m.db.Conn.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("failed to take the migration lock: %w", err)
+	}
+	defer func() {
+		if _, unlockErr := conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrationLockID); unlockErr != nil {
+			// The lock lives as long as the session, so don't hand this
+			// connection back to the pool.
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]MigrationStatus, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]MigrationStatus)
+	for rows.Next() {
+		st := MigrationStatus{Applied: true}
+		if err := rows.Scan(&st.Version, &st.Name, &st.Checksum, &st.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[st.Version] = st
+	}
+	return applied, rows.Err()
+}
+
+// checkApplied returns the applied migrations after making sure each one
+// is known and unchanged since it was applied.
+func (m *Migrator) checkApplied(ctx context.Context, conn *sql.Conn) (map[int64]MigrationStatus, error) {
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[int64]Migration, len(m.migrations))
+	for _, mig := range m.migrations {
+		files[mig.Version] = mig
+	}
+	for version, st := range applied {
+		mig, ok := files[version]
+		if !ok {
+			return nil, fmt.Errorf("%w: %d_%s", ErrUnknownMigration, version, st.Name)
+		}
+		if st.Checksum != mig.Checksum {
+			return nil, fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, version, mig.Name)
+		}
+	}
+	return applied, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %w", mig.Version, mig.Name, err)
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+			mig.Version, mig.Name, mig.Checksum)
+		return err
+	})
+}
+
+func (m *Migrator) revert(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	if mig.Down == "" {
+		return fmt.Errorf("%w: %d_%s", ErrNoDownMigration, mig.Version, mig.Name)
+	}
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+			return fmt.Errorf("reverting migration %d_%s failed: %w", mig.Version, mig.Name, err)
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, mig.Version)
+		return err
+	})
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package db_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/shatwik7/polycrate/lib/db"
+	"github.com/shatwik7/polycrate/lib/db/dbtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_add_bio.up.sql":   {Data: []byte("ALTER TABLE users ADD bio TEXT;")},
+		"0010_index.up.sql":     {Data: []byte("CREATE INDEX i ON users (bio);")},
+		"0001_initial.up.sql":   {Data: []byte("CREATE TABLE users (id INT);")},
+		"0001_initial.down.sql": {Data: []byte("DROP TABLE users;")},
+		"0002_add_bio.down.sql": {Data: []byte("ALTER TABLE users DROP bio;")},
+		"README.md":             {Data: []byte("not a migration")},
+		"0003_notes.sql.orig":   {Data: []byte("ignored")},
+	}
+	migrations, err := db.LoadMigrations(fsys)
+	assert.NoError(t, err)
+	assert.Len(t, migrations, 3)
+	assert.Equal(t, []int64{1, 2, 10}, []int64{migrations[0].Version, migrations[1].Version, migrations[2].Version})
+	assert.Equal(t, "initial", migrations[0].Name)
+	assert.Equal(t, "DROP TABLE users;", migrations[0].Down)
+	assert.Empty(t, migrations[2].Down)
+	assert.Len(t, migrations[0].Checksum, 64)
+	assert.NotEqual(t, migrations[0].Checksum, migrations[1].Checksum)
+}
+
+func TestLoadMigrationsRejectsBadSets(t *testing.T) {
+	for name, fsys := range map[string]fstest.MapFS{
+		"down without up": {"0001_initial.down.sql": {Data: []byte("DROP TABLE users;")}},
+		"name mismatch": {
+			"0001_initial.up.sql": {Data: []byte("CREATE TABLE users (id INT);")},
+			"0001_other.down.sql": {Data: []byte("DROP TABLE users;")},
+		},
+		"version zero": {"0000_initial.up.sql": {Data: []byte("SELECT 1;")}},
+	} {
+		_, err := db.LoadMigrations(fsys)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := db.Migrations()
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, migrations) {
+		assert.Equal(t, int64(1), migrations[0].Version)
+		assert.Contains(t, migrations[0].Up, "CREATE TABLE IF NOT EXISTS users")
+		assert.NotEmpty(t, migrations[0].Down)
+	}
+	for i, m := range migrations {
+		assert.NotEmpty(t, m.Down, "migration %d_%s needs a down file", m.Version, m.Name)
+		if i > 0 {
+			assert.Greater(t, m.Version, migrations[i-1].Version)
+		}
+	}
+}
+
+func TestAssetVersionTrigger(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+
+	var asset string
+	err := database.QueryRow(`WITH u AS (
+		INSERT INTO users (username, email) VALUES ('maker', 'maker@site.com') RETURNING id
+	)
+	INSERT INTO assets (creator_id, file_name, file_url, file_format)
+	SELECT id, 'chair.glb', 's3://assets/chair.glb', 'glb' FROM u RETURNING id`).Scan(&asset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := func() int64 {
+		var v int64
+		assert.NoError(t, database.QueryRow(`SELECT version FROM assets WHERE id = $1`, asset).Scan(&v))
+		return v
+	}
+	assert.Equal(t, int64(1), version())
+
+	_, err = database.Exec(`UPDATE assets SET description = 'oak' WHERE id = $1`, asset)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), version())
+
+	// An update that bumps the version itself isn't bumped twice, and one
+	// that changes nothing isn't bumped at all.
+	_, err = database.Exec(`UPDATE assets SET description = 'pine', version = version + 1 WHERE id = $1`, asset)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), version())
+	_, err = database.Exec(`UPDATE assets SET description = 'pine' WHERE id = $1`, asset)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), version())
+}
@@ -0,0 +1,33 @@
+-- Drops everything 0001_initial.up.sql creates. The pgcrypto and pg_trgm
+-- extensions are left installed since other schemas may use them.
+DROP TABLE IF EXISTS security_events;
+DROP TABLE IF EXISTS signing_keys;
+DROP TABLE IF EXISTS login_history;
+DROP TABLE IF EXISTS invitation_uses;
+DROP TABLE IF EXISTS invitations;
+
+DROP TRIGGER IF EXISTS user_stats_follow ON user_follows;
+DROP TRIGGER IF EXISTS user_stats_download ON asset_downloads;
+DROP TRIGGER IF EXISTS user_stats_like ON likes;
+DROP TRIGGER IF EXISTS user_stats_asset_delete ON assets;
+DROP TRIGGER IF EXISTS user_stats_asset_insert_update ON assets;
+DROP FUNCTION IF EXISTS user_stats_on_follow();
+DROP FUNCTION IF EXISTS user_stats_on_download();
+DROP FUNCTION IF EXISTS user_stats_on_like();
+DROP FUNCTION IF EXISTS user_stats_on_asset();
+DROP FUNCTION IF EXISTS bump_user_stats(UUID, BIGINT, BIGINT, BIGINT, BIGINT);
+DROP TABLE IF EXISTS user_download_stats_monthly;
+DROP TABLE IF EXISTS user_stats;
+
+DROP TABLE IF EXISTS user_follows;
+DROP VIEW IF EXISTS visible_public_assets;
+DROP TABLE IF EXISTS user_moderation_actions;
+DROP TABLE IF EXISTS notification_queue;
+DROP TABLE IF EXISTS notifications;
+DROP TABLE IF EXISTS likes;
+DROP TABLE IF EXISTS asset_downloads;
+DROP TABLE IF EXISTS asset_metadata;
+DROP TABLE IF EXISTS asset_tags;
+DROP TABLE IF EXISTS assets;
+DROP TABLE IF EXISTS user_credentials;
+DROP TABLE IF EXISTS users;
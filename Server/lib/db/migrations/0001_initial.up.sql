@@ -0,0 +1,345 @@
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+CREATE TABLE IF NOT EXISTS users (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    username VARCHAR(50) NOT NULL UNIQUE,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    full_name VARCHAR(100),
+    profile_picture_url TEXT,
+    bio TEXT,
+    website TEXT,
+    location VARCHAR(100),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS user_credentials (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    password_hash TEXT NOT NULL,
+    last_login TIMESTAMP WITH TIME ZONE,
+    is_active BOOLEAN DEFAULT true
+);
+
+CREATE TABLE IF NOT EXISTS assets (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    creator_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    file_name TEXT NOT NULL,
+    file_url TEXT NOT NULL,
+    file_format VARCHAR(10) CHECK (file_format IN ('glb', 'gltf', 'obj')),
+    preview_url TEXT,
+    thumbnail_url TEXT,
+    downloads INT DEFAULT 0,
+    likes INT DEFAULT 0,
+    description TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    is_public BOOLEAN DEFAULT true
+);
+
+CREATE TABLE IF NOT EXISTS asset_tags (
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    tag VARCHAR(50) NOT NULL,
+    PRIMARY KEY(asset_id, tag)
+);
+
+CREATE TABLE IF NOT EXISTS asset_metadata (
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    key VARCHAR(50) NOT NULL,
+    value TEXT,
+    PRIMARY KEY(asset_id, key)
+);
+
+CREATE TABLE IF NOT EXISTS asset_downloads (
+    id SERIAL PRIMARY KEY,
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    downloaded_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS likes (
+    id SERIAL PRIMARY KEY,
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    UNIQUE(asset_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(20) CHECK(type IN ('email', 'sms', 'push')),
+    destination VARCHAR(255) NOT NULL,   -- email/phone/device_token
+    subject TEXT,
+    message TEXT,
+    status VARCHAR(20) CHECK(status IN ('queued', 'sent', 'failed')),
+    sent_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS notification_queue (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    notification_id UUID NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+    queued_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    processed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_created_at_id ON users (created_at, id);
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING gin (username gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_full_name_trgm ON users USING gin (full_name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_bio_trgm ON users USING gin (bio gin_trgm_ops);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user'
+    CHECK (role IN ('user', 'moderator', 'admin'));
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_until TIMESTAMP WITH TIME ZONE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS banned_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS user_moderation_actions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    moderator_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    action VARCHAR(20) NOT NULL CHECK (action IN ('suspend', 'lift', 'ban')),
+    reason TEXT NOT NULL,
+    notes TEXT,                          -- private, moderators only
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_moderation_actions_user ON user_moderation_actions (user_id, created_at DESC);
+
+-- Public assets of creators who are neither banned nor currently suspended.
+-- Gallery listings read from this view so a suspension hides a creator's
+-- assets the moment it starts and shows them again once it expires.
+CREATE OR REPLACE VIEW visible_public_assets AS
+SELECT a.*
+FROM assets a
+JOIN users u ON u.id = a.creator_id
+WHERE a.is_public
+  AND u.banned_at IS NULL
+  AND (u.suspended_until IS NULL OR u.suspended_until <= now());
+
+CREATE TABLE IF NOT EXISTS user_follows (
+    follower_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    followee_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    PRIMARY KEY (follower_id, followee_id),
+    CHECK (follower_id <> followee_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_follows_followee ON user_follows (followee_id);
+
+-- Creator profile counters. Kept current by the triggers below so profile
+-- views never aggregate over assets, likes or asset_downloads.
+CREATE TABLE IF NOT EXISTS user_stats (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    public_assets BIGINT NOT NULL DEFAULT 0,
+    total_downloads BIGINT NOT NULL DEFAULT 0,
+    total_likes BIGINT NOT NULL DEFAULT 0,
+    followers BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+-- Downloads per creator per calendar month (UTC). This is history: it is not
+-- reduced when an asset is deleted, unlike user_stats.total_downloads.
+CREATE TABLE IF NOT EXISTS user_download_stats_monthly (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    month DATE NOT NULL,
+    downloads BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, month)
+);
+
+CREATE OR REPLACE FUNCTION bump_user_stats(p_user UUID, p_assets BIGINT, p_downloads BIGINT, p_likes BIGINT, p_followers BIGINT)
+RETURNS void AS $$
+BEGIN
+    -- The user may already be gone when this runs from a cascade delete.
+    INSERT INTO user_stats (user_id, public_assets, total_downloads, total_likes, followers)
+    SELECT p_user, p_assets, p_downloads, p_likes, p_followers
+    WHERE EXISTS (SELECT 1 FROM users WHERE id = p_user)
+    ON CONFLICT (user_id) DO UPDATE SET
+        public_assets = user_stats.public_assets + EXCLUDED.public_assets,
+        total_downloads = user_stats.total_downloads + EXCLUDED.total_downloads,
+        total_likes = user_stats.total_likes + EXCLUDED.total_likes,
+        followers = user_stats.followers + EXCLUDED.followers,
+        updated_at = now();
+END $$ LANGUAGE plpgsql;
+
+-- Runs BEFORE DELETE so the asset's likes and downloads are still there to
+-- be subtracted; by the time the cascade removes them the asset is gone and
+-- their own triggers find no creator to update.
+CREATE OR REPLACE FUNCTION user_stats_on_asset() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        PERFORM bump_user_stats(NEW.creator_id, CASE WHEN NEW.is_public THEN 1 ELSE 0 END, 0, 0, 0);
+        RETURN NEW;
+    ELSIF TG_OP = 'DELETE' THEN
+        PERFORM bump_user_stats(OLD.creator_id,
+            CASE WHEN OLD.is_public THEN -1 ELSE 0 END,
+            -(SELECT count(*) FROM asset_downloads WHERE asset_id = OLD.id),
+            -(SELECT count(*) FROM likes WHERE asset_id = OLD.id),
+            0);
+        RETURN OLD;
+    END IF;
+    IF OLD.creator_id IS DISTINCT FROM NEW.creator_id THEN
+        PERFORM bump_user_stats(OLD.creator_id,
+            CASE WHEN OLD.is_public THEN -1 ELSE 0 END,
+            -(SELECT count(*) FROM asset_downloads WHERE asset_id = OLD.id),
+            -(SELECT count(*) FROM likes WHERE asset_id = OLD.id),
+            0);
+        PERFORM bump_user_stats(NEW.creator_id,
+            CASE WHEN NEW.is_public THEN 1 ELSE 0 END,
+            (SELECT count(*) FROM asset_downloads WHERE asset_id = NEW.id),
+            (SELECT count(*) FROM likes WHERE asset_id = NEW.id),
+            0);
+    ELSIF OLD.is_public IS DISTINCT FROM NEW.is_public THEN
+        PERFORM bump_user_stats(NEW.creator_id, CASE WHEN NEW.is_public THEN 1 ELSE -1 END, 0, 0, 0);
+    END IF;
+    RETURN NEW;
+END $$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER user_stats_asset_insert_update
+    AFTER INSERT OR UPDATE OF creator_id, is_public ON assets
+    FOR EACH ROW EXECUTE FUNCTION user_stats_on_asset();
+CREATE OR REPLACE TRIGGER user_stats_asset_delete
+    BEFORE DELETE ON assets
+    FOR EACH ROW EXECUTE FUNCTION user_stats_on_asset();
+
+CREATE OR REPLACE FUNCTION user_stats_on_like() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        PERFORM bump_user_stats((SELECT creator_id FROM assets WHERE id = NEW.asset_id), 0, 0, 1, 0);
+    ELSE
+        PERFORM bump_user_stats((SELECT creator_id FROM assets WHERE id = OLD.asset_id), 0, 0, -1, 0);
+    END IF;
+    RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER user_stats_like
+    AFTER INSERT OR DELETE ON likes
+    FOR EACH ROW EXECUTE FUNCTION user_stats_on_like();
+
+CREATE OR REPLACE FUNCTION user_stats_on_download() RETURNS trigger AS $$
+DECLARE
+    creator UUID;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        creator := (SELECT creator_id FROM assets WHERE id = NEW.asset_id);
+        PERFORM bump_user_stats(creator, 0, 1, 0, 0);
+        IF creator IS NOT NULL THEN
+            INSERT INTO user_download_stats_monthly (user_id, month, downloads)
+            VALUES (creator, date_trunc('month', NEW.downloaded_at AT TIME ZONE 'UTC')::date, 1)
+            ON CONFLICT (user_id, month) DO UPDATE SET downloads = user_download_stats_monthly.downloads + 1;
+        END IF;
+    ELSE
+        creator := (SELECT creator_id FROM assets WHERE id = OLD.asset_id);
+        PERFORM bump_user_stats(creator, 0, -1, 0, 0);
+    END IF;
+    RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER user_stats_download
+    AFTER INSERT OR DELETE ON asset_downloads
+    FOR EACH ROW EXECUTE FUNCTION user_stats_on_download();
+
+CREATE OR REPLACE FUNCTION user_stats_on_follow() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        PERFORM bump_user_stats(NEW.followee_id, 0, 0, 0, 1);
+    ELSE
+        PERFORM bump_user_stats(OLD.followee_id, 0, 0, 0, -1);
+    END IF;
+    RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER user_stats_follow
+    AFTER INSERT OR DELETE ON user_follows
+    FOR EACH ROW EXECUTE FUNCTION user_stats_on_follow();
+
+-- Backfill counters for activity recorded before the triggers existed.
+INSERT INTO user_stats (user_id, public_assets, total_downloads, total_likes, followers)
+SELECT u.id,
+       (SELECT count(*) FROM assets a WHERE a.creator_id = u.id AND a.is_public),
+       (SELECT count(*) FROM asset_downloads d JOIN assets a ON a.id = d.asset_id WHERE a.creator_id = u.id),
+       (SELECT count(*) FROM likes l JOIN assets a ON a.id = l.asset_id WHERE a.creator_id = u.id),
+       (SELECT count(*) FROM user_follows f WHERE f.followee_id = u.id)
+FROM users u
+ON CONFLICT (user_id) DO NOTHING;
+
+INSERT INTO user_download_stats_monthly (user_id, month, downloads)
+SELECT a.creator_id, date_trunc('month', d.downloaded_at AT TIME ZONE 'UTC')::date, count(*)
+FROM asset_downloads d JOIN assets a ON a.id = d.asset_id
+GROUP BY 1, 2
+ON CONFLICT (user_id, month) DO NOTHING;
+
+-- Invitations for invite-only registration. Only a SHA-256 hash of each
+-- code is stored; the code itself is shown to the issuer once.
+CREATE TABLE IF NOT EXISTS invitations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    code_hash TEXT NOT NULL UNIQUE,
+    issuer_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    max_uses INT NOT NULL DEFAULT 1 CHECK (max_uses > 0),
+    uses INT NOT NULL DEFAULT 0,
+    email VARCHAR(255),                  -- only this address may redeem it
+    expires_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    CHECK (uses BETWEEN 0 AND max_uses)
+);
+
+CREATE INDEX IF NOT EXISTS idx_invitations_issuer ON invitations (issuer_id, created_at DESC);
+
+-- Who registered with which invitation. A user redeems at most one.
+CREATE TABLE IF NOT EXISTS invitation_uses (
+    invitation_id UUID NOT NULL REFERENCES invitations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    used_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    PRIMARY KEY (invitation_id, user_id)
+);
+
+-- Every sign-in attempt against an existing account. device_hash is a
+-- SHA-256 of the user agent and the client's device id; network is the
+-- /24 (IPv4) or /48 (IPv6) the address belongs to, which stands in for
+-- location.
+CREATE TABLE IF NOT EXISTS login_history (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    ip INET,
+    network CIDR,
+    user_agent TEXT,
+    device_hash TEXT NOT NULL,
+    outcome VARCHAR(20) NOT NULL
+        CHECK (outcome IN ('success', 'invalid_password', 'inactive', 'suspended', 'banned')),
+    new_device BOOLEAN NOT NULL DEFAULT false,
+    new_location BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_history_user ON login_history (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_login_history_device ON login_history (user_id, device_hash) WHERE outcome = 'success';
+
+-- Token signing keys. private_key is the PKCS#8 key sealed with AES-GCM
+-- under a key derived from JWT_SECRET. Retired keys no longer sign but stay
+-- published until every token they signed has expired.
+CREATE TABLE IF NOT EXISTS signing_keys (
+    kid TEXT PRIMARY KEY,
+    algorithm VARCHAR(10) NOT NULL,
+    private_key BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    retired_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Security-relevant events on an account that aren't logins, shown to the
+-- account owner. actor_id is the admin behind an impersonated session.
+CREATE TABLE IF NOT EXISTS security_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    event VARCHAR(40) NOT NULL CHECK (event IN ('impersonation_started', 'impersonated_action')),
+    method TEXT,
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_security_events_user ON security_events (user_id, created_at DESC);
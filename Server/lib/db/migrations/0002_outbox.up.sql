@@ -0,0 +1,31 @@
+-- Domain events waiting to be published. Services insert them in the
+-- transaction that makes the change they describe; the relay in lib/events
+-- publishes them to the broker and marks them delivered.
+CREATE TABLE IF NOT EXISTS outbox (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    topic TEXT NOT NULL CHECK (topic <> ''),
+    key TEXT NOT NULL DEFAULT '',
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    -- A failed delivery is retried once available_at has passed.
+    available_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    delivered_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox (available_at, created_at) WHERE delivered_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_delivered ON outbox (delivered_at) WHERE delivered_at IS NOT NULL;
+
+-- Wakes relays listening on the outbox channel once the inserting
+-- transaction commits. Postgres folds the notifications of a transaction
+-- into one, so a busy writer costs a single wakeup.
+CREATE OR REPLACE FUNCTION outbox_notify() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('outbox', '');
+    RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER outbox_notify
+    AFTER INSERT ON outbox
+    FOR EACH STATEMENT EXECUTE FUNCTION outbox_notify();
@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS asset_version ON assets;
+DROP FUNCTION IF EXISTS bump_asset_version();
+ALTER TABLE assets DROP COLUMN IF EXISTS version;
+ALTER TABLE users DROP COLUMN IF EXISTS version;
@@ -0,0 +1,21 @@
+-- Row versions for optimistic concurrency. Every update that changes what
+-- clients see bumps version, and clients send back the version they read,
+-- as an etag, so a write based on stale data can be refused.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE assets ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+-- Assets are written from several places, so a trigger bumps their version
+-- on any update that doesn't bump it itself.
+CREATE OR REPLACE FUNCTION bump_asset_version() RETURNS trigger AS $$
+BEGIN
+    IF NEW.version = OLD.version THEN
+        NEW.version := OLD.version + 1;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER asset_version
+    BEFORE UPDATE ON assets
+    FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*)
+    EXECUTE FUNCTION bump_asset_version();
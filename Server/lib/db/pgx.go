@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// The methods in this file talk to Pool directly. Queries made through
+// Pool scan uuid columns into [16]byte types such as uuid.UUID and
+// timestamptz into time.Time without a round trip through text.
+
+var errNoPool = errors.New("database has no pgx pool")
+
+// SendBatch sends every query queued in b in a single round trip. The
+// results must be read in order and closed.
+func (db *DB) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	if db.Pool == nil {
+		return errBatchResults{errNoPool}
+	}
+	return db.Pool.SendBatch(ctx, b)
+}
+
+// CopyFrom bulk-loads rows into table with the COPY protocol and returns
+// how many were copied. It is much faster than INSERT for large loads but
+// has no ON CONFLICT or RETURNING.
+func (db *DB) CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, rows pgx.CopyFromSource) (int64, error) {
+	if db.Pool == nil {
+		return 0, errNoPool
+	}
+	n, err := db.Pool.CopyFrom(ctx, table, columns, rows)
+	if err != nil {
+		return n, fmt.Errorf("failed to copy into %s: %w", table.Sanitize(), err)
+	}
+	return n, nil
+}
+
+// Listen calls handle for every notification sent on channel until ctx is
+// done or the connection fails, on a connection taken out of the pool.
+func (db *DB) Listen(ctx context.Context, channel string, handle func(*pgconn.Notification)) error {
+	if db.Pool == nil {
+		return errNoPool
+	}
+	pooled, err := db.Pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	// The session stays subscribed, so take it out of the pool for good.
+	conn := pooled.Hijack()
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", channel, err)
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed waiting for notification: %w", err)
+		}
+		handle(n)
+	}
+}
+
+// Notify sends payload to every session listening on channel. It always
+// runs on the pool, never inside a WithTx transaction, so listeners hear
+// about it at once even if that transaction later rolls back. To notify
+// only on commit, run SELECT pg_notify($1, $2) through the Tx instead.
+func (db *DB) Notify(ctx context.Context, channel, payload string) error {
+	_, err := db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, channel, payload)
+	return err
+}
+
+// Array returns a scanner that reads a Postgres array into dest, a pointer
+// to a slice such as *[]string, through database/sql.
+func Array(dest any) sql.Scanner {
+	return pgtype.NewMap().SQLScanner(dest)
+}
+
+type errBatchResults struct{ err error }
+
+func (r errBatchResults) Exec() (pgconn.CommandTag, error) { return pgconn.CommandTag{}, r.err }
+func (r errBatchResults) Query() (pgx.Rows, error)         { return nil, r.err }
+func (r errBatchResults) QueryRow() pgx.Row                { return errRow{r.err} }
+func (r errBatchResults) Close() error                     { return r.err }
+
+type errRow struct{ err error }
+
+func (r errRow) Scan(...any) error { return r.err }
@@ -0,0 +1,97 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shatwik7/polycrate/lib/db/dbtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendBatch(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+	ctx := context.Background()
+
+	b := &pgx.Batch{}
+	b.Queue(`INSERT INTO users (username, email) VALUES ($1, $2)`, "alice", "alice@site.com")
+	b.Queue(`INSERT INTO users (username, email) VALUES ($1, $2)`, "bob", "bob@site.com")
+	b.Queue(`SELECT count(*) FROM users`)
+	results := database.SendBatch(ctx, b)
+	for i := 0; i < 2; i++ {
+		tag, err := results.Exec()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), tag.RowsAffected())
+	}
+	var n int64
+	assert.NoError(t, results.QueryRow().Scan(&n))
+	assert.Equal(t, int64(2), n)
+	assert.NoError(t, results.Close())
+}
+
+func TestCopyFrom(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+	ctx := context.Background()
+
+	rows := [][]any{
+		{"alice", "alice@site.com"},
+		{"bob", "bob@site.com"},
+		{"carol", "carol@site.com"},
+	}
+	n, err := database.CopyFrom(ctx, pgx.Identifier{"users"}, []string{"username", "email"}, pgx.CopyFromRows(rows))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	var count int64
+	assert.NoError(t, database.QueryRow(`SELECT count(*) FROM users`).Scan(&count))
+	assert.Equal(t, int64(3), count)
+
+	_, err = database.CopyFrom(ctx, pgx.Identifier{"users"}, []string{"username", "email"}, pgx.CopyFromRows(rows[:1]))
+	assert.ErrorContains(t, err, "failed to copy into")
+}
+
+func TestListenNotify(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Channels are shared by the whole database, so use one of our own.
+	channel := dbtest.SchemaName(t.Name())
+	received := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- database.Listen(ctx, channel, func(n *pgconn.Notification) {
+			select {
+			case received <- n.Payload:
+			default:
+			}
+		})
+	}()
+
+	// Notifications sent before LISTEN runs are lost, so keep sending until
+	// one arrives.
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(5 * time.Second)
+wait:
+	for {
+		select {
+		case payload := <-received:
+			assert.Equal(t, "hello", payload)
+			break wait
+		case err := <-done:
+			t.Fatalf("Listen returned early: %v", err)
+		case <-tick.C:
+			assert.NoError(t, database.Notify(ctx, channel, "hello"))
+		case <-timeout:
+			t.Fatal("no notification received")
+		}
+	}
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DefaultMaxOpenConns    = 25
+	DefaultMaxIdleConns    = 10
+	DefaultConnMaxLifetime = 30 * time.Minute
+	DefaultConnMaxIdleTime = 5 * time.Minute
+	DefaultConnectTimeout  = 5 * time.Second
+
+	startupRetryBaseWait = 100 * time.Millisecond
+	startupRetryMaxWait  = 5 * time.Second
+)
+
+type poolOptions struct {
+	maxOpen        int
+	maxIdle        int
+	maxLifetime    time.Duration
+	maxIdleTime    time.Duration
+	connectTimeout time.Duration
+	startupTimeout time.Duration
+
+	replicas      []string
+	maxReplicaLag time.Duration
+	checkInterval time.Duration
+
+	slowQueryThreshold time.Duration
+	tracerProvider     trace.TracerProvider
+	meterProvider      metric.MeterProvider
+	tracer             *tracer
+}
+
+type Option func(*poolOptions)
+
+// WithMaxOpenConns caps the number of connections to Postgres. Callers
+// wait for a free connection once the cap is reached.
+func WithMaxOpenConns(n int) Option {
+	return func(o *poolOptions) { o.maxOpen = n }
+}
+
+// WithMaxIdleConns sets how many idle connections are kept. A connection
+// released while that many are idle is closed.
+func WithMaxIdleConns(n int) Option {
+	return func(o *poolOptions) { o.maxIdle = n }
+}
+
+// WithConnMaxLifetime sets how long a connection is used before it is
+// closed and replaced.
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(o *poolOptions) { o.maxLifetime = d }
+}
+
+// WithConnMaxIdleTime sets how long a connection may sit idle before it is
+// closed.
+func WithConnMaxIdleTime(d time.Duration) Option {
+	return func(o *poolOptions) { o.maxIdleTime = d }
+}
+
+// WithConnectTimeout limits how long opening a single connection may take.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(o *poolOptions) { o.connectTimeout = d }
+}
+
+// WithStartupRetry makes NewDB wait for the database, pinging it with
+// backoff until it answers or d has passed. Without it NewDB doesn't
+// connect at all.
+func WithStartupRetry(d time.Duration) Option {
+	return func(o *poolOptions) { o.startupTimeout = d }
+}
+
+// WithReplicas adds read replicas, each with a pool of its own sized like
+// the primary's. Reads made with a ReadOnly context are spread across the
+// healthy ones.
+func WithReplicas(dataSourceNames ...string) Option {
+	return func(o *poolOptions) { o.replicas = append(o.replicas, dataSourceNames...) }
+}
+
+// WithMaxReplicaLag sets how far behind the primary a replica may fall
+// before reads stop going to it.
+func WithMaxReplicaLag(d time.Duration) Option {
+	return func(o *poolOptions) { o.maxReplicaLag = d }
+}
+
+// WithReplicaCheckInterval sets how often replicas are health-checked.
+func WithReplicaCheckInterval(d time.Duration) Option {
+	return func(o *poolOptions) { o.checkInterval = d }
+}
+
+func (o poolOptions) apply(config *pgxpool.Config, idleConns func() int32) error {
+	if o.maxOpen <= 0 {
+		return fmt.Errorf("max open connections must be positive, got %d", o.maxOpen)
+	}
+	if o.maxIdle < 0 {
+		return fmt.Errorf("max idle connections can't be negative, got %d", o.maxIdle)
+	}
+	config.MaxConns = int32(o.maxOpen)
+	config.MaxConnLifetime = o.maxLifetime
+	config.MaxConnIdleTime = o.maxIdleTime
+	config.ConnConfig.ConnectTimeout = o.connectTimeout
+	if o.tracer != nil {
+		config.ConnConfig.Tracer = o.tracer
+	}
+	if o.maxIdle < o.maxOpen {
+		maxIdle := int32(o.maxIdle)
+		config.AfterRelease = func(*pgx.Conn) bool { return idleConns() < maxIdle }
+	}
+	return nil
+}
+
+// waitReady pings db until it answers or timeout has passed.
+func (db *DB) waitReady(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		err := db.Pool.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		wait := min(startupRetryBaseWait<<attempt, startupRetryMaxWait)
+		if waitErr := sleepCtx(ctx, wait); waitErr != nil {
+			return fmt.Errorf("database not ready after %s: %w", timeout, err)
+		}
+	}
+}
+
+// PoolStats is a snapshot of the connection pool.
+type PoolStats struct {
+	MaxOpen int `json:"max_open"`
+	// Open counts connections in use, idle and being opened.
+	Open  int `json:"open"`
+	InUse int `json:"in_use"`
+	Idle  int `json:"idle"`
+	// WaitCount is how many times a caller had to wait for a connection,
+	// and WaitDuration how long those waits took in total.
+	WaitCount    int64         `json:"wait_count"`
+	WaitDuration time.Duration `json:"wait_duration_ns"`
+	// MaxLifetimeClosed and MaxIdleTimeClosed count connections closed for
+	// reaching the maximum lifetime or idle time.
+	MaxLifetimeClosed int64 `json:"max_lifetime_closed"`
+	MaxIdleTimeClosed int64 `json:"max_idle_time_closed"`
+}
+
+// Stats returns the current pool statistics. A DB without a pgx pool
+// reports the database/sql pool instead.
+func (db *DB) Stats() PoolStats {
+	if db.Pool == nil {
+		if db.Conn == nil {
+			return PoolStats{}
+		}
+		s := db.Conn.Stats()
+		return PoolStats{
+			MaxOpen:           s.MaxOpenConnections,
+			Open:              s.OpenConnections,
+			InUse:             s.InUse,
+			Idle:              s.Idle,
+			WaitCount:         s.WaitCount,
+			WaitDuration:      s.WaitDuration,
+			MaxLifetimeClosed: s.MaxLifetimeClosed,
+			MaxIdleTimeClosed: s.MaxIdleTimeClosed,
+		}
+	}
+	s := db.Pool.Stat()
+	return PoolStats{
+		MaxOpen:           int(s.MaxConns()),
+		Open:              int(s.TotalConns()),
+		InUse:             int(s.AcquiredConns()),
+		Idle:              int(s.IdleConns()),
+		WaitCount:         s.EmptyAcquireCount(),
+		WaitDuration:      s.EmptyAcquireWaitTime(),
+		MaxLifetimeClosed: s.MaxLifetimeDestroyCount(),
+		MaxIdleTimeClosed: s.MaxIdleDestroyCount(),
+	}
+}
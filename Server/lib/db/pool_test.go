@@ -0,0 +1,55 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolOptions(t *testing.T) {
+	config, err := pgxpool.ParseConfig("postgres://user@localhost:5432/db")
+	assert.NoError(t, err)
+
+	o := poolOptions{maxOpen: 8, maxIdle: 2, maxLifetime: time.Hour, maxIdleTime: time.Minute, connectTimeout: time.Second}
+	idle := int32(0)
+	assert.NoError(t, o.apply(config, func() int32 { return idle }))
+	assert.Equal(t, int32(8), config.MaxConns)
+	assert.Equal(t, time.Hour, config.MaxConnLifetime)
+	assert.Equal(t, time.Minute, config.MaxConnIdleTime)
+	assert.Equal(t, time.Second, config.ConnConfig.ConnectTimeout)
+
+	// Released connections are kept until two are idle.
+	assert.True(t, config.AfterRelease(nil))
+	idle = 2
+	assert.False(t, config.AfterRelease(nil))
+
+	o.maxOpen = 0
+	assert.Error(t, o.apply(config, nil))
+	o.maxOpen, o.maxIdle = 8, -1
+	assert.Error(t, o.apply(config, nil))
+}
+
+func TestPoolOptionsIdleCapNotNeeded(t *testing.T) {
+	config, err := pgxpool.ParseConfig("postgres://user@localhost:5432/db")
+	assert.NoError(t, err)
+	o := poolOptions{maxOpen: 4, maxIdle: 4}
+	assert.NoError(t, o.apply(config, nil))
+	assert.Nil(t, config.AfterRelease)
+}
+
+func TestNewDBStartupRetryGivesUp(t *testing.T) {
+	start := time.Now()
+	_, err := NewDB("postgres://user@127.0.0.1:1/db?sslmode=disable",
+		WithConnectTimeout(100*time.Millisecond), WithStartupRetry(300*time.Millisecond))
+	assert.ErrorContains(t, err, "database not ready")
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestNewDBWithoutStartupRetryDoesNotConnect(t *testing.T) {
+	database, err := NewDB("postgres://user@127.0.0.1:1/db?sslmode=disable", WithMaxOpenConns(3))
+	assert.NoError(t, err)
+	defer database.Close()
+	assert.Equal(t, PoolStats{MaxOpen: 3}, database.Stats())
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultMaxReplicaLag        = 5 * time.Second
+	DefaultReplicaCheckInterval = 2 * time.Second
+)
+
+// replicaStateQuery reads what replicaState.lag needs to decide whether a
+// replica may serve reads. pg_stat_wal_receiver has at most one row, and
+// its status is only visible to roles with pg_read_all_stats (pg_monitor
+// has it).
+const replicaStateQuery = `SELECT pg_is_in_recovery(),
+		EXISTS (SELECT 1 FROM pg_stat_wal_receiver),
+		(SELECT status FROM pg_stat_wal_receiver),
+		COALESCE(pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn(), false),
+		EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())::float8`
+
+// replicaState is one row of replicaStateQuery.
+type replicaState struct {
+	inRecovery     bool
+	hasReceiver    bool
+	receiverStatus sql.NullString
+	// caughtUp is whether everything received has been replayed.
+	caughtUp bool
+	// replayAge is the time in seconds since the last replayed
+	// transaction committed on the primary, NULL before the first one.
+	replayAge sql.NullFloat64
+}
+
+// lag returns how far the replica is behind its primary, or an error if
+// it can't be trusted to be close at all. A server that isn't in recovery
+// is a primary, not a replica. A standby whose WAL receiver isn't
+// streaming has lost its primary and replays nothing new, so however
+// stale it is it looks caught up. Only a streaming standby's replay
+// position says anything: when it has replayed everything it received it
+// isn't lagging, even if the primary has been idle for a while, and
+// otherwise it is as far behind as the last transaction it replayed.
+func (s replicaState) lag() (time.Duration, error) {
+	switch {
+	case !s.inRecovery:
+		return 0, errors.New("server is not in recovery, so it is not a replica")
+	case !s.hasReceiver:
+		return 0, errors.New("no WAL receiver is running")
+	case !s.receiverStatus.Valid:
+		return 0, errors.New("WAL receiver status isn't visible, grant the role pg_monitor")
+	case s.receiverStatus.String != "streaming":
+		return 0, fmt.Errorf("WAL receiver is %s, not streaming", s.receiverStatus.String)
+	case s.caughtUp:
+		return 0, nil
+	case !s.replayAge.Valid:
+		return 0, errors.New("no transaction has been replayed yet")
+	}
+	return time.Duration(s.replayAge.Float64 * float64(time.Second)), nil
+}
+
+type ctxKey int
+
+const (
+	readOnlyKey ctxKey = iota
+	readYourWritesKey
+)
+
+// ReadOnly marks ctx so QueryContext and QueryRowContext calls made with it
+// may be served by a read replica. Mark only statements that don't write:
+// ExecContext, transactions, batches and COPY always use the primary, but
+// an INSERT ... RETURNING sent through QueryContext would not.
+func ReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKey, true)
+}
+
+// ReadYourWrites marks ctx so reads made with it go to the primary even if
+// they are also marked ReadOnly, for callers that must see what they have
+// just written.
+func ReadYourWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readYourWritesKey, true)
+}
+
+// ReplicaStatus is the last health check result for a read replica.
+type ReplicaStatus struct {
+	Host      string        `json:"host"`
+	Healthy   bool          `json:"healthy"`
+	Lag       time.Duration `json:"lag_ns"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type replica struct {
+	db *DB
+
+	mu     sync.Mutex
+	status ReplicaStatus
+	// healthy mirrors status.Healthy so routing doesn't take the lock.
+	healthy atomic.Bool
+}
+
+// reader returns the connection that should serve a read made with ctx:
+// the next healthy replica in turn if ctx is marked ReadOnly, and the
+// primary otherwise or when no replica is healthy.
+func (db *DB) reader(ctx context.Context) *sql.DB {
+	if len(db.replicas) == 0 || ctx.Value(readOnlyKey) == nil || ctx.Value(readYourWritesKey) != nil {
+		return db.Conn
+	}
+	start := db.nextReplica.Add(1)
+	for i := range db.replicas {
+		r := db.replicas[(int(start)+i)%len(db.replicas)]
+		if r.healthy.Load() {
+			return r.db.Conn
+		}
+	}
+	return db.Conn
+}
+
+// Replicas returns the status of every read replica.
+func (db *DB) Replicas() []ReplicaStatus {
+	statuses := make([]ReplicaStatus, len(db.replicas))
+	for i, r := range db.replicas {
+		r.mu.Lock()
+		statuses[i] = r.status
+		r.mu.Unlock()
+	}
+	return statuses
+}
+
+// check marks r healthy if it answers, is a streaming standby and is at
+// most maxLag behind.
+func (r *replica) check(ctx context.Context, timeout, maxLag time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var state replicaState
+	var lag time.Duration
+	err := r.db.Conn.QueryRowContext(ctx, replicaStateQuery).
+		Scan(&state.inRecovery, &state.hasReceiver, &state.receiverStatus, &state.caughtUp, &state.replayAge)
+	if err == nil {
+		lag, err = state.lag()
+	}
+	if err == nil && lag > maxLag {
+		err = fmt.Errorf("replica is %s behind, more than %s", lag.Round(time.Millisecond), maxLag)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	wasHealthy, firstCheck := r.status.Healthy, r.status.CheckedAt.IsZero()
+	r.status.Healthy, r.status.Lag, r.status.CheckedAt, r.status.Error = err == nil, lag, time.Now(), ""
+	if err != nil {
+		r.status.Error = err.Error()
+		if wasHealthy {
+			log.Printf("db: replica %s taken out of rotation: %v", r.status.Host, err)
+		}
+	} else if !wasHealthy && !firstCheck {
+		log.Printf("db: replica %s back in rotation", r.status.Host)
+	}
+	r.healthy.Store(err == nil)
+}
+
+// checkReplicas checks every replica now and then every interval until ctx
+// is done.
+func (db *DB) checkReplicas(ctx context.Context, interval, timeout, maxLag time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, r := range db.replicas {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.check(ctx, timeout, maxLag)
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
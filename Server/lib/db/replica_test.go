@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const unreachableDSN = "postgres://user@127.0.0.1:1/db?sslmode=disable&connect_timeout=1"
+
+func openLazy(t *testing.T) *sql.DB {
+	t.Helper()
+	conn, err := sql.Open("pgx", unreachableDSN)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestReaderRouting(t *testing.T) {
+	primary := &DB{Conn: openLazy(t)}
+	a, b := &replica{db: &DB{Conn: openLazy(t)}}, &replica{db: &DB{Conn: openLazy(t)}}
+	primary.replicas = []*replica{a, b}
+	readOnly := ReadOnly(context.Background())
+
+	// No replica is healthy yet.
+	assert.Same(t, primary.Conn, primary.reader(readOnly))
+
+	a.healthy.Store(true)
+	b.healthy.Store(true)
+	seen := map[*sql.DB]int{}
+	for i := 0; i < 10; i++ {
+		seen[primary.reader(readOnly)]++
+	}
+	assert.Equal(t, map[*sql.DB]int{a.db.Conn: 5, b.db.Conn: 5}, seen)
+
+	assert.Same(t, primary.Conn, primary.reader(context.Background()), "unmarked reads use the primary")
+	assert.Same(t, primary.Conn, primary.reader(ReadYourWrites(readOnly)))
+	assert.Same(t, primary.Conn, primary.reader(ReadOnly(ReadYourWrites(context.Background()))))
+
+	b.healthy.Store(false)
+	for i := 0; i < 4; i++ {
+		assert.Same(t, a.db.Conn, primary.reader(readOnly))
+	}
+}
+
+func TestReplicaCheckMarksUnreachableReplicaDown(t *testing.T) {
+	r := &replica{db: &DB{Conn: openLazy(t)}, status: ReplicaStatus{Host: "127.0.0.1:1", Healthy: true}}
+	r.healthy.Store(true)
+	r.check(context.Background(), 500*time.Millisecond, time.Second)
+
+	assert.False(t, r.healthy.Load())
+	status := r.status
+	assert.False(t, status.Healthy)
+	assert.NotEmpty(t, status.Error)
+	assert.False(t, status.CheckedAt.IsZero())
+}
+
+func TestReplicaStateLag(t *testing.T) {
+	streaming := replicaState{
+		inRecovery:     true,
+		hasReceiver:    true,
+		receiverStatus: sql.NullString{String: "streaming", Valid: true},
+		replayAge:      sql.NullFloat64{Float64: 3, Valid: true},
+	}
+	tests := []struct {
+		name    string
+		edit    func(s *replicaState)
+		lag     time.Duration
+		healthy bool
+	}{
+		{"replaying", func(s *replicaState) {}, 3 * time.Second, true},
+		{"caught up with an idle primary", func(s *replicaState) { s.caughtUp = true; s.replayAge.Float64 = 3600 }, 0, true},
+		{"primary", func(s *replicaState) { s.inRecovery = false; s.hasReceiver = false; s.caughtUp = true }, 0, false},
+		{"lost its primary", func(s *replicaState) { s.hasReceiver = false; s.receiverStatus.Valid = false; s.caughtUp = true }, 0, false},
+		{"receiver reconnecting", func(s *replicaState) { s.receiverStatus.String = "waiting"; s.caughtUp = true }, 0, false},
+		{"status hidden", func(s *replicaState) { s.receiverStatus.Valid = false; s.caughtUp = true }, 0, false},
+		{"nothing replayed yet", func(s *replicaState) { s.replayAge.Valid = false }, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := streaming
+			tt.edit(&s)
+			lag, err := s.lag()
+			assert.Equal(t, tt.healthy, err == nil, err)
+			assert.Equal(t, tt.lag, lag)
+		})
+	}
+}
+
+func TestNewDBWithReplicas(t *testing.T) {
+	database, err := NewDB(unreachableDSN, WithReplicas(unreachableDSN, unreachableDSN),
+		WithConnectTimeout(100*time.Millisecond), WithReplicaCheckInterval(50*time.Millisecond))
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		for _, st := range database.Replicas() {
+			if st.CheckedAt.IsZero() {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+	statuses := database.Replicas()
+	assert.Len(t, statuses, 2)
+	for _, st := range statuses {
+		assert.Equal(t, "127.0.0.1:1", st.Host)
+		assert.False(t, st.Healthy)
+	}
+	assert.Same(t, database.Conn, database.reader(ReadOnly(context.Background())))
+	assert.NoError(t, database.Close())
+
+	_, err = NewDB(unreachableDSN, WithReplicas(unreachableDSN), WithReplicaCheckInterval(0))
+	assert.Error(t, err)
+}
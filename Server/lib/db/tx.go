@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// MaxTxAttempts is how many times WithTx runs a transaction that keeps
+	// failing with a serialization failure or deadlock.
+	MaxTxAttempts   = 5
+	txRetryBaseWait = 10 * time.Millisecond
+	txRetryMaxWait  = time.Second
+)
+
+// Querier is what *DB and *Tx have in common, so code written against it
+// runs either directly or inside a transaction. WithTx on a *Tx nests
+// through a savepoint.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	WithTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) error
+}
+
+var (
+	_ Querier = (*DB)(nil)
+	_ Querier = (*Tx)(nil)
+)
+
+// Tx is a transaction run by WithTx.
+type Tx struct {
+	tx         *sql.Tx
+	savepoints int
+}
+
+// WithTx runs fn in a transaction. The transaction is committed if fn
+// returns nil and rolled back if it returns an error or panics. When
+// Postgres aborts it with a serialization failure or deadlock, the whole
+// transaction, fn included, is retried after a jittered backoff, up to
+// MaxTxAttempts times; fn must therefore be safe to run more than once.
+func (db *DB) WithTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) error {
+	var err error
+	for attempt := 0; attempt < MaxTxAttempts; attempt++ {
+		if attempt > 0 {
+			if waitErr := sleepCtx(ctx, txRetryWait(attempt)); waitErr != nil {
+				return waitErr
+			}
+		}
+		err = db.runTx(ctx, opts, fn)
+		if !IsRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (db *DB) runTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) (err error) {
+	sqlTx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = sqlTx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			_ = sqlTx.Rollback()
+		}
+	}()
+	if err = fn(&Tx{tx: sqlTx}); err != nil {
+		return err
+	}
+	if err = sqlTx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// WithTx runs fn inside a savepoint of tx. If fn returns an error or
+// panics, only the work done since the savepoint is rolled back and the
+// error is returned to the enclosing transaction. opts must be nil: a
+// savepoint can't change the transaction's isolation level.
+func (tx *Tx) WithTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) (err error) {
+	if opts != nil {
+		return errors.New("transaction options can't be set on a nested transaction")
+	}
+	tx.savepoints++
+	name := fmt.Sprintf("sp_%d", tx.savepoints)
+	if _, err := tx.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_, _ = tx.tx.ExecContext(context.WithoutCancel(ctx), "ROLLBACK TO SAVEPOINT "+name)
+			panic(p)
+		}
+		if err != nil {
+			_, _ = tx.tx.ExecContext(context.WithoutCancel(ctx), "ROLLBACK TO SAVEPOINT "+name)
+		}
+	}()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	if _, err = tx.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name); err != nil {
+		return fmt.Errorf("failed to release savepoint: %w", err)
+	}
+	return nil
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return tx.tx.ExecContext(ctx, query, args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.tx.QueryContext(ctx, query, args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return tx.tx.QueryRowContext(ctx, query, args...)
+}
+
+// IsRetryable reports whether err is a serialization failure (40001) or a
+// deadlock (40P01), after which the transaction can be run again.
+func IsRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
+
+// txRetryWait returns a random wait of up to txRetryBaseWait * 2^attempt,
+// capped at txRetryMaxWait, so transactions that collided don't retry in
+// lockstep.
+func txRetryWait(attempt int) time.Duration {
+	ceiling := min(txRetryBaseWait<<attempt, txRetryMaxWait)
+	return time.Duration(rand.Int64N(int64(ceiling))) + 1
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
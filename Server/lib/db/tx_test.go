@@ -0,0 +1,29 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, IsRetryable(&pgconn.PgError{Code: "40001"}))
+	assert.True(t, IsRetryable(fmt.Errorf("failed to commit transaction: %w", &pgconn.PgError{Code: "40P01"})))
+	assert.False(t, IsRetryable(&pgconn.PgError{Code: "23505"}))
+	assert.False(t, IsRetryable(errors.New("40001")))
+	assert.False(t, IsRetryable(nil))
+}
+
+func TestTxRetryWait(t *testing.T) {
+	for attempt := 1; attempt < 12; attempt++ {
+		for i := 0; i < 50; i++ {
+			wait := txRetryWait(attempt)
+			assert.Greater(t, wait, time.Duration(0))
+			assert.LessOrEqual(t, wait, min(txRetryBaseWait<<attempt, txRetryMaxWait))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Package etag turns row versions into the etags services hand to clients.
+//
+// Tables that support optimistic concurrency have a version column that
+// starts at 1 and goes up by one on every update. Read responses carry the
+// version as an etag; update requests send it back, and the update only
+// applies while the row is still at that version:
+//
+//	UPDATE t SET ..., version = version + 1 WHERE id = $1 AND version = $2
+//
+// Doing the check in the same statement as the write leaves no window for
+// another update to slip in between.
+package etag
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalid is returned by Parse for strings Format didn't produce.
+var ErrInvalid = errors.New("malformed etag")
+
+// Format returns the etag for a row version, a quoted decimal as in an
+// HTTP ETag header.
+func Format(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// Parse returns the version an etag stands for. An empty etag means the
+// client didn't send one and parses to zero, which no row has.
+func Parse(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	inner, ok := strings.CutPrefix(s, `"`)
+	if !ok {
+		return 0, ErrInvalid
+	}
+	inner, ok = strings.CutSuffix(inner, `"`)
+	if !ok {
+		return 0, ErrInvalid
+	}
+	version, err := strconv.ParseInt(inner, 10, 64)
+	if err != nil || version < 1 || strconv.FormatInt(version, 10) != inner {
+		return 0, ErrInvalid
+	}
+	return version, nil
+}
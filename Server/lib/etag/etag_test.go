@@ -0,0 +1,28 @@
+package etag_test
+
+import (
+	"testing"
+
+	"github.com/shatwik7/polycrate/lib/etag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, version := range []int64{1, 2, 42, 1 << 40} {
+		got, err := etag.Parse(etag.Format(version))
+		assert.NoError(t, err)
+		assert.Equal(t, version, got)
+	}
+	assert.Equal(t, `"7"`, etag.Format(7))
+}
+
+func TestParse(t *testing.T) {
+	version, err := etag.Parse("")
+	assert.NoError(t, err)
+	assert.Zero(t, version)
+
+	for _, s := range []string{`7`, `"7`, `7"`, `""`, `"0"`, `"-1"`, `"+7"`, `"07"`, `W/"7"`, `"seven"`} {
+		_, err := etag.Parse(s)
+		assert.ErrorIs(t, err, etag.ErrInvalid, s)
+	}
+}
@@ -0,0 +1,40 @@
+package events
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// OpenBroker returns the broker rawURL describes:
+//
+//	memory                                  a MemoryBroker
+//	redis://[user:pass@]host:port[/db]      Redis Streams, see RedisBroker
+//	rediss://...                            the same over TLS
+//	nats://[user:pass@|token@]host:port     NATS JetStream, see NATSBroker
+//	tls://...                               the same over TLS
+func OpenBroker(rawURL string) (Broker, error) {
+	if rawURL == "memory" || rawURL == "memory://" {
+		return NewMemoryBroker(), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL: %w", err)
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		return NewRedisBroker(u)
+	case "nats", "tls":
+		return NewNATSBroker(u)
+	}
+	return nil, fmt.Errorf("unsupported broker %q", u.Scheme)
+}
+
+// defaultPort adds port to addr if it has none.
+func defaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
@@ -0,0 +1,306 @@
+package events_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shatwik7/polycrate/lib/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func testEvent() events.Event {
+	return events.Event{
+		ID:        uuid.MustParse("7f1d3c4e-8a8e-4bb1-9d0e-3a8f7f0f2a11"),
+		Topic:     "user.registered",
+		Key:       "42",
+		Payload:   json.RawMessage(`{"username":"alice"}`),
+		CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func closeBroker(b events.Broker) {
+	if c, ok := b.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func TestOpenBroker(t *testing.T) {
+	for _, raw := range []string{
+		"memory",
+		"redis://localhost",
+		"rediss://:secret@cache:6380/2?maxlen=1000",
+		"redis://node1?addr=node2:6379&addr=node3:6379",
+		"redis://sentinel1:26379/1?addr=sentinel2:26379&master_name=primary",
+		"nats://token@127.0.0.1:1",
+		"tls://127.0.0.1:1?addr=127.0.0.1:2&jetstream=true",
+	} {
+		b, err := events.OpenBroker(raw)
+		assert.NoError(t, err, raw)
+		assert.NotNil(t, b, raw)
+		closeBroker(b)
+	}
+	for _, raw := range []string{
+		"kafka://broker",
+		"redis://localhost/x",
+		"redis://localhost?maxlen=-1",
+		"redis://node1/2?addr=node2:6379",
+		"redis://localhost?cluster=maybe",
+		"nats://127.0.0.1:1?jetstream=false",
+		"::",
+	} {
+		_, err := events.OpenBroker(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	b := events.NewMemoryBroker()
+	var users, all []string
+	b.Subscribe("user.registered", func(e events.Event) { users = append(users, e.Key) })
+	b.Subscribe("", func(e events.Event) { all = append(all, e.Topic) })
+
+	e := testEvent()
+	assert.NoError(t, b.Publish(ctx, e))
+	e.Topic = "asset.liked"
+	assert.NoError(t, b.Publish(ctx, e))
+
+	assert.Equal(t, []string{"42"}, users)
+	assert.Equal(t, []string{"user.registered", "asset.liked"}, all)
+	assert.Len(t, b.Events(), 2)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, b.Publish(canceled, e), context.Canceled)
+	assert.Len(t, b.Events(), 2)
+}
+
+func TestRedisBroker(t *testing.T) {
+	m := miniredis.RunT(t)
+	m.RequireUserAuth("worker", "secret")
+	u, _ := url.Parse("redis://worker:secret@" + m.Addr() + "/3?stream_prefix=app.&maxlen=500")
+	b, err := events.NewRedisBroker(u)
+	assert.NoError(t, err)
+	defer b.Close()
+
+	assert.NoError(t, b.Publish(ctx, testEvent()))
+	entries, err := m.DB(3).Stream("app.user.registered")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, []string{"id", "7f1d3c4e-8a8e-4bb1-9d0e-3a8f7f0f2a11", "key", "42",
+			"payload", `{"username":"alice"}`, "created_at", "2026-01-02T03:04:05Z"}, entries[0].Values)
+	}
+
+	// An error reply is about the event, not the connection.
+	m.DB(3).Set("app.broken", "not a stream")
+	broken := testEvent()
+	broken.Topic = "broken"
+	err = b.Publish(ctx, broken)
+	assert.ErrorContains(t, err, "WRONGTYPE")
+	assert.NotErrorIs(t, err, events.ErrUnavailable)
+	assert.NoError(t, b.Publish(ctx, testEvent()))
+
+	// Losing the server makes the broker unavailable until it is back.
+	m.Close()
+	assert.ErrorIs(t, b.Publish(ctx, testEvent()), events.ErrUnavailable)
+	assert.NoError(t, m.Restart())
+	assert.NoError(t, b.Publish(ctx, testEvent()))
+}
+
+func TestRedisBrokerTimeout(t *testing.T) {
+	// A server that accepts connections and never answers.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	u, _ := url.Parse("redis://" + lis.Addr().String())
+	b, _ := events.NewRedisBroker(u)
+	defer b.Close()
+
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	err = b.Publish(timeout, testEvent())
+	assert.ErrorIs(t, err, events.ErrUnavailable)
+}
+
+// fakeJetStream is just enough of a NATS server for a client to publish
+// to JetStream: it answers each published message with reply.
+func fakeJetStream(t *testing.T, reply func(subject string, header nats.Header) string) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go serveJetStream(conn, reply)
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func serveJetStream(conn net.Conn, reply func(subject string, header nats.Header) string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, `INFO {"server_id":"fake","version":"2.10.0","proto":1,"headers":true,"max_payload":1048576}`+"\r\n")
+	var inboxSID string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "SUB":
+			inboxSID = fields[len(fields)-1]
+		case "HPUB":
+			// HPUB <subject> <reply> <header bytes> <total bytes>
+			headerLen, _ := strconv.Atoi(fields[3])
+			total, _ := strconv.Atoi(fields[4])
+			body := make([]byte, total+2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+			header := nats.Header{}
+			for _, h := range strings.Split(string(body[:headerLen]), "\r\n")[1:] {
+				if k, v, ok := strings.Cut(h, ":"); ok {
+					header.Add(k, strings.TrimSpace(v))
+				}
+			}
+			resp := reply(fields[1], header)
+			if resp == "" {
+				// No stream listens on the subject.
+				status := "NATS/1.0 503\r\n\r\n"
+				io.WriteString(conn, "HMSG "+fields[2]+" "+inboxSID+" "+strconv.Itoa(len(status))+" "+strconv.Itoa(len(status))+"\r\n"+status+"\r\n")
+				continue
+			}
+			io.WriteString(conn, "MSG "+fields[2]+" "+inboxSID+" "+strconv.Itoa(len(resp))+"\r\n"+resp+"\r\n")
+		}
+	}
+}
+
+func TestNATSBroker(t *testing.T) {
+	published := make(chan nats.Header, 10)
+	addr := fakeJetStream(t, func(subject string, header nats.Header) string {
+		switch subject {
+		case "polycrate.user.registered":
+			published <- header
+			return `{"stream":"USERS","seq":7}`
+		case "polycrate.user.unstored":
+			return ""
+		}
+		return `{"error":{"code":400,"err_code":10000,"description":"bad request"}}`
+	})
+	u, _ := url.Parse("nats://svc:pw@" + addr + "?subject_prefix=polycrate.")
+	b, err := events.NewNATSBroker(u)
+	assert.NoError(t, err)
+	defer b.Close()
+
+	assert.NoError(t, b.Publish(ctx, testEvent()))
+	header := <-published
+	assert.Equal(t, "7f1d3c4e-8a8e-4bb1-9d0e-3a8f7f0f2a11", header.Get("Nats-Msg-Id"))
+	assert.Equal(t, "42", header.Get("Polycrate-Key"))
+	assert.Equal(t, "2026-01-02T03:04:05Z", header.Get("Polycrate-Created-At"))
+
+	unstored := testEvent()
+	unstored.Topic = "user.unstored"
+	assert.ErrorIs(t, b.Publish(ctx, unstored), events.ErrNoStream)
+	rejected := testEvent()
+	rejected.Topic = "user.rejected"
+	err = b.Publish(ctx, rejected)
+	assert.ErrorContains(t, err, "bad request")
+	assert.NotErrorIs(t, err, events.ErrUnavailable)
+	bad := testEvent()
+	bad.Key = "two\r\nlines"
+	assert.Error(t, b.Publish(ctx, bad))
+
+	assert.NoError(t, b.Publish(ctx, testEvent()))
+}
+
+func TestNATSBrokerUnavailable(t *testing.T) {
+	u, _ := url.Parse("nats://127.0.0.1:1")
+	b, err := events.NewNATSBroker(u)
+	assert.NoError(t, err, "the broker keeps trying to connect")
+	defer b.Close()
+
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, b.Publish(timeout, testEvent()), events.ErrUnavailable)
+}
+
+// TestNATSBrokerServer publishes to the NATS server in TEST_NATS_URL,
+// which must have JetStream enabled. It is skipped when that isn't set.
+func TestNATSBrokerServer(t *testing.T) {
+	raw := os.Getenv("TEST_NATS_URL")
+	if raw == "" {
+		t.Skip("TEST_NATS_URL not set")
+	}
+	conn, err := nats.Connect(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, _ := jetstream.New(conn)
+	prefix := "test" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	stream, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: prefix, Subjects: []string{prefix + ".>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.DeleteStream(ctx, prefix)
+
+	u, _ := url.Parse(raw)
+	q := u.Query()
+	q.Set("subject_prefix", prefix+".")
+	u.RawQuery = q.Encode()
+	b, err := events.NewNATSBroker(u)
+	assert.NoError(t, err)
+	defer b.Close()
+
+	// Publishing the same event twice stores it once.
+	assert.NoError(t, b.Publish(ctx, testEvent()))
+	assert.NoError(t, b.Publish(ctx, testEvent()))
+	info, err := stream.Info(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), info.State.Msgs)
+
+	unstored := testEvent()
+	unstored.Topic = "user.registered"
+	b2, _ := events.NewNATSBroker(&url.URL{Scheme: u.Scheme, Host: u.Host, User: u.User})
+	defer b2.Close()
+	assert.ErrorIs(t, b2.Publish(ctx, unstored), events.ErrNoStream)
+}
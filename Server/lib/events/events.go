@@ -0,0 +1,78 @@
+// Package events publishes domain events through a transactional outbox.
+//
+// A service that changes data and then publishes to a queue loses the
+// event if it crashes in between, and publishes one that never happened if
+// its transaction rolls back after the publish. Instead, Enqueue writes
+// the event to the outbox table in the same transaction as the change, so
+// the two commit or roll back together, and a Relay publishes committed
+// events to a Broker afterwards.
+//
+// Delivery is at least once: an event whose publish succeeded may be
+// published again if the relay dies before marking it delivered, and a
+// failed event is retried after events published later. Consumers should
+// deduplicate on Event.ID and not rely on ordering between events.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shatwik7/polycrate/lib/db"
+)
+
+// notifyChannel is the channel the outbox trigger notifies on commit.
+const notifyChannel = "outbox"
+
+var ErrEmptyTopic = errors.New("event topic must not be empty")
+
+// ErrUnavailable is wrapped by Publish errors that mean the broker couldn't
+// be reached, as opposed to it refusing one event. The relay stops its
+// batch on one instead of waiting out a timeout for every event. Network
+// errors and timeouts count as unavailable without it.
+var ErrUnavailable = errors.New("broker unavailable")
+
+// Event is a message about something that has happened.
+type Event struct {
+	ID uuid.UUID
+	// Topic names the kind of event, such as "user.registered". Brokers
+	// publish it to the stream or subject of the same name.
+	Topic string
+	// Key identifies what the event is about, usually the id of the row
+	// that changed. It may be empty.
+	Key       string
+	Payload   json.RawMessage
+	CreatedAt time.Time
+	// Attempts counts the earlier, failed attempts to publish the event.
+	Attempts int
+}
+
+// Broker delivers events to their consumers. Publish must only return nil
+// once the broker has accepted the event; the relay then marks it
+// delivered and never publishes it again.
+type Broker interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Enqueue writes an event with payload, encoded as JSON, to the outbox.
+// Pass the *db.Tx making the change the event describes: the event is
+// published if and only if that transaction commits.
+func Enqueue(ctx context.Context, q db.Querier, topic, key string, payload any) (uuid.UUID, error) {
+	if topic == "" {
+		return uuid.Nil, ErrEmptyTopic
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to encode %s event: %w", topic, err)
+	}
+	var id uuid.UUID
+	err = q.QueryRowContext(ctx, `INSERT INTO outbox (topic, key, payload) VALUES ($1, $2, $3) RETURNING id`,
+		topic, key, string(body)).Scan(&id)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to enqueue %s event: %w", topic, err)
+	}
+	return id, nil
+}
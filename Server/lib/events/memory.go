@@ -0,0 +1,50 @@
+package events
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// MemoryBroker delivers events to handlers in the same process. It suits
+// tests and single-instance development setups; events published while no
+// handler is subscribed are only kept for Events.
+type MemoryBroker struct {
+	mu       sync.Mutex
+	events   []Event
+	handlers map[string][]func(Event)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{handlers: make(map[string][]func(Event))}
+}
+
+// Subscribe calls handle with every event later published on topic. An
+// empty topic subscribes to all of them. Handlers run synchronously inside
+// Publish, so a slow one holds up the relay.
+func (b *MemoryBroker) Subscribe(topic string, handle func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[topic] = append(b.handlers[topic], handle)
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, event Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.events = append(b.events, event)
+	handlers := slices.Concat(b.handlers[event.Topic], b.handlers[""])
+	b.mu.Unlock()
+	for _, handle := range handlers {
+		handle(event)
+	}
+	return nil
+}
+
+// Events returns every event published so far, in order.
+func (b *MemoryBroker) Events() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.events)
+}
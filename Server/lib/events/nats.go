@@ -0,0 +1,108 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrNoStream is returned when no JetStream stream takes the event's
+// subject.
+var ErrNoStream = errors.New("nats: no stream for subject")
+
+// NATSBroker publishes events to NATS JetStream, on a subject named after
+// the topic. Messages carry the event id in the Nats-Msg-Id header, which
+// JetStream uses to drop duplicates, and the key and creation time in
+// Polycrate-Key and Polycrate-Created-At.
+//
+// Publish returns once a stream has stored the message. Plain NATS only
+// confirms the server has received a message, not that anyone got it,
+// which isn't enough for at-least-once delivery, so a stream must take
+// every subject the broker publishes to.
+type NATSBroker struct {
+	conn *nats.Conn
+	js   jetstream.JetStream
+	// prefix is put in front of the topic to name the subject.
+	prefix string
+}
+
+// NewNATSBroker returns a broker for u, a nats:// or tls:// URL. The query
+// may set:
+//
+//	addr=host:port        another server to connect to; may be repeated
+//	subject_prefix=p      put p in front of the topic to name the subject
+//
+// It keeps reconnecting in the background while no server answers.
+func NewNATSBroker(u *url.URL) (*NATSBroker, error) {
+	q := u.Query()
+	if raw := q.Get("jetstream"); raw != "" {
+		if on, err := strconv.ParseBool(raw); err != nil || !on {
+			return nil, fmt.Errorf("invalid nats jetstream %q: events are only published to JetStream", raw)
+		}
+	}
+	servers := []string{u.Scheme + "://" + defaultPort(u.Host, "4222")}
+	for _, addr := range q["addr"] {
+		servers = append(servers, u.Scheme+"://"+defaultPort(addr, "4222"))
+	}
+	opts := []nats.Option{
+		nats.Name("polycrate-events"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			opts = append(opts, nats.UserInfo(u.User.Username(), pass))
+		} else {
+			opts = append(opts, nats.Token(u.User.Username()))
+		}
+	}
+	conn, err := nats.Connect(strings.Join(servers, ","), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &NATSBroker{conn: conn, js: js, prefix: q.Get("subject_prefix")}, nil
+}
+
+func (b *NATSBroker) Publish(ctx context.Context, event Event) error {
+	subject := b.prefix + event.Topic
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("nats: invalid subject %q", subject)
+	}
+	if strings.ContainsAny(event.Key, "\r\n") {
+		return fmt.Errorf("nats: event key %q can't go in a header", event.Key)
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = event.Payload
+	msg.Header.Set("Polycrate-Key", event.Key)
+	msg.Header.Set("Polycrate-Created-At", event.CreatedAt.UTC().Format(time.RFC3339Nano))
+
+	_, err := b.js.PublishMsg(ctx, msg, jetstream.WithMsgID(event.ID.String()))
+	var apiErr *jetstream.APIError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, jetstream.ErrNoStreamResponse):
+		return fmt.Errorf("%w %s", ErrNoStream, subject)
+	case errors.As(err, &apiErr):
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
+
+// Close closes the connection.
+func (b *NATSBroker) Close() error {
+	b.conn.Close()
+	return nil
+}
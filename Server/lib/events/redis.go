@@ -0,0 +1,115 @@
+package events
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBroker appends events to Redis Streams with XADD, one stream per
+// topic. Each entry has the fields id, key, payload and created_at; Redis
+// assigns the entry id. Consumers read the streams with XREADGROUP.
+type RedisBroker struct {
+	client redis.UniversalClient
+	// prefix is put in front of the topic to name the stream.
+	prefix string
+	// maxLen caps each stream at about that many entries; zero keeps
+	// every entry.
+	maxLen int64
+}
+
+// NewRedisBroker returns a broker for u, a redis:// or rediss:// URL. The
+// path selects the database and the query may set:
+//
+//	addr=host:port        another node to connect to; may be repeated
+//	cluster=true          talk to a Redis Cluster, implied by a second node
+//	master_name=name      find the primary through the Sentinels at the nodes
+//	sentinel_password=pw  the password the Sentinels require
+//	stream_prefix=p       put p in front of the topic to name the stream
+//	maxlen=n              trim each stream to about n entries
+//
+// It connects on the first Publish.
+func NewRedisBroker(u *url.URL) (*RedisBroker, error) {
+	q := u.Query()
+	opts := &redis.UniversalOptions{
+		Addrs:            []string{defaultPort(u.Host, "6379")},
+		MasterName:       q.Get("master_name"),
+		SentinelPassword: q.Get("sentinel_password"),
+		ClientName:       "polycrate-events",
+		// Let the relay's publish timeout bound reads and writes.
+		ContextTimeoutEnabled: true,
+	}
+	for _, addr := range q["addr"] {
+		opts.Addrs = append(opts.Addrs, defaultPort(addr, "6379"))
+	}
+	if u.Scheme == "rediss" {
+		host, _, _ := net.SplitHostPort(opts.Addrs[0])
+		opts.TLSConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		n, err := strconv.Atoi(path)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid redis database %q", path)
+		}
+		opts.DB = n
+	}
+	if raw := q.Get("cluster"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis cluster %q", raw)
+		}
+		opts.IsClusterMode = on
+	}
+	if opts.DB != 0 && opts.MasterName == "" && (opts.IsClusterMode || len(opts.Addrs) > 1) {
+		return nil, errors.New("redis cluster only has database 0")
+	}
+
+	b := &RedisBroker{prefix: q.Get("stream_prefix")}
+	if raw := q.Get("maxlen"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid redis maxlen %q", raw)
+		}
+		b.maxLen = n
+	}
+	b.client = redis.NewUniversalClient(opts)
+	return b, nil
+}
+
+func (b *RedisBroker) Publish(ctx context.Context, event Event) error {
+	err := b.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: b.prefix + event.Topic,
+		MaxLen: b.maxLen,
+		Approx: true,
+		Values: []any{
+			"id", event.ID.String(),
+			"key", event.Key,
+			"payload", string(event.Payload),
+			"created_at", event.CreatedAt.UTC().Format(time.RFC3339Nano),
+		},
+	}).Err()
+	// An error reply is about this event; anything else means Redis
+	// couldn't be reached.
+	var replyErr redis.Error
+	if err != nil && !errors.As(err, &replyErr) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+// Close closes the connections to Redis.
+func (b *RedisBroker) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,325 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shatwik7/polycrate/lib/db"
+)
+
+const (
+	DefaultBatchSize       = 100
+	DefaultPollInterval    = time.Second
+	DefaultPublishTimeout  = 10 * time.Second
+	DefaultLease           = time.Minute
+	DefaultRetention       = 7 * 24 * time.Hour
+	DefaultCleanupInterval = time.Hour
+
+	retryBaseWait    = time.Second
+	retryMaxWait     = 5 * time.Minute
+	listenRetryWait  = 30 * time.Second
+	cleanupBatchSize = 1000
+)
+
+// Relay publishes the events in the outbox to a Broker. Any number of
+// relays may run against the same database: each claims its batch by
+// leasing it, pushing the events' available_at past the time it needs to
+// publish them, so an event is only in flight on one of them. No
+// transaction is open while the broker is called; if a relay dies with a
+// batch, its events are claimed again when the lease runs out.
+type Relay struct {
+	db              *db.DB
+	broker          Broker
+	batchSize       int
+	pollInterval    time.Duration
+	publishTimeout  time.Duration
+	lease           time.Duration
+	retention       time.Duration
+	cleanupInterval time.Duration
+}
+
+type RelayOption func(*Relay)
+
+// WithBatchSize sets how many events are claimed at once.
+func WithBatchSize(n int) RelayOption {
+	return func(r *Relay) { r.batchSize = n }
+}
+
+// WithPollInterval sets how often Run looks for due events when no commit
+// has woken it, which is also how late a retry may run.
+func WithPollInterval(d time.Duration) RelayOption {
+	return func(r *Relay) { r.pollInterval = d }
+}
+
+// WithPublishTimeout bounds a single Publish call.
+func WithPublishTimeout(d time.Duration) RelayOption {
+	return func(r *Relay) { r.publishTimeout = d }
+}
+
+// WithLease sets how long a claimed batch is reserved for the relay that
+// claimed it. Events it hasn't published when the lease runs out are put
+// back for any relay to claim.
+func WithLease(d time.Duration) RelayOption {
+	return func(r *Relay) { r.lease = d }
+}
+
+// WithRetention sets how long delivered events are kept before Cleanup
+// deletes them. Run doesn't clean up when it is zero or negative.
+func WithRetention(d time.Duration) RelayOption {
+	return func(r *Relay) { r.retention = d }
+}
+
+// WithCleanupInterval sets how often Run calls Cleanup.
+func WithCleanupInterval(d time.Duration) RelayOption {
+	return func(r *Relay) { r.cleanupInterval = d }
+}
+
+func NewRelay(database *db.DB, broker Broker, opts ...RelayOption) *Relay {
+	r := &Relay{
+		db:              database,
+		broker:          broker,
+		batchSize:       DefaultBatchSize,
+		pollInterval:    DefaultPollInterval,
+		publishTimeout:  DefaultPublishTimeout,
+		lease:           DefaultLease,
+		retention:       DefaultRetention,
+		cleanupInterval: DefaultCleanupInterval,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run publishes events until ctx is done. It wakes up whenever a
+// transaction that wrote to the outbox commits, and otherwise every poll
+// interval, which also picks up retries. Errors are logged and retried on
+// the next pass.
+func (r *Relay) Run(ctx context.Context) {
+	wake := make(chan struct{}, 1)
+	listening := make(chan struct{})
+	go func() {
+		defer close(listening)
+		r.listen(ctx, wake)
+	}()
+	defer func() { <-listening }()
+
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+	var cleaned time.Time
+	for {
+		delivered, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("events: relaying outbox: %v", err)
+		}
+		if r.retention > 0 && time.Since(cleaned) >= r.cleanupInterval {
+			if _, err := r.Cleanup(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("events: cleaning up outbox: %v", err)
+			}
+			cleaned = time.Now()
+		}
+		// A full batch means more are probably due.
+		if err == nil && delivered == r.batchSize && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// listen signals wake for every commit to the outbox. If the connection is
+// lost, Run keeps polling while listen reconnects.
+func (r *Relay) listen(ctx context.Context, wake chan<- struct{}) {
+	for {
+		err := r.db.Listen(ctx, notifyChannel, func(*pgconn.Notification) {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("events: listening for outbox commits: %v", err)
+		t := time.NewTimer(listenRetryWait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RelayOnce publishes one batch of due events and returns how many were
+// delivered. Events the broker rejects are retried later, after a backoff
+// that grows with their attempts. When the broker can't be reached the
+// rest of the batch isn't tried, and waits as long as the failed event.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	leaseEnd := time.Now().Add(r.lease)
+	batch, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Record the outcome even if ctx is done meanwhile, so the events
+	// already published aren't published again when the lease runs out.
+	finish, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.publishTimeout)
+	defer cancel()
+
+	var ok []uuid.UUID
+	var rest []Event
+	var restWait time.Duration
+	for i, event := range batch {
+		if ctx.Err() != nil || !time.Now().Before(leaseEnd) {
+			rest = batch[i:]
+			break
+		}
+		publishErr := r.publish(ctx, event, leaseEnd)
+		if publishErr == nil {
+			ok = append(ok, event.ID)
+			continue
+		}
+		if ctx.Err() != nil {
+			rest = batch[i:]
+			break
+		}
+		log.Printf("events: publishing %s event %s: %v", event.Topic, event.ID, publishErr)
+		wait := retryWait(event.Attempts)
+		_, err := r.db.ExecContext(finish, `UPDATE outbox
+			SET last_error = $2, available_at = now() + make_interval(secs => $3)
+			WHERE id = $1`, event.ID, publishErr.Error(), wait.Seconds())
+		if err != nil {
+			return 0, err
+		}
+		if unavailable(publishErr) {
+			rest, restWait = batch[i+1:], wait
+			break
+		}
+	}
+
+	if len(rest) > 0 {
+		ids := make([]uuid.UUID, len(rest))
+		for i, event := range rest {
+			ids[i] = event.ID
+		}
+		// They weren't attempted, so take back the attempt the claim
+		// counted.
+		_, err := r.db.ExecContext(finish, `UPDATE outbox
+			SET attempts = attempts - 1, available_at = now() + make_interval(secs => $2)
+			WHERE id = ANY($1::uuid[])`, ids, restWait.Seconds())
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(ok) > 0 {
+		_, err := r.db.ExecContext(finish, `UPDATE outbox
+			SET last_error = NULL, delivered_at = now()
+			WHERE id = ANY($1::uuid[])`, ok)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(ok), ctx.Err()
+}
+
+// claim leases up to batchSize due events, oldest first, skipping those
+// another relay is claiming. It counts an attempt for each and commits at
+// once, so no lock outlives the statement.
+func (r *Relay) claim(ctx context.Context) ([]Event, error) {
+	rows, err := r.db.QueryContext(ctx, `UPDATE outbox
+		SET attempts = attempts + 1, available_at = now() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE delivered_at IS NULL AND available_at <= now()
+			ORDER BY created_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, topic, key, payload, created_at, attempts - 1`, r.batchSize, r.lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim events: %w", err)
+	}
+	defer rows.Close()
+	var batch []Event
+	for rows.Next() {
+		var e Event
+		var payload []byte
+		if err := rows.Scan(&e.ID, &e.Topic, &e.Key, &payload, &e.CreatedAt, &e.Attempts); err != nil {
+			return nil, err
+		}
+		e.Payload = payload
+		batch = append(batch, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING doesn't keep the subquery's order.
+	slices.SortFunc(batch, func(a, b Event) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return slices.Compare(a.ID[:], b.ID[:])
+	})
+	return batch, nil
+}
+
+// publish calls the broker, giving up at the end of the lease.
+func (r *Relay) publish(ctx context.Context, event Event, leaseEnd time.Time) error {
+	deadline := time.Now().Add(r.publishTimeout)
+	if leaseEnd.Before(deadline) {
+		deadline = leaseEnd
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	return r.broker.Publish(ctx, event)
+}
+
+// unavailable reports whether a Publish error means the broker couldn't
+// be reached, rather than that it refused the event.
+func unavailable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)
+}
+
+// Cleanup deletes the events delivered longer than the retention period
+// ago and returns how many it deleted. It deletes a batch at a time so no
+// statement holds its locks for long.
+func (r *Relay) Cleanup(ctx context.Context) (int64, error) {
+	var total int64
+	for {
+		res, err := r.db.ExecContext(ctx, `DELETE FROM outbox WHERE id IN (
+			SELECT id FROM outbox WHERE delivered_at < now() - make_interval(secs => $1) LIMIT $2)`,
+			r.retention.Seconds(), cleanupBatchSize)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < cleanupBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// retryWait returns how long to wait before publishing an event again
+// after it has failed attempts+1 times.
+func retryWait(attempts int) time.Duration {
+	if attempts >= 20 {
+		return retryMaxWait
+	}
+	return min(retryBaseWait<<attempts, retryMaxWait)
+}
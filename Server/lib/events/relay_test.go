@@ -0,0 +1,292 @@
+package events_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shatwik7/polycrate/lib/db"
+	"github.com/shatwik7/polycrate/lib/db/dbtest"
+	"github.com/shatwik7/polycrate/lib/events"
+	"github.com/stretchr/testify/assert"
+)
+
+var ctx = context.Background()
+
+// flakyBroker fails every publish on the topics in failing.
+type flakyBroker struct {
+	*events.MemoryBroker
+	mu      sync.Mutex
+	failing map[string]bool
+}
+
+func (b *flakyBroker) Publish(ctx context.Context, e events.Event) error {
+	b.mu.Lock()
+	fail := b.failing[e.Topic]
+	b.mu.Unlock()
+	if fail {
+		return errors.New("broker unavailable")
+	}
+	return b.MemoryBroker.Publish(ctx, e)
+}
+
+func enqueue(t *testing.T, q db.Querier, topic string) uuid.UUID {
+	t.Helper()
+	id, err := events.Enqueue(ctx, q, topic, "key-"+topic, map[string]string{"topic": topic})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return id
+}
+
+func TestEnqueueFollowsTransaction(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+	broker := events.NewMemoryBroker()
+	relay := events.NewRelay(database, broker)
+
+	var committed uuid.UUID
+	assert.NoError(t, database.WithTx(ctx, nil, func(tx *db.Tx) error {
+		committed = enqueue(t, tx, "user.registered")
+		return nil
+	}))
+	assert.Error(t, database.WithTx(ctx, nil, func(tx *db.Tx) error {
+		enqueue(t, tx, "user.deleted")
+		return errors.New("change failed")
+	}))
+	_, err := events.Enqueue(ctx, database, "", "", nil)
+	assert.ErrorIs(t, err, events.ErrEmptyTopic)
+
+	n, err := relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	published := broker.Events()
+	if assert.Len(t, published, 1) {
+		assert.Equal(t, committed, published[0].ID)
+		assert.Equal(t, "key-user.registered", published[0].Key)
+		assert.JSONEq(t, `{"topic":"user.registered"}`, string(published[0].Payload))
+	}
+
+	// Delivered events aren't published again.
+	n, err = relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	var deliveredAt *time.Time
+	assert.NoError(t, database.QueryRow(`SELECT delivered_at FROM outbox WHERE id = $1`, committed).Scan(&deliveredAt))
+	assert.NotNil(t, deliveredAt)
+}
+
+func TestRelayRetriesFailedEvents(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+	broker := &flakyBroker{MemoryBroker: events.NewMemoryBroker(), failing: map[string]bool{"asset.liked": true}}
+	relay := events.NewRelay(database, broker)
+
+	failed := enqueue(t, database, "asset.liked")
+	enqueue(t, database, "user.registered")
+
+	// The failing event doesn't hold up the others.
+	n, err := relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	var attempts int
+	var lastError string
+	var wait float64
+	assert.NoError(t, database.QueryRow(`SELECT attempts, last_error, extract(epoch FROM available_at - now()) FROM outbox WHERE id = $1`, failed).
+		Scan(&attempts, &lastError, &wait))
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, "broker unavailable", lastError)
+	assert.Greater(t, wait, 0.0)
+
+	// Once the broker recovers and the backoff has passed, it goes out.
+	broker.mu.Lock()
+	broker.failing = nil
+	broker.mu.Unlock()
+	n, err = relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, n, "retried before its backoff")
+	database.Exec(`UPDATE outbox SET available_at = now() WHERE id = $1`, failed)
+	n, err = relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	published := broker.Events()
+	if assert.Len(t, published, 2) {
+		assert.Equal(t, failed, published[1].ID)
+		assert.Equal(t, 1, published[1].Attempts)
+	}
+}
+
+// downBroker fails every publish as a broker that can't be reached does.
+type downBroker struct {
+	calls int
+}
+
+func (b *downBroker) Publish(context.Context, events.Event) error {
+	b.calls++
+	return fmt.Errorf("%w: connection refused", events.ErrUnavailable)
+}
+
+func TestRelayStopsWhenBrokerUnavailable(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+	broker := &downBroker{}
+	relay := events.NewRelay(database, broker)
+
+	first := enqueue(t, database, "user.registered")
+	enqueue(t, database, "user.registered")
+	enqueue(t, database, "user.deleted")
+
+	n, err := relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, 1, broker.calls, "kept publishing to a broker that is down")
+
+	var attempts, due int
+	database.QueryRow(`SELECT attempts FROM outbox WHERE id = $1`, first).Scan(&attempts)
+	assert.Equal(t, 1, attempts)
+	// The others weren't attempted, but wait for the broker as well.
+	database.QueryRow(`SELECT count(*) FROM outbox WHERE attempts = 0 AND available_at > now()`).Scan(&due)
+	assert.Equal(t, 2, due)
+}
+
+// lockingBroker checks, for every event it publishes, that no transaction
+// holds the event's row.
+type lockingBroker struct {
+	*events.MemoryBroker
+	database *db.DB
+	t        *testing.T
+}
+
+func (b *lockingBroker) Publish(ctx context.Context, e events.Event) error {
+	err := b.database.WithTx(ctx, nil, func(tx *db.Tx) error {
+		_, err := tx.ExecContext(ctx, `SELECT 1 FROM outbox WHERE id = $1 FOR UPDATE NOWAIT`, e.ID)
+		return err
+	})
+	assert.NoError(b.t, err, "event is locked while it is published")
+	return b.MemoryBroker.Publish(ctx, e)
+}
+
+func TestRelayLeasesEvents(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+	broker := &lockingBroker{MemoryBroker: events.NewMemoryBroker(), database: database, t: t}
+	relay := events.NewRelay(database, broker)
+
+	id := enqueue(t, database, "user.registered")
+	n, err := relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// A relay that died holding a lease leaves the event claimed until
+	// the lease runs out.
+	leased := enqueue(t, database, "user.deleted")
+	database.Exec(`UPDATE outbox SET attempts = 1, available_at = now() + interval '1 minute' WHERE id = $1`, leased)
+	n, err = relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	database.Exec(`UPDATE outbox SET available_at = now() WHERE id = $1`, leased)
+	n, err = relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	published := broker.Events()
+	if assert.Len(t, published, 2) {
+		assert.Equal(t, id, published[0].ID)
+		assert.Equal(t, leased, published[1].ID)
+		assert.Equal(t, 1, published[1].Attempts)
+	}
+}
+
+func TestRelaysShareTheOutbox(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+	for i := 0; i < 50; i++ {
+		enqueue(t, database, "user.registered")
+	}
+
+	broker := events.NewMemoryBroker()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			relay := events.NewRelay(database, broker, events.WithBatchSize(5))
+			for {
+				n, err := relay.RelayOnce(ctx)
+				if err != nil || n == 0 {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[uuid.UUID]bool)
+	for _, e := range broker.Events() {
+		assert.False(t, seen[e.ID], "event %s published twice", e.ID)
+		seen[e.ID] = true
+	}
+	assert.Len(t, seen, 50)
+}
+
+func TestRelayRun(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+	broker := events.NewMemoryBroker()
+	received := make(chan events.Event, 100)
+	broker.Subscribe("user.registered", func(e events.Event) { received <- e })
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		events.NewRelay(database, broker, events.WithPollInterval(time.Hour)).Run(runCtx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// With an hour between polls, only the commit notification can wake
+	// the relay. It may not be listening yet, so keep committing events
+	// until one comes through.
+	enqueued := make(map[uuid.UUID]bool)
+	deadline := time.After(10 * time.Second)
+	for {
+		enqueued[enqueue(t, database, "user.registered")] = true
+		select {
+		case e := <-received:
+			assert.True(t, enqueued[e.ID])
+			return
+		case <-time.After(200 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("relay didn't publish the event")
+		}
+	}
+}
+
+func TestRelayCleanup(t *testing.T) {
+	t.Parallel()
+	database := dbtest.New(t)
+	relay := events.NewRelay(database, events.NewMemoryBroker(), events.WithRetention(time.Hour))
+
+	old := enqueue(t, database, "user.registered")
+	enqueue(t, database, "user.registered")
+	pending := enqueue(t, database, "user.deleted")
+	_, err := relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	database.Exec(`UPDATE outbox SET delivered_at = now() - interval '2 hours' WHERE id = $1`, old)
+	database.Exec(`UPDATE outbox SET delivered_at = NULL, created_at = now() - interval '1 day' WHERE id = $1`, pending)
+
+	n, err := relay.Cleanup(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	var left int
+	database.QueryRow(`SELECT count(*) FROM outbox`).Scan(&left)
+	assert.Equal(t, 2, left)
+}
@@ -0,0 +1,86 @@
+// Package jwks publishes and consumes the JSON Web Key Sets the user
+// service signs access tokens with.
+//
+// Services that only need to check a token use a Verifier: it fetches the
+// key set once, caches it, and fetches it again when a token names a key
+// it hasn't seen, which is what happens right after the user service
+// rotates its signing key.
+package jwks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	KeyTypeEC = "EC"
+	CurveP256 = "P-256"
+	AlgES256  = "ES256"
+	UseSig    = "sig"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported JSON web key")
+
+// Key is a public key in RFC 7517 form. Only P-256 EC keys are supported.
+type Key struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Set is the document served at /.well-known/jwks.json.
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+// NewKey describes pub as an ES256 signing key with the given id.
+func NewKey(kid string, pub *ecdsa.PublicKey) Key {
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	return Key{
+		Kty: KeyTypeEC,
+		Crv: CurveP256,
+		Kid: kid,
+		Use: UseSig,
+		Alg: AlgES256,
+		X:   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size))),
+		Y:   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+// PublicKey decodes k into an ECDSA public key.
+func (k Key) PublicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != KeyTypeEC || k.Crv != CurveP256 || (k.Alg != "" && k.Alg != AlgES256) {
+		return nil, fmt.Errorf("%w: kty=%q crv=%q alg=%q", ErrUnsupportedKey, k.Kty, k.Crv, k.Alg)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad x: %v", ErrUnsupportedKey, err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad y: %v", ErrUnsupportedKey, err)
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if _, err := pub.ECDH(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedKey, err)
+	}
+	return pub, nil
+}
+
+// Lookup returns the key with the given id.
+func (s *Set) Lookup(kid string) (Key, bool) {
+	for _, k := range s.Keys {
+		if k.Kid == kid {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
@@ -0,0 +1,237 @@
+package jwks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	DefaultCacheTTL        = time.Hour
+	DefaultMinRefreshDelay = 10 * time.Second
+	DefaultFetchTimeout    = 10 * time.Second
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired token")
+	ErrUnknownKey   = errors.New("token signed with an unknown key")
+)
+
+// Fetcher returns the current key set, for example from the user
+// service's /.well-known/jwks.json endpoint or its GetJWKS RPC.
+type Fetcher func(ctx context.Context) (*Set, error)
+
+// HTTPFetcher fetches the key set from url. A nil client means
+// http.DefaultClient.
+func HTTPFetcher(url string, client *http.Client) Fetcher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context) (*Set, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+		}
+		set := &Set{}
+		if err := json.NewDecoder(resp.Body).Decode(set); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", url, err)
+		}
+		return set, nil
+	}
+}
+
+// Verifier checks ES256 tokens against a cached key set.
+type Verifier struct {
+	fetch      Fetcher
+	ttl        time.Duration
+	minRefresh time.Duration
+	timeout    time.Duration
+	parserOpts []jwt.ParserOption
+
+	// mu guards the fields below. It is never held during a fetch, so
+	// tokens with a cached kid verify while the key endpoint is slow.
+	mu          sync.Mutex
+	keys        map[string]*ecdsa.PublicKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	// refreshing is the fetch in flight, if any; callers that need a new
+	// key set wait for it rather than start their own.
+	refreshing *refresh
+}
+
+// refresh is one fetch of the key set. err is set before done is closed.
+type refresh struct {
+	done chan struct{}
+	err  error
+}
+
+type Option func(*Verifier)
+
+// WithCacheTTL sets how long a fetched key set is used before it is
+// fetched again even though every kid is known.
+func WithCacheTTL(d time.Duration) Option {
+	return func(v *Verifier) { v.ttl = d }
+}
+
+// WithMinRefreshDelay limits how often an unknown kid can trigger a fetch,
+// so tokens with made-up kids can't turn the verifier into a load
+// generator against the key endpoint.
+func WithMinRefreshDelay(d time.Duration) Option {
+	return func(v *Verifier) { v.minRefresh = d }
+}
+
+// WithFetchTimeout bounds each fetch of the key set. A fetch is shared by
+// every caller waiting for it, so it doesn't stop when one of them gives up.
+func WithFetchTimeout(d time.Duration) Option {
+	return func(v *Verifier) { v.timeout = d }
+}
+
+// WithParserOptions adds checks such as jwt.WithIssuer to every Verify.
+func WithParserOptions(opts ...jwt.ParserOption) Option {
+	return func(v *Verifier) { v.parserOpts = append(v.parserOpts, opts...) }
+}
+
+func NewVerifier(fetch Fetcher, opts ...Option) *Verifier {
+	v := &Verifier{
+		fetch:      fetch,
+		ttl:        DefaultCacheTTL,
+		minRefresh: DefaultMinRefreshDelay,
+		timeout:    DefaultFetchTimeout,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Verify checks the token's signature and expiry and decodes its claims
+// into claims. It returns ErrInvalidToken, or ErrUnknownKey when the key
+// set doesn't contain the token's kid even after a refresh.
+func (v *Verifier) Verify(ctx context.Context, token string, claims jwt.Claims) error {
+	opts := append([]jwt.ParserOption{
+		jwt.WithValidMethods([]string{AlgES256}),
+		jwt.WithExpirationRequired(),
+	}, v.parserOpts...)
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, ErrUnknownKey
+		}
+		return v.key(ctx, kid)
+	}, opts...)
+	if errors.Is(err, ErrUnknownKey) {
+		return ErrUnknownKey
+	}
+	if err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// Refresh fetches the key set now, or waits for the fetch already in
+// flight.
+func (v *Verifier) Refresh(ctx context.Context) error {
+	v.mu.Lock()
+	r := v.startRefreshLocked(ctx)
+	v.mu.Unlock()
+	return r.wait(ctx)
+}
+
+func (v *Verifier) key(ctx context.Context, kid string) (*ecdsa.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetchedAt) > v.ttl
+	if ok && !stale {
+		v.mu.Unlock()
+		return key, nil
+	}
+	if !stale && v.refreshing == nil && time.Since(v.lastAttempt) < v.minRefresh {
+		v.mu.Unlock()
+		return nil, ErrUnknownKey
+	}
+	r := v.startRefreshLocked(ctx)
+	v.mu.Unlock()
+
+	if err := r.wait(ctx); err != nil {
+		// Keep serving a stale set rather than rejecting every token while
+		// the key endpoint is down.
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok = v.keys[kid]; !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// startRefreshLocked returns the fetch in flight, starting one if there is
+// none. The fetch keeps ctx's values but not its cancellation.
+func (v *Verifier) startRefreshLocked(ctx context.Context) *refresh {
+	if v.refreshing != nil {
+		return v.refreshing
+	}
+	r := &refresh{done: make(chan struct{})}
+	v.refreshing = r
+	v.lastAttempt = time.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), v.timeout)
+		defer cancel()
+		keys, err := v.fetchKeys(ctx)
+
+		v.mu.Lock()
+		if err == nil {
+			v.keys = keys
+			v.fetchedAt = time.Now()
+		}
+		v.refreshing = nil
+		v.mu.Unlock()
+		r.err = err
+		close(r.done)
+	}()
+	return r
+}
+
+func (r *refresh) wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (v *Verifier) fetchKeys(ctx context.Context) (map[string]*ecdsa.PublicKey, error) {
+	set, err := v.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*ecdsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		pub, err := k.PublicKey()
+		if err != nil {
+			// Skip keys we can't use instead of failing the whole set.
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
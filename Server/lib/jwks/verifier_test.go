@@ -0,0 +1,144 @@
+package jwks_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/shatwik7/polycrate/lib/jwks"
+	"github.com/stretchr/testify/assert"
+)
+
+type keyServer struct {
+	mu      sync.Mutex
+	set     jwks.Set
+	fetches atomic.Int32
+}
+
+func (s *keyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.fetches.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	json.NewEncoder(w).Encode(s.set)
+}
+
+func (s *keyServer) add(t *testing.T, kid string) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	s.mu.Lock()
+	s.set.Keys = append(s.set.Keys, jwks.NewKey(kid, &key.PublicKey))
+	s.mu.Unlock()
+	return key
+}
+
+func sign(t *testing.T, kid string, key *ecdsa.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+		Subject:   "user",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pub, err := jwks.NewKey("k1", &key.PublicKey).PublicKey()
+	assert.NoError(t, err)
+	assert.True(t, key.PublicKey.Equal(pub))
+
+	_, err = jwks.Key{Kty: "RSA", Kid: "k2"}.PublicKey()
+	assert.ErrorIs(t, err, jwks.ErrUnsupportedKey)
+}
+
+func TestVerifierRefreshesOnUnknownKid(t *testing.T) {
+	keys := &keyServer{}
+	server := httptest.NewServer(keys)
+	defer server.Close()
+	first := keys.add(t, "k1")
+
+	verifier := jwks.NewVerifier(jwks.HTTPFetcher(server.URL, nil), jwks.WithMinRefreshDelay(0))
+	claims := &jwt.RegisteredClaims{}
+	assert.NoError(t, verifier.Verify(context.Background(), sign(t, "k1", first), claims))
+	assert.Equal(t, "user", claims.Subject)
+	assert.NoError(t, verifier.Verify(context.Background(), sign(t, "k1", first), &jwt.RegisteredClaims{}))
+	assert.Equal(t, int32(1), keys.fetches.Load())
+
+	second := keys.add(t, "k2")
+	assert.NoError(t, verifier.Verify(context.Background(), sign(t, "k2", second), &jwt.RegisteredClaims{}))
+	assert.Equal(t, int32(2), keys.fetches.Load())
+
+	err := verifier.Verify(context.Background(), sign(t, "k1", second), &jwt.RegisteredClaims{})
+	assert.ErrorIs(t, err, jwks.ErrInvalidToken)
+}
+
+func TestVerifierLimitsRefreshes(t *testing.T) {
+	keys := &keyServer{}
+	server := httptest.NewServer(keys)
+	defer server.Close()
+	key := keys.add(t, "k1")
+
+	verifier := jwks.NewVerifier(jwks.HTTPFetcher(server.URL, nil), jwks.WithMinRefreshDelay(time.Hour))
+	assert.NoError(t, verifier.Refresh(context.Background()))
+	for i := 0; i < 5; i++ {
+		err := verifier.Verify(context.Background(), sign(t, "made-up", key), &jwt.RegisteredClaims{})
+		assert.ErrorIs(t, err, jwks.ErrUnknownKey)
+	}
+	assert.Equal(t, int32(1), keys.fetches.Load())
+}
+
+func TestVerifierDoesNotBlockOnSlowRefresh(t *testing.T) {
+	keys := &keyServer{}
+	server := httptest.NewServer(keys)
+	defer server.Close()
+	cached := keys.add(t, "k1")
+	verifier := jwks.NewVerifier(jwks.HTTPFetcher(server.URL, nil), jwks.WithMinRefreshDelay(0))
+	assert.NoError(t, verifier.Refresh(context.Background()))
+
+	// Hold the key endpoint while tokens with a new kid wait for it.
+	fresh, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keys.mu.Lock()
+	keys.set.Keys = append(keys.set.Keys, jwks.NewKey("k2", &fresh.PublicKey))
+	before := keys.fetches.Load()
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- verifier.Verify(context.Background(), sign(t, "k2", fresh), &jwt.RegisteredClaims{})
+		}()
+	}
+	for keys.fetches.Load() == before {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- verifier.Verify(context.Background(), sign(t, "k1", cached), &jwt.RegisteredClaims{})
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("a token with a cached kid waited for the refresh")
+	}
+
+	keys.mu.Unlock()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, before+1, keys.fetches.Load(), "concurrent lookups share one fetch")
+}
@@ -66,9 +66,13 @@ func (x *GetAssetRequest) GetId() string {
 }
 
 type GetAssetResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Name          string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name  string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	// The asset's version as formatted by lib/etag.Format. It changes
+	// whenever the asset does; updates take it back to make sure they
+	// aren't based on stale data.
+	Etag          string `protobuf:"bytes,3,opt,name=etag,proto3" json:"etag,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -117,16 +121,24 @@ func (x *GetAssetResponse) GetName() string {
 	return ""
 }
 
+func (x *GetAssetResponse) GetEtag() string {
+	if x != nil {
+		return x.Etag
+	}
+	return ""
+}
+
 var File_asset_proto protoreflect.FileDescriptor
 
 const file_asset_proto_rawDesc = "" +
 	"\n" +
 	"\vasset.proto\x12\x05asset\"!\n" +
 	"\x0fGetAssetRequest\x12\x0e\n" +
-	"\x02id\x18\x01 \x01(\tR\x02id\"6\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"J\n" +
 	"\x10GetAssetResponse\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
-	"\x04name\x18\x02 \x01(\tR\x04name2K\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\x12\n" +
+	"\x04etag\x18\x03 \x01(\tR\x04etag2K\n" +
 	"\fAssetService\x12;\n" +
 	"\bGetAsset\x12\x16.asset.GetAssetRequest\x1a\x17.asset.GetAssetResponseB8Z6github.com/shatwik7/polycrate/libs/proto/asset;assetpbb\x06proto3"
 
@@ -0,0 +1,285 @@
+// Package userloader coalesces user lookups made while serving a single
+// request into BatchGetUsers calls against the user service.
+//
+// A gallery page that renders fifty asset cards calls Load once per card;
+// the loader collects those ids for a short window and resolves them with
+// one RPC, caching the result for the rest of the request.
+package userloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	userpb "github.com/shatwik7/polycrate/lib/protos/user"
+	"google.golang.org/grpc"
+)
+
+const (
+	DefaultWait     = 2 * time.Millisecond
+	DefaultMaxBatch = 100
+	DefaultTimeout  = 5 * time.Second
+)
+
+var (
+	ErrNotFound  = errors.New("user not found")
+	ErrInvalidID = errors.New("invalid user id")
+)
+
+type entry struct {
+	user *userpb.PublicProfile
+	err  error
+	done chan struct{}
+}
+
+type batch struct {
+	ctx     context.Context
+	ids     []string
+	entries map[string]*entry
+	timer   *time.Timer
+	// deadline is the latest deadline of the callers in the batch, and
+	// unbounded is set once one of them has none.
+	deadline  time.Time
+	unbounded bool
+}
+
+// Loader batches and caches user lookups. It is meant to live for one
+// request; create a new one per request with New or UnaryServerInterceptor.
+type Loader struct {
+	client   userpb.UserServiceClient
+	wait     time.Duration
+	maxBatch int
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	cache   map[string]*entry
+	pending *batch
+}
+
+type Option func(*Loader)
+
+// WithWait sets how long the loader waits for more ids before sending a batch.
+func WithWait(d time.Duration) Option {
+	return func(l *Loader) { l.wait = d }
+}
+
+// WithMaxBatch sets the number of ids that triggers an immediate flush.
+func WithMaxBatch(n int) Option {
+	return func(l *Loader) { l.maxBatch = n }
+}
+
+// WithTimeout bounds each BatchGetUsers call. A batch also gives up once
+// every caller waiting on it has.
+func WithTimeout(d time.Duration) Option {
+	return func(l *Loader) { l.timeout = d }
+}
+
+func New(client userpb.UserServiceClient, opts ...Option) *Loader {
+	l := &Loader{
+		client:   client,
+		wait:     DefaultWait,
+		maxBatch: DefaultMaxBatch,
+		timeout:  DefaultTimeout,
+		cache:    make(map[string]*entry),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Load returns the public profile of the user with the given id, or
+// ErrNotFound. An id that isn't a UUID fails with ErrInvalidID without
+// joining a batch, where it would fail every other id with it.
+func (l *Loader) Load(ctx context.Context, id string) (*userpb.PublicProfile, error) {
+	key, err := canonicalID(id)
+	if err != nil {
+		return nil, err
+	}
+	e := l.enqueue(ctx, key)
+	select {
+	case <-e.done:
+		return e.user, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// LoadMany returns the users that exist among ids, keyed by id. Missing ids
+// are left out of the map rather than reported as an error, and so are ids
+// that aren't UUIDs.
+func (l *Loader) LoadMany(ctx context.Context, ids []string) (map[string]*userpb.PublicProfile, error) {
+	entries := make(map[string]*entry, len(ids))
+	for _, id := range ids {
+		key, err := canonicalID(id)
+		if err != nil {
+			continue
+		}
+		entries[id] = l.enqueue(ctx, key)
+	}
+	l.Flush()
+
+	users := make(map[string]*userpb.PublicProfile, len(entries))
+	for id, e := range entries {
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if errors.Is(e.err, ErrNotFound) {
+			continue
+		}
+		if e.err != nil {
+			return nil, e.err
+		}
+		users[id] = e.user
+	}
+	return users, nil
+}
+
+// Prime stores a user that was fetched some other way so later loads of
+// its id are served from the cache.
+func (l *Loader) Prime(u *userpb.PublicProfile) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.cache[u.GetId()]; ok {
+		return
+	}
+	e := &entry{user: u, done: make(chan struct{})}
+	close(e.done)
+	l.cache[u.GetId()] = e
+}
+
+// Flush sends the pending batch immediately instead of waiting.
+func (l *Loader) Flush() {
+	l.mu.Lock()
+	b := l.takePending()
+	l.mu.Unlock()
+	if b != nil {
+		l.dispatch(b)
+	}
+}
+
+func (l *Loader) enqueue(ctx context.Context, id string) *entry {
+	l.mu.Lock()
+	if e, ok := l.cache[id]; ok {
+		l.mu.Unlock()
+		return e
+	}
+	e := &entry{done: make(chan struct{})}
+	l.cache[id] = e
+
+	if l.pending == nil {
+		b := &batch{ctx: context.WithoutCancel(ctx), entries: make(map[string]*entry)}
+		b.timer = time.AfterFunc(l.wait, func() { l.flushBatch(b) })
+		l.pending = b
+	}
+	b := l.pending
+	b.ids = append(b.ids, id)
+	b.entries[id] = e
+	if deadline, ok := ctx.Deadline(); !ok {
+		b.unbounded = true
+	} else if deadline.After(b.deadline) {
+		b.deadline = deadline
+	}
+
+	var full *batch
+	if len(b.ids) >= l.maxBatch {
+		full = l.takePending()
+	}
+	l.mu.Unlock()
+
+	if full != nil {
+		go l.dispatch(full)
+	}
+	return e
+}
+
+// takePending detaches the pending batch. The caller must hold l.mu.
+func (l *Loader) takePending() *batch {
+	b := l.pending
+	if b == nil {
+		return nil
+	}
+	b.timer.Stop()
+	l.pending = nil
+	return b
+}
+
+func (l *Loader) flushBatch(b *batch) {
+	l.mu.Lock()
+	if l.pending != b {
+		l.mu.Unlock()
+		return
+	}
+	l.pending = nil
+	l.mu.Unlock()
+	l.dispatch(b)
+}
+
+func (l *Loader) dispatch(b *batch) {
+	// The batch outlives the caller that started it, but no longer than
+	// the last caller waiting on it would.
+	deadline := time.Now().Add(l.timeout)
+	if !b.unbounded && b.deadline.Before(deadline) {
+		deadline = b.deadline
+	}
+	ctx, cancel := context.WithDeadline(b.ctx, deadline)
+	defer cancel()
+	resp, err := l.client.BatchGetUsers(ctx, &userpb.BatchGetUsersRequest{Ids: b.ids})
+	for id, e := range b.entries {
+		switch {
+		case err != nil:
+			e.err = err
+		case resp.GetProfiles()[id] != nil:
+			e.user = resp.GetProfiles()[id]
+		default:
+			e.err = ErrNotFound
+		}
+		close(e.done)
+	}
+	if err != nil {
+		// Don't cache transport failures; the next Load retries.
+		l.mu.Lock()
+		for id, e := range b.entries {
+			if l.cache[id] == e {
+				delete(l.cache, id)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// canonicalID returns id in the form the user service uses as map keys.
+func canonicalID(id string) (string, error) {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return "", fmt.Errorf("%w %q", ErrInvalidID, id)
+	}
+	return parsed.String(), nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *Loader) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the loader attached to ctx, or nil.
+func FromContext(ctx context.Context) *Loader {
+	l, _ := ctx.Value(contextKey{}).(*Loader)
+	return l
+}
+
+// UnaryServerInterceptor attaches a fresh Loader to every incoming request
+// so handlers can call FromContext(ctx).Load without sharing a cache
+// across requests.
+func UnaryServerInterceptor(client userpb.UserServiceClient, opts ...Option) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return handler(NewContext(ctx, New(client, opts...)), req)
+	}
+}
@@ -0,0 +1,185 @@
+package userloader_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	userpb "github.com/shatwik7/polycrate/lib/protos/user"
+	"github.com/shatwik7/polycrate/lib/userloader"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	alice = "0b8a5c3e-6f1e-4a53-9a0c-4f4b1f8e2a01"
+	bob   = "6d2f7a10-3c4b-4e8d-8f5a-2b9c1d0e7f02"
+	carol = "9e4c2b7d-1a5f-4c3e-b6d8-7f0a3e5c9b03"
+)
+
+type fakeClient struct {
+	userpb.UserServiceClient
+	calls atomic.Int32
+	users map[string]*userpb.PublicProfile
+	// block makes BatchGetUsers wait for its context instead of
+	// answering.
+	block bool
+	// deadlines receives the deadline of every call, when not nil.
+	deadlines chan time.Time
+}
+
+// BatchGetUsers answers like the user service, which rejects the whole
+// request if one id isn't a UUID.
+func (c *fakeClient) BatchGetUsers(ctx context.Context, in *userpb.BatchGetUsersRequest, opts ...grpc.CallOption) (*userpb.BatchGetUsersResponse, error) {
+	c.calls.Add(1)
+	if c.deadlines != nil {
+		deadline, _ := ctx.Deadline()
+		c.deadlines <- deadline
+	}
+	if c.block {
+		<-ctx.Done()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	for _, id := range in.GetIds() {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid ids")
+		}
+	}
+	resp := &userpb.BatchGetUsersResponse{Profiles: map[string]*userpb.PublicProfile{}}
+	for _, id := range in.GetIds() {
+		if u, ok := c.users[id]; ok {
+			resp.Profiles[id] = u
+		} else {
+			resp.MissingIds = append(resp.MissingIds, id)
+		}
+	}
+	return resp, nil
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{users: map[string]*userpb.PublicProfile{
+		alice: {Id: alice, Username: "alice"},
+		bob:   {Id: bob, Username: "bob"},
+	}}
+}
+
+func TestLoadCoalescesConcurrentCalls(t *testing.T) {
+	client := newFakeClient()
+	loader := userloader.New(client, userloader.WithWait(20*time.Millisecond))
+
+	var wg sync.WaitGroup
+	for _, id := range []string{alice, bob, alice, bob} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			u, err := loader.Load(context.Background(), id)
+			assert.NoError(t, err)
+			assert.Equal(t, id, u.GetId())
+		}(id)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), client.calls.Load())
+
+	_, err := loader.Load(context.Background(), alice)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), client.calls.Load())
+}
+
+func TestLoadMissing(t *testing.T) {
+	loader := userloader.New(newFakeClient())
+	_, err := loader.Load(context.Background(), carol)
+	assert.ErrorIs(t, err, userloader.ErrNotFound)
+}
+
+func TestLoadManySkipsMissing(t *testing.T) {
+	client := newFakeClient()
+	loader := userloader.New(client, userloader.WithWait(time.Hour))
+
+	users, err := loader.LoadMany(context.Background(), []string{alice, bob, carol, "nobody"})
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, "bob", users[bob].GetUsername())
+	assert.Equal(t, int32(1), client.calls.Load())
+}
+
+func TestMaxBatchFlushesEarly(t *testing.T) {
+	client := newFakeClient()
+	loader := userloader.New(client, userloader.WithWait(time.Hour), userloader.WithMaxBatch(2))
+
+	users, err := loader.LoadMany(context.Background(), []string{alice, bob})
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+}
+
+func TestPrime(t *testing.T) {
+	client := newFakeClient()
+	loader := userloader.New(client)
+	loader.Prime(&userpb.PublicProfile{Id: carol, Username: "carol"})
+
+	u, err := loader.Load(context.Background(), carol)
+	assert.NoError(t, err)
+	assert.Equal(t, "carol", u.GetUsername())
+	assert.Equal(t, int32(0), client.calls.Load())
+}
+
+func TestInvalidIDFailsOnlyItsCaller(t *testing.T) {
+	client := newFakeClient()
+	loader := userloader.New(client, userloader.WithWait(20*time.Millisecond))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := loader.Load(context.Background(), "not-a-uuid")
+		assert.ErrorIs(t, err, userloader.ErrInvalidID)
+	}()
+	go func() {
+		defer wg.Done()
+		// Ids are looked up in their canonical form.
+		u, err := loader.Load(context.Background(), strings.ToUpper(alice))
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", u.GetUsername())
+	}()
+	wg.Wait()
+	assert.Equal(t, int32(1), client.calls.Load())
+}
+
+func TestBatchTimeout(t *testing.T) {
+	client := newFakeClient()
+	client.block = true
+	loader := userloader.New(client, userloader.WithTimeout(50*time.Millisecond))
+
+	// The caller has no deadline, but the batch does.
+	_, err := loader.Load(context.Background(), alice)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// A batch gives up once the last caller waiting on it has.
+	client.deadlines = make(chan time.Time, 1)
+	loader = userloader.New(client, userloader.WithTimeout(time.Hour), userloader.WithWait(20*time.Millisecond))
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	long, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, call := range []struct {
+		ctx context.Context
+		id  string
+	}{{short, alice}, {long, bob}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := loader.Load(call.ctx, call.id)
+			assert.Error(t, err)
+		}()
+	}
+	deadline := <-client.deadlines
+	wantDeadline, _ := long.Deadline()
+	assert.Equal(t, wantDeadline, deadline)
+	wg.Wait()
+}
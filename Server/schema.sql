@@ -1,84 +0,0 @@
-CREATE EXTENSION IF NOT EXISTS pgcrypto;
-
-CREATE TABLE IF NOT EXISTS users (
-    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    username VARCHAR(50) NOT NULL UNIQUE,
-    email VARCHAR(255) NOT NULL UNIQUE,
-    full_name VARCHAR(100),
-    profile_picture_url TEXT,
-    bio TEXT,
-    website TEXT,
-    location VARCHAR(100),
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT now()
-);
-
-CREATE TABLE IF NOT EXISTS user_credentials (
-    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
-    password_hash TEXT NOT NULL,
-    last_login TIMESTAMP WITH TIME ZONE,
-    is_active BOOLEAN DEFAULT true
-);
-
-CREATE TABLE IF NOT EXISTS assets (
-    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    creator_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-    file_name TEXT NOT NULL,
-    file_url TEXT NOT NULL,
-    file_format VARCHAR(10) CHECK (file_format IN ('glb', 'gltf', 'obj')),
-    preview_url TEXT,
-    thumbnail_url TEXT,
-    downloads INT DEFAULT 0,
-    likes INT DEFAULT 0,
-    description TEXT,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
-    is_public BOOLEAN DEFAULT true
-);
-
-CREATE TABLE IF NOT EXISTS asset_tags (
-    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
-    tag VARCHAR(50) NOT NULL,
-    PRIMARY KEY(asset_id, tag)
-);
-
-CREATE TABLE IF NOT EXISTS asset_metadata (
-    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
-    key VARCHAR(50) NOT NULL,
-    value TEXT,
-    PRIMARY KEY(asset_id, key)
-);
-
-CREATE TABLE IF NOT EXISTS asset_downloads (
-    id SERIAL PRIMARY KEY,
-    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
-    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
-    downloaded_at TIMESTAMP WITH TIME ZONE DEFAULT now()
-);
-
-CREATE TABLE IF NOT EXISTS likes (
-    id SERIAL PRIMARY KEY,
-    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
-    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
-    UNIQUE(asset_id, user_id)
-);
-
-CREATE TABLE IF NOT EXISTS notifications (
-    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
-    type VARCHAR(20) CHECK(type IN ('email', 'sms', 'push')),
-    destination VARCHAR(255) NOT NULL,   -- email/phone/device_token
-    subject TEXT,
-    message TEXT,
-    status VARCHAR(20) CHECK(status IN ('queued', 'sent', 'failed')),
-    sent_at TIMESTAMP WITH TIME ZONE,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
-);
-
-CREATE TABLE IF NOT EXISTS notification_queue (
-    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    notification_id UUID NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
-    queued_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
-    processed_at TIMESTAMP WITH TIME ZONE
-);
\ No newline at end of file
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// Caller is the authenticated identity behind a request. When an admin
+// impersonates a user, UserID and Role are the user's and Actor is the
+// admin's ID.
+type Caller struct {
+	UserID uuid.UUID
+	Role   Role
+	Actor  uuid.UUID
+}
+
+// IsImpersonated reports whether an admin is acting as this user.
+func (c *Caller) IsImpersonated() bool {
+	return c != nil && c.Actor != uuid.Nil
+}
+
+func (c *Caller) IsAdmin() bool {
+	return c != nil && c.Role == RoleAdmin
+}
+
+// IsModerator reports whether the caller may take moderation actions.
+// Admins are moderators too.
+func (c *Caller) IsModerator() bool {
+	return c != nil && (c.Role == RoleModerator || c.Role == RoleAdmin)
+}
+
+// Is reports whether the caller is the user with the given ID.
+func (c *Caller) Is(id uuid.UUID) bool {
+	return c != nil && c.UserID == id
+}
+
+type callerKey struct{}
+
+func NewContext(ctx context.Context, c *Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// FromContext returns the authenticated caller, or nil for anonymous
+// requests.
+func FromContext(ctx context.Context) *Caller {
+	c, _ := ctx.Value(callerKey{}).(*Caller)
+	return c
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AccountCheck is consulted for every verified token. It returns nil if the
+// account may still act, or a gRPC status error explaining why not.
+type AccountCheck func(ctx context.Context, id uuid.UUID) error
+
+type InterceptorOption func(*interceptorOptions)
+
+type interceptorOptions struct {
+	check AccountCheck
+}
+
+// WithAccountCheck rejects otherwise valid tokens whose account has since
+// been suspended, banned or deactivated.
+func WithAccountCheck(check AccountCheck) InterceptorOption {
+	return func(o *interceptorOptions) { o.check = check }
+}
+
+// UnaryServerInterceptor attaches the Caller from an "authorization: Bearer"
+// header to the request context. Requests without the header continue
+// anonymously; requests with a bad token are rejected.
+func UnaryServerInterceptor(tokens *TokenManager, opts ...InterceptorOption) grpc.UnaryServerInterceptor {
+	var o interceptorOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		token := bearerToken(ctx)
+		if token == "" {
+			return handler(ctx, req)
+		}
+		caller, err := tokens.Verify(ctx, token)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		if o.check != nil {
+			if err := o.check(ctx, caller.UserID); err != nil {
+				return nil, err
+			}
+			// The impersonating admin has to be in good standing too.
+			if caller.IsImpersonated() {
+				if err := o.check(ctx, caller.Actor); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return handler(NewContext(ctx, caller), req)
+	}
+}
+
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, v := range md.Get("authorization") {
+		if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+			return strings.TrimSpace(v[7:])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shatwik7/polycrate/lib/jwks"
+)
+
+const (
+	DefaultRotationInterval = 30 * 24 * time.Hour
+	// DefaultRetirementGrace keeps a retired key published long enough for
+	// every token it signed to expire.
+	DefaultRetirementGrace = 2 * DefaultTokenTTL
+	jwksMaxAge             = 5 * time.Minute
+)
+
+var ErrNoSigningKey = errors.New("no active signing key")
+
+// StoredKey is a signing key as kept by a KeyStore. The private key is
+// sealed with the key ring's secret.
+type StoredKey struct {
+	ID        string
+	Algorithm string
+	Sealed    []byte
+	CreatedAt time.Time
+	// RetiredAt is zero while the key still signs new tokens.
+	RetiredAt time.Time
+}
+
+// KeyStore persists signing keys so every instance of the user service
+// signs with and publishes the same set.
+type KeyStore interface {
+	// SigningKeys returns every stored key, newest first.
+	SigningKeys(ctx context.Context) ([]StoredKey, error)
+	// AddSigningKey stores key and retires the keys that were signing
+	// before it, unless a key created after staleBefore already exists. It
+	// reports whether key was added.
+	AddSigningKey(ctx context.Context, key StoredKey, staleBefore time.Time) (bool, error)
+	// DeleteSigningKeys removes keys retired before the given time.
+	DeleteSigningKeys(ctx context.Context, retiredBefore time.Time) error
+}
+
+// SigningKey is an unsealed ES256 key.
+type SigningKey struct {
+	ID        string
+	Private   *ecdsa.PrivateKey
+	CreatedAt time.Time
+	RetiredAt time.Time
+}
+
+// KeyRing holds the signing keys loaded from a KeyStore. The newest active
+// key signs; every key that hasn't outlived its retirement grace period
+// verifies and is published in the JWKS.
+type KeyRing struct {
+	store       KeyStore
+	aead        cipher.AEAD
+	rotateEvery time.Duration
+	grace       time.Duration
+
+	mu   sync.RWMutex
+	keys []SigningKey
+}
+
+// NewKeyRing returns a key ring backed by store. secret encrypts private
+// keys at rest; every instance sharing the store needs the same secret.
+func NewKeyRing(store KeyStore, secret []byte, rotateEvery, grace time.Duration) *KeyRing {
+	if rotateEvery <= 0 {
+		rotateEvery = DefaultRotationInterval
+	}
+	if grace <= 0 {
+		grace = DefaultRetirementGrace
+	}
+	sum := sha256.Sum256(secret)
+	block, _ := aes.NewCipher(sum[:])
+	aead, _ := cipher.NewGCM(block)
+	return &KeyRing{store: store, aead: aead, rotateEvery: rotateEvery, grace: grace}
+}
+
+// Load replaces the in-memory keys with the ones in the store.
+func (r *KeyRing) Load(ctx context.Context) error {
+	stored, err := r.store.SigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var keys []SigningKey
+	for _, s := range stored {
+		if !s.RetiredAt.IsZero() && now.Sub(s.RetiredAt) > r.grace {
+			continue
+		}
+		private, err := r.unseal(s.Sealed)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", s.ID, err)
+		}
+		keys = append(keys, SigningKey{ID: s.ID, Private: private, CreatedAt: s.CreatedAt, RetiredAt: s.RetiredAt})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	r.mu.Lock()
+	r.keys = keys
+	r.mu.Unlock()
+	return nil
+}
+
+// Rotate adds a new signing key if there is none or the current one is
+// older than the rotation interval, deletes keys past their grace period
+// and reloads the ring.
+func (r *KeyRing) Rotate(ctx context.Context, now time.Time) error {
+	if err := r.Load(ctx); err != nil {
+		return err
+	}
+	if current, err := r.current(); err != nil || now.Sub(current.CreatedAt) >= r.rotateEvery {
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		sealed, err := r.seal(private)
+		if err != nil {
+			return err
+		}
+		key := StoredKey{ID: uuid.NewString(), Algorithm: jwks.AlgES256, Sealed: sealed, CreatedAt: now}
+		if _, err := r.store.AddSigningKey(ctx, key, now.Add(-r.rotateEvery)); err != nil {
+			return err
+		}
+	}
+	if err := r.store.DeleteSigningKeys(ctx, now.Add(-r.grace)); err != nil {
+		return err
+	}
+	return r.Load(ctx)
+}
+
+// Run rotates and reloads the ring every interval until ctx is done, so
+// instances pick up keys rotated by their peers.
+func (r *KeyRing) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := r.Rotate(ctx, now); err != nil {
+				log.Printf("auth: rotating signing keys: %v", err)
+			}
+		}
+	}
+}
+
+// current returns the key new tokens are signed with.
+func (r *KeyRing) current() (SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, k := range r.keys {
+		if k.RetiredAt.IsZero() {
+			return k, nil
+		}
+	}
+	return SigningKey{}, ErrNoSigningKey
+}
+
+// JWKS returns the public half of every key in the ring.
+func (r *KeyRing) JWKS() *jwks.Set {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	set := &jwks.Set{Keys: []jwks.Key{}}
+	for _, k := range r.keys {
+		set.Keys = append(set.Keys, jwks.NewKey(k.ID, &k.Private.PublicKey))
+	}
+	return set
+}
+
+// ServeHTTP serves the key set as /.well-known/jwks.json.
+func (r *KeyRing) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	_ = json.NewEncoder(w).Encode(r.JWKS())
+}
+
+func (r *KeyRing) seal(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, r.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return r.aead.Seal(nonce, nonce, der, nil), nil
+}
+
+func (r *KeyRing) unseal(sealed []byte) (*ecdsa.PrivateKey, error) {
+	n := r.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("sealed key is truncated")
+	}
+	der, err := r.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, errors.New("can't decrypt signing key; is JWT_SECRET the same on every instance?")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an ECDSA key")
+	}
+	return key, nil
+}
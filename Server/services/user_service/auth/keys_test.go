@@ -0,0 +1,120 @@
+package auth_test
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryKeyStore is an auth.KeyStore for tests.
+type memoryKeyStore struct {
+	mu   sync.Mutex
+	keys []auth.StoredKey
+}
+
+func (s *memoryKeyStore) SigningKeys(ctx context.Context) ([]auth.StoredKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := append([]auth.StoredKey(nil), s.keys...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *memoryKeyStore) AddSigningKey(ctx context.Context, key auth.StoredKey, staleBefore time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if k.RetiredAt.IsZero() && k.CreatedAt.After(staleBefore) {
+			return false, nil
+		}
+	}
+	for i := range s.keys {
+		if s.keys[i].RetiredAt.IsZero() {
+			s.keys[i].RetiredAt = key.CreatedAt
+		}
+	}
+	s.keys = append(s.keys, key)
+	return true, nil
+}
+
+func (s *memoryKeyStore) DeleteSigningKeys(ctx context.Context, retiredBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.keys[:0]
+	for _, k := range s.keys {
+		if k.RetiredAt.IsZero() || !k.RetiredAt.Before(retiredBefore) {
+			kept = append(kept, k)
+		}
+	}
+	s.keys = kept
+	return nil
+}
+
+func newTokenManager(t *testing.T, ttl time.Duration) *auth.TokenManager {
+	t.Helper()
+	keys := auth.NewKeyRing(&memoryKeyStore{}, []byte("secret"), time.Hour, 2*time.Hour)
+	assert.NoError(t, keys.Rotate(context.Background(), time.Now()))
+	return auth.NewTokenManager(keys, ttl)
+}
+
+func kids(keys *auth.KeyRing) []string {
+	var ids []string
+	for _, k := range keys.JWKS().Keys {
+		ids = append(ids, k.Kid)
+	}
+	return ids
+}
+
+func TestKeyRotation(t *testing.T) {
+	store := &memoryKeyStore{}
+	keys := auth.NewKeyRing(store, []byte("secret"), time.Hour, 2*time.Hour)
+	tokens := auth.NewTokenManager(keys, time.Hour)
+	start := time.Now()
+
+	assert.NoError(t, keys.Rotate(context.Background(), start))
+	first := kids(keys)
+	assert.Len(t, first, 1)
+	old, err := tokens.Issue(uuid.New(), auth.RoleUser)
+	assert.NoError(t, err)
+
+	assert.NoError(t, keys.Rotate(context.Background(), start.Add(30*time.Minute)))
+	assert.Equal(t, first, kids(keys))
+
+	// The old key stops signing but keeps verifying.
+	assert.NoError(t, keys.Rotate(context.Background(), start.Add(61*time.Minute)))
+	assert.Len(t, kids(keys), 2)
+	assert.Contains(t, kids(keys), first[0])
+	_, err = tokens.Verify(context.Background(), old)
+	assert.NoError(t, err)
+
+	// Past its grace period the first key is gone.
+	assert.NoError(t, keys.Rotate(context.Background(), start.Add(4*time.Hour)))
+	assert.NotContains(t, kids(keys), first[0])
+	assert.Len(t, kids(keys), 2)
+}
+
+func TestKeyRingSharesStore(t *testing.T) {
+	store := &memoryKeyStore{}
+	a := auth.NewKeyRing(store, []byte("secret"), time.Hour, 2*time.Hour)
+	b := auth.NewKeyRing(store, []byte("secret"), time.Hour, 2*time.Hour)
+	assert.NoError(t, a.Rotate(context.Background(), time.Now()))
+	assert.NoError(t, b.Rotate(context.Background(), time.Now()))
+	assert.Equal(t, kids(a), kids(b), "a fresh key is not rotated again by a peer")
+
+	// A token signed after a peer rotated is picked up by reloading.
+	verifier := auth.NewTokenManager(a, time.Hour)
+	assert.NoError(t, b.Rotate(context.Background(), time.Now().Add(2*time.Hour)))
+	token, err := auth.NewTokenManager(b, time.Hour).Issue(uuid.New(), auth.RoleUser)
+	assert.NoError(t, err)
+	_, err = verifier.Verify(context.Background(), token)
+	assert.NoError(t, err)
+
+	wrongSecret := auth.NewKeyRing(store, []byte("other"), time.Hour, 2*time.Hour)
+	assert.Error(t, wrongSecret.Load(context.Background()))
+}
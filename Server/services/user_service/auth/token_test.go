@@ -0,0 +1,115 @@
+package auth_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestIssueAndVerify(t *testing.T) {
+	tokens := newTokenManager(t, time.Hour)
+	id := uuid.New()
+
+	token, err := tokens.Issue(id, auth.RoleAdmin)
+	assert.NoError(t, err)
+
+	caller, err := tokens.Verify(context.Background(), token)
+	assert.NoError(t, err)
+	assert.Equal(t, id, caller.UserID)
+	assert.True(t, caller.IsAdmin())
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+	keys := auth.NewKeyRing(&memoryKeyStore{}, []byte("secret"), time.Hour, 2*time.Hour)
+	assert.NoError(t, keys.Rotate(context.Background(), time.Now()))
+	tokens := auth.NewTokenManager(keys, time.Hour)
+	other := newTokenManager(t, time.Hour)
+	expired := auth.NewTokenManager(keys, -time.Hour)
+
+	forged, _ := other.Issue(uuid.New(), auth.RoleAdmin)
+	_, err := tokens.Verify(context.Background(), forged)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	_, err = tokens.Verify(context.Background(), "not.a.token")
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	// A non-positive TTL falls back to the default rather than issuing
+	// already-expired tokens.
+	fresh, _ := expired.Issue(uuid.New(), auth.RoleUser)
+	_, err = tokens.Verify(context.Background(), fresh)
+	assert.NoError(t, err)
+}
+
+func TestInterceptor(t *testing.T) {
+	tokens := newTokenManager(t, time.Hour)
+	interceptor := auth.UnaryServerInterceptor(tokens)
+	id := uuid.New()
+	token, _ := tokens.Issue(id, auth.RoleUser)
+
+	var seen *auth.Caller
+	handler := func(ctx context.Context, req any) (any, error) {
+		seen = auth.FromContext(ctx)
+		return nil, nil
+	}
+
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err)
+	assert.Nil(t, seen)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	_, err = interceptor(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err)
+	assert.True(t, seen.Is(id))
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer garbage"))
+	_, err = interceptor(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestImpersonationToken(t *testing.T) {
+	tokens := newTokenManager(t, time.Hour)
+	user, admin := uuid.New(), uuid.New()
+
+	token, expiresAt, err := tokens.Impersonate(user, auth.RoleUser, admin, time.Hour)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(auth.DefaultImpersonationTTL), expiresAt, time.Second)
+
+	caller, err := tokens.Verify(context.Background(), token)
+	assert.NoError(t, err)
+	assert.True(t, caller.Is(user))
+	assert.Equal(t, admin, caller.Actor)
+	assert.True(t, caller.IsImpersonated())
+	assert.False(t, caller.IsAdmin())
+
+	plain, _ := tokens.Issue(user, auth.RoleUser)
+	caller, _ = tokens.Verify(context.Background(), plain)
+	assert.False(t, caller.IsImpersonated())
+}
+
+func TestInterceptorChecksImpersonatingAdmin(t *testing.T) {
+	tokens := newTokenManager(t, time.Hour)
+	user, admin := uuid.New(), uuid.New()
+	token, _, _ := tokens.Impersonate(user, auth.RoleUser, admin, 0)
+
+	var checked []uuid.UUID
+	check := func(ctx context.Context, id uuid.UUID) error {
+		checked = append(checked, id)
+		if id == admin {
+			return status.Error(codes.PermissionDenied, "banned")
+		}
+		return nil
+	}
+	interceptor := auth.UnaryServerInterceptor(tokens, auth.WithAccountCheck(check))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) { return nil, nil })
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, []uuid.UUID{user, admin}, checked)
+}
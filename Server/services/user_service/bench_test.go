@@ -0,0 +1,113 @@
+package userservice_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lib/pq"
+	"github.com/shatwik7/polycrate/lib/db"
+	"github.com/shatwik7/polycrate/lib/db/dbtest"
+	userservice "github.com/shatwik7/polycrate/services/user_service"
+)
+
+// The benchmarks compare the pgx driver lib/db uses now with lib/pq, which
+// it used before. Each gets a schema of its own from lib/db/dbtest; run
+// them with
+//
+//	TEST_DATABASE_URL=... go test ./services/user_service -run '^$' -bench .
+
+// benchDrivers opens a fresh schema once through each driver.
+func benchDrivers(b *testing.B) map[string]*db.DB {
+	b.Helper()
+	pgxDB := dbtest.New(b)
+	var schema string
+	if err := pgxDB.QueryRow(`SELECT current_schema()`).Scan(&schema); err != nil {
+		b.Fatal(err)
+	}
+	dsn, err := dbtest.WithSearchPath(os.Getenv(dbtest.EnvDatabaseURL), schema+",public")
+	if err != nil {
+		b.Fatal(err)
+	}
+	pqConn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pqDB := &db.DB{Conn: pqConn}
+	b.Cleanup(func() { pqDB.Close() })
+	return map[string]*db.DB{"lib-pq": pqDB, "pgx": pgxDB}
+}
+
+func BenchmarkListUsers(b *testing.B) {
+	drivers := benchDrivers(b)
+	seed := drivers["pgx"]
+	for i := 0; i < 500; i++ {
+		_, err := seed.Exec(`INSERT INTO users (username, email, full_name, created_at, updated_at)
+			VALUES ($1, $2, 'Bench User', now(), now())`,
+			fmt.Sprintf("bench_%d", i), fmt.Sprintf("bench_%d@site.com", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"lib-pq", "pgx"} {
+		repo := userservice.NewUserRepository(drivers[name])
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := repo.ListUsers(ctx, userservice.Page{Limit: 100}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBulkInsert loads 1000 rows per iteration into a scratch table,
+// with unnest over array parameters and, on pgx, with COPY.
+func BenchmarkBulkInsert(b *testing.B) {
+	const rows = 1000
+	drivers := benchDrivers(b)
+	scratch := drivers["pgx"]
+	if _, err := scratch.Exec(`CREATE TABLE bench_users (username TEXT, email TEXT, full_name TEXT)`); err != nil {
+		b.Fatal(err)
+	}
+
+	cols := make([][]string, 3)
+	copyRows := make([][]any, rows)
+	for i := 0; i < rows; i++ {
+		username, email := fmt.Sprintf("bench_%d", i), fmt.Sprintf("bench_%d@site.com", i)
+		cols[0] = append(cols[0], username)
+		cols[1] = append(cols[1], email)
+		cols[2] = append(cols[2], "Bench User")
+		copyRows[i] = []any{username, email, "Bench User"}
+	}
+	const unnest = `INSERT INTO bench_users (username, email, full_name)
+		SELECT * FROM unnest($1::text[], $2::text[], $3::text[])`
+
+	b.Run("lib-pq/unnest", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := drivers["lib-pq"].ExecContext(ctx, unnest, pq.Array(cols[0]), pq.Array(cols[1]), pq.Array(cols[2]))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pgx/unnest", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := drivers["pgx"].ExecContext(ctx, unnest, cols[0], cols[1], cols[2]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pgx/copy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := drivers["pgx"].CopyFrom(ctx, pgx.Identifier{"bench_users"},
+				[]string{"username", "email", "full_name"}, pgx.CopyFromRows(copyRows))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,310 @@
+package userservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	DefaultImportBatchSize = 1000
+	MaxLocationLength      = 100
+	exportPageSize         = 1000
+	// unusablePasswordHash is stored for imported users who came without a
+	// password. It never matches, so they must have one set before signing in.
+	unusablePasswordHash = "!"
+)
+
+var ErrImportConflict = errors.New("import stopped at a conflicting row")
+
+// UserRecord is one user as read by Importer or written by ExportUsers.
+type UserRecord struct {
+	// Line is the position of the record in the input, for error reports.
+	Line         int    `json:"-"`
+	Username     string `json:"username"`
+	Email        string `json:"email"`
+	FullName     string `json:"full_name,omitempty"`
+	Bio          string `json:"bio,omitempty"`
+	Website      string `json:"website,omitempty"`
+	Location     string `json:"location,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// ConflictStrategy decides what happens to a record whose username or
+// email already exists.
+type ConflictStrategy string
+
+const (
+	// ConflictSkip leaves the existing user alone and moves on.
+	ConflictSkip ConflictStrategy = "skip"
+	// ConflictUpdate overwrites the profile of the user with the same
+	// email. A username that belongs to a different user is still an error.
+	ConflictUpdate ConflictStrategy = "update"
+	// ConflictFail stops the import. Batches already written stay written.
+	// A dry run reports the conflict and carries on.
+	ConflictFail ConflictStrategy = "fail"
+)
+
+type ImportOptions struct {
+	OnConflict ConflictStrategy
+	BatchSize  int
+	// DryRun validates every record and reports what would happen without
+	// writing anything.
+	DryRun bool
+}
+
+type RowError struct {
+	Line    int
+	Field   string
+	Message string
+}
+
+func (e RowError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+	return fmt.Sprintf("line %d: %s %s", e.Line, e.Field, e.Message)
+}
+
+type ImportReport struct {
+	Inserted int
+	Updated  int
+	Skipped  int
+	Errors   []RowError
+}
+
+// Importer writes users in batches. Add records one at a time and call
+// Flush once the input is exhausted.
+type Importer struct {
+	repo      UserStore
+	opts      ImportOptions
+	pending   []UserRecord
+	usernames map[string]int
+	emails    map[string]int
+	report    ImportReport
+}
+
+func (s *UserService) NewImporter(opts ImportOptions) *Importer {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultImportBatchSize
+	}
+	if opts.OnConflict == "" {
+		opts.OnConflict = ConflictFail
+	}
+	return &Importer{
+		repo:      s.Repo,
+		opts:      opts,
+		usernames: make(map[string]int),
+		emails:    make(map[string]int),
+	}
+}
+
+// Report returns the outcome of every record flushed so far.
+func (im *Importer) Report() ImportReport {
+	return im.report
+}
+
+// RecordError reports a record that couldn't be read at all.
+func (im *Importer) RecordError(line int, message string) {
+	im.report.Errors = append(im.report.Errors, RowError{Line: line, Message: message})
+}
+
+// Add validates r and queues it for the next batch. Invalid records are
+// reported and dropped; the returned error is only set when the import
+// can't go on.
+func (im *Importer) Add(ctx context.Context, r UserRecord) error {
+	if violations := validateUserRecord(r); len(violations) > 0 {
+		for _, v := range violations {
+			im.report.Errors = append(im.report.Errors, RowError{Line: r.Line, Field: v.Field, Message: v.Description})
+		}
+		return nil
+	}
+	if line, ok := im.usernames[r.Username]; ok {
+		im.report.Errors = append(im.report.Errors, RowError{Line: r.Line, Field: "username", Message: fmt.Sprintf("duplicates line %d", line)})
+		return nil
+	}
+	if line, ok := im.emails[r.Email]; ok {
+		im.report.Errors = append(im.report.Errors, RowError{Line: r.Line, Field: "email", Message: fmt.Sprintf("duplicates line %d", line)})
+		return nil
+	}
+	im.usernames[r.Username] = r.Line
+	im.emails[r.Email] = r.Line
+
+	im.pending = append(im.pending, r)
+	if len(im.pending) >= im.opts.BatchSize {
+		return im.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush writes the queued records in one transaction.
+func (im *Importer) Flush(ctx context.Context) error {
+	records := im.pending
+	im.pending = nil
+	if len(records) == 0 {
+		return nil
+	}
+
+	var outcome ImportReport
+	err := im.repo.WithTx(ctx, func(repo UserStore) error {
+		outcome = ImportReport{}
+		usernames := make([]string, len(records))
+		emails := make([]string, len(records))
+		for i, r := range records {
+			usernames[i], emails[i] = r.Username, r.Email
+		}
+		byUsername, byEmail, err := repo.FindExistingUsers(ctx, usernames, emails)
+		if err != nil {
+			return err
+		}
+
+		var inserts []UserRecord
+		var updates []UserRecord
+		var updateIDs []uuid.UUID
+		for _, r := range records {
+			sameName, nameTaken := byUsername[r.Username]
+			sameEmail, emailTaken := byEmail[r.Email]
+			if !nameTaken && !emailTaken {
+				inserts = append(inserts, r)
+				continue
+			}
+			field := "email"
+			if !emailTaken {
+				field = "username"
+			}
+			switch im.opts.OnConflict {
+			case ConflictSkip:
+				outcome.Skipped++
+			case ConflictUpdate:
+				if !emailTaken || (nameTaken && sameName != sameEmail) {
+					outcome.Errors = append(outcome.Errors, RowError{Line: r.Line, Field: "username", Message: "belongs to another user"})
+					continue
+				}
+				updates = append(updates, r)
+				updateIDs = append(updateIDs, sameEmail)
+			default:
+				outcome.Errors = append(outcome.Errors, RowError{Line: r.Line, Field: field, Message: "already exists"})
+				// A dry run goes on to report every conflict.
+				if !im.opts.DryRun {
+					return ErrImportConflict
+				}
+			}
+		}
+
+		if im.opts.DryRun {
+			outcome.Inserted += len(inserts)
+			outcome.Updated += len(updates)
+			return nil
+		}
+		if len(inserts) > 0 {
+			inserted, err := repo.InsertUserRecords(ctx, inserts)
+			if err != nil {
+				return err
+			}
+			outcome.Inserted += inserted
+			// Rows that lost a race with a concurrent signup.
+			outcome.Skipped += len(inserts) - inserted
+		}
+		if len(updates) > 0 {
+			if err := repo.UpdateUserRecords(ctx, updateIDs, updates); err != nil {
+				return err
+			}
+			outcome.Updated += len(updates)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrImportConflict) {
+		return err
+	}
+	im.report.Errors = append(im.report.Errors, outcome.Errors...)
+	if err != nil {
+		return err
+	}
+	im.report.Inserted += outcome.Inserted
+	im.report.Updated += outcome.Updated
+	im.report.Skipped += outcome.Skipped
+	return nil
+}
+
+var userRecordRules = []struct {
+	field string
+	value func(UserRecord) string
+	rules []Rule
+}{
+	{"username", func(r UserRecord) string { return r.Username }, []Rule{required, length(MinUsernameLength, MaxUsernameLength), matches(usernamePattern, "may only contain letters, digits, '_', '.' and '-'")}},
+	{"email", func(r UserRecord) string { return r.Email }, []Rule{required, maxLength(MaxEmailLength), email}},
+	{"full_name", func(r UserRecord) string { return r.FullName }, []Rule{maxLength(MaxFullNameLength)}},
+	{"bio", func(r UserRecord) string { return r.Bio }, []Rule{maxLength(MaxBioLength)}},
+	{"website", func(r UserRecord) string { return r.Website }, []Rule{optional(httpURL)}},
+	{"location", func(r UserRecord) string { return r.Location }, []Rule{maxLength(MaxLocationLength)}},
+	{"password_hash", func(r UserRecord) string { return r.PasswordHash }, []Rule{optional(bcryptHash)}},
+}
+
+// validateUserRecord applies the same rules CreateUser requests go through.
+func validateUserRecord(r UserRecord) []FieldViolation {
+	var violations []FieldViolation
+	for _, fr := range userRecordRules {
+		v := protoreflect.ValueOfString(fr.value(r))
+		for _, rule := range fr.rules {
+			if desc := rule(v); desc != "" {
+				violations = append(violations, FieldViolation{Field: fr.field, Description: desc})
+				break
+			}
+		}
+	}
+	return violations
+}
+
+func bcryptHash(v protoreflect.Value) string {
+	if _, err := bcrypt.Cost([]byte(v.String())); err != nil {
+		return "must be a bcrypt hash"
+	}
+	return ""
+}
+
+// ExportUsers calls fn for every user in creation order. Password hashes
+// are only included when withPasswordHash is set.
+func (s *UserService) ExportUsers(ctx context.Context, withPasswordHash bool, fn func(UserRecord) error) error {
+	page := Page{Limit: exportPageSize}
+	for {
+		users, err := s.Repo.ListUsers(ctx, page)
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return nil
+		}
+		var hashes map[uuid.UUID]string
+		if withPasswordHash {
+			ids := make([]uuid.UUID, len(users))
+			for i, u := range users {
+				ids[i] = u.ID
+			}
+			if hashes, err = s.Repo.FindPasswordHashes(ctx, ids); err != nil {
+				return err
+			}
+		}
+		for _, u := range users {
+			r := UserRecord{
+				Username: u.Username,
+				Email:    u.Email,
+				FullName: u.FullName,
+				Bio:      u.Bio,
+				Website:  u.Website.String,
+				Location: u.Location.String,
+			}
+			if hash := hashes[u.ID]; hash != unusablePasswordHash {
+				r.PasswordHash = hash
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		last := users[len(users)-1]
+		page.After = &PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+}
@@ -0,0 +1,33 @@
+package userservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestValidateUserRecord(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	valid := UserRecord{
+		Username:     "jane.doe",
+		Email:        "jane@example.com",
+		Website:      "https://jane.example.com",
+		PasswordHash: string(hash),
+	}
+	assert.Empty(t, validateUserRecord(valid))
+
+	invalid := UserRecord{
+		Username:     "jane doe",
+		Email:        "jane",
+		Website:      "jane.example.com",
+		PasswordHash: "password",
+	}
+	var fields []string
+	for _, v := range validateUserRecord(invalid) {
+		fields = append(fields, v.Field)
+	}
+	assert.Equal(t, []string{"username", "email", "website", "password_hash"}, fields)
+}
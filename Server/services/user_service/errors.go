@@ -0,0 +1,198 @@
+package userservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shatwik7/polycrate/lib/db"
+	"github.com/shatwik7/polycrate/lib/etag"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrAccountInactive    = errors.New("account is deactivated")
+	ErrPermissionDenied   = errors.New("permission denied")
+	ErrUnauthenticated    = errors.New("authentication required")
+	ErrAccountSuspended   = errors.New("account is suspended")
+	ErrAccountBanned      = errors.New("account is banned")
+	ErrNotSuspended       = errors.New("account is not suspended")
+	ErrImpersonated       = errors.New("not allowed while impersonating a user")
+	ErrVersionConflict    = errors.New("user has changed since it was read")
+)
+
+// FieldViolation describes one invalid field of a request.
+type FieldViolation struct {
+	Field       string
+	Description string
+}
+
+// ValidationError is returned when a request is rejected before it reaches
+// the database. It maps to InvalidArgument with a BadRequest detail.
+type ValidationError struct {
+	Violations []FieldViolation
+}
+
+func NewValidationError(field, description string) *ValidationError {
+	return &ValidationError{Violations: []FieldViolation{{Field: field, Description: description}}}
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Violations) == 1 {
+		return fmt.Sprintf("invalid %s: %s", e.Violations[0].Field, e.Violations[0].Description)
+	}
+	return fmt.Sprintf("%d invalid fields", len(e.Violations))
+}
+
+// ConflictError is returned when a write violates a unique constraint.
+// Field names the request field that already holds the value, or is
+// "resource" when the constraint isn't one clients know about.
+type ConflictError struct {
+	Field string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Field + " already exists"
+}
+
+// uniqueConstraintFields maps Postgres unique constraint names to the
+// request field a client should change.
+var uniqueConstraintFields = map[string]string{
+	"users_username_key": "username",
+	"users_email_key":    "email",
+}
+
+// conflictResource is the Field of a ConflictError for a unique constraint
+// missing from uniqueConstraintFields.
+const conflictResource = "resource"
+
+// invalidArgumentFields maps sentinel errors that only ever describe bad
+// input to the request field they concern.
+var invalidArgumentFields = map[error]string{
+	ErrInvalidPageToken:   "page_token",
+	ErrEmptySearchQuery:   "query",
+	ErrBatchTooLarge:      "ids",
+	ErrInvitationRequired: "invite_code",
+	ErrInvalidInvitation:  "invite_code",
+	etag.ErrInvalid:       "etag",
+}
+
+// mapDBError turns driver errors the service knows how to explain into
+// domain errors. Anything else is returned unchanged.
+func mapDBError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		field, ok := uniqueConstraintFields[pgErr.ConstraintName]
+		if !ok {
+			// Constraint names are schema details; keep them in the log.
+			log.Printf("userservice: unique violation on unmapped constraint %s", pgErr.ConstraintName)
+			field = conflictResource
+		}
+		return &ConflictError{Field: field}
+	}
+	return err
+}
+
+// isQueryCanceled reports whether Postgres cancelled the statement, which
+// the driver asks it to do when the query's context is done.
+func isQueryCanceled(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "57014"
+}
+
+func parseID(field, raw string) (uuid.UUID, error) {
+	id, err := uuid.Parse(raw)
+	if err != nil {
+		return uuid.Nil, NewValidationError(field, "must be a valid UUID")
+	}
+	return id, nil
+}
+
+// toStatus converts an error returned by UserService into a gRPC status.
+// Errors that aren't part of the service's error model are logged and
+// reported as Internal so driver and SQL details never reach the client.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		return badRequest(validation.Violations)
+	}
+	for sentinel, field := range invalidArgumentFields {
+		if errors.Is(err, sentinel) {
+			return badRequest([]FieldViolation{{Field: field, Description: sentinel.Error()}})
+		}
+	}
+
+	var conflict *ConflictError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), isQueryCanceled(err):
+		return status.Error(codes.DeadlineExceeded, "request timed out")
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "request canceled")
+	case db.IsRetryable(err):
+		return status.Error(codes.Aborted, "conflicting concurrent update, try again")
+	case errors.As(err, &conflict):
+		st, _ := status.New(codes.AlreadyExists, conflict.Error()).WithDetails(&errdetails.ErrorInfo{
+			Reason:   "ALREADY_EXISTS",
+			Domain:   "user.polycrate",
+			Metadata: map[string]string{"field": conflict.Field},
+		})
+		return st.Err()
+	case errors.Is(err, ErrVersionConflict):
+		return status.Error(codes.Aborted, ErrVersionConflict.Error())
+	case errors.Is(err, ErrUserNotFound):
+		return status.Error(codes.NotFound, ErrUserNotFound.Error())
+	case errors.Is(err, ErrInvalidCredentials):
+		return status.Error(codes.Unauthenticated, ErrInvalidCredentials.Error())
+	case errors.Is(err, ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, ErrUnauthenticated.Error())
+	case errors.Is(err, ErrAccountInactive):
+		return status.Error(codes.PermissionDenied, ErrAccountInactive.Error())
+	case errors.Is(err, ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, ErrPermissionDenied.Error())
+	case errors.Is(err, ErrImpersonated):
+		return status.Error(codes.PermissionDenied, ErrImpersonated.Error())
+	case errors.Is(err, ErrAccountSuspended):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, ErrAccountBanned):
+		return status.Error(codes.PermissionDenied, ErrAccountBanned.Error())
+	case errors.Is(err, ErrNotSuspended):
+		return status.Error(codes.FailedPrecondition, ErrNotSuspended.Error())
+	case errors.Is(err, ErrRegistrationClosed):
+		return status.Error(codes.FailedPrecondition, ErrRegistrationClosed.Error())
+	case errors.Is(err, ErrInvitationNotFound):
+		return status.Error(codes.NotFound, ErrInvitationNotFound.Error())
+	}
+
+	log.Printf("userservice: internal error: %v", err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+func badRequest(violations []FieldViolation) error {
+	br := &errdetails.BadRequest{}
+	for _, v := range violations {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       v.Field,
+			Description: v.Description,
+		})
+	}
+	msg := "invalid request"
+	if len(violations) == 1 {
+		msg = fmt.Sprintf("invalid %s: %s", violations[0].Field, violations[0].Description)
+	}
+	st, _ := status.New(codes.InvalidArgument, msg).WithDetails(br)
+	return st.Err()
+}
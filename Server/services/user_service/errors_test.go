@@ -0,0 +1,76 @@
+package userservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shatwik7/polycrate/lib/etag"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{"not found", ErrUserNotFound, codes.NotFound},
+		{"wrapped not found", fmt.Errorf("lookup: %w", ErrUserNotFound), codes.NotFound},
+		{"bad credentials", ErrInvalidCredentials, codes.Unauthenticated},
+		{"inactive", ErrAccountInactive, codes.PermissionDenied},
+		{"forbidden", ErrPermissionDenied, codes.PermissionDenied},
+		{"anonymous", ErrUnauthenticated, codes.Unauthenticated},
+		{"page token", ErrInvalidPageToken, codes.InvalidArgument},
+		{"conflict", &ConflictError{Field: "email"}, codes.AlreadyExists},
+		{"timed out", fmt.Errorf("query: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{"statement canceled", &pgconn.PgError{Code: "57014"}, codes.DeadlineExceeded},
+		{"canceled", context.Canceled, codes.Canceled},
+		{"stale etag", ErrVersionConflict, codes.Aborted},
+		{"malformed etag", etag.ErrInvalid, codes.InvalidArgument},
+		{"deadlock", fmt.Errorf("failed to commit transaction: %w", &pgconn.PgError{Code: "40P01"}), codes.Aborted},
+		{"unknown", errors.New("pq: relation \"users\" does not exist"), codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.code, status.Code(toStatus(tt.err)))
+		})
+	}
+}
+
+func TestToStatusHidesInternalDetails(t *testing.T) {
+	st := status.Convert(toStatus(errors.New("pq: password authentication failed for user \"polycrate\"")))
+	assert.Equal(t, "internal error", st.Message())
+}
+
+func TestToStatusFieldViolations(t *testing.T) {
+	st := status.Convert(toStatus(NewValidationError("email", "must be a valid email address")))
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Len(t, st.Details(), 1)
+	br := st.Details()[0].(*errdetails.BadRequest)
+	assert.Equal(t, "email", br.GetFieldViolations()[0].GetField())
+}
+
+func TestMapDBErrorUniqueViolation(t *testing.T) {
+	err := mapDBError(fmt.Errorf("failed to execute query: %w", &pgconn.PgError{Code: "23505", ConstraintName: "users_email_key"}))
+	var conflict *ConflictError
+	assert.ErrorAs(t, err, &conflict)
+	assert.Equal(t, "email", conflict.Field)
+
+	st := status.Convert(toStatus(err))
+	assert.Equal(t, codes.AlreadyExists, st.Code())
+	assert.Equal(t, "email", st.Details()[0].(*errdetails.ErrorInfo).GetMetadata()["field"])
+
+	// Constraints the service doesn't know aren't named to the client.
+	err = mapDBError(&pgconn.PgError{Code: "23505", ConstraintName: "user_follows_pkey"})
+	st = status.Convert(toStatus(err))
+	assert.Equal(t, codes.AlreadyExists, st.Code())
+	assert.Equal(t, "resource already exists", st.Message())
+	assert.Equal(t, "resource", st.Details()[0].(*errdetails.ErrorInfo).GetMetadata()["field"])
+	assert.NotContains(t, st.String(), "user_follows_pkey")
+}
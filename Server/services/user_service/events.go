@@ -0,0 +1,31 @@
+package userservice
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Topics of the events the user service writes to the outbox, in the
+// transaction that makes the change. The relay in lib/events publishes
+// them with the payloads below, encoded as JSON and keyed by the user's
+// id.
+const (
+	TopicUserRegistered = "user.registered"
+	TopicUserDeleted    = "user.deleted"
+)
+
+// UserRegistered is published when CreateUser creates an account.
+// Accounts created by ImportUsers aren't announced.
+type UserRegistered struct {
+	UserID       uuid.UUID  `json:"user_id"`
+	Username     string     `json:"username"`
+	InvitationID *uuid.UUID `json:"invitation_id,omitempty"`
+	RegisteredAt time.Time  `json:"registered_at"`
+}
+
+// UserDeleted is published when an account is deleted.
+type UserDeleted struct {
+	UserID    uuid.UUID `json:"user_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
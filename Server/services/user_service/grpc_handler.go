@@ -2,21 +2,31 @@ package userservice
 
 import (
 	"context"
+	"errors"
+	"net"
 
 	"github.com/google/uuid"
 	"github.com/shatwik7/polycrate/lib/db"
+	"github.com/shatwik7/polycrate/lib/etag"
 	userpb "github.com/shatwik7/polycrate/lib/protos/user"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type UserServer struct {
 	userpb.UnimplementedUserServiceServer
 	Service UserService
+	Tokens  *auth.TokenManager
 }
 
-func NewUserServer(database *db.DB) *UserServer {
+func NewUserServer(database db.Querier, tokens *auth.TokenManager) *UserServer {
 	service := NewUserService(database)
-	return &UserServer{Service: *service}
+	return &UserServer{Service: *service, Tokens: tokens}
 }
 
 func convertUser(u User) *userpb.User {
@@ -31,9 +41,25 @@ func convertUser(u User) *userpb.User {
 		Location:          u.Location.String,
 		CreatedAt:         timestamppb.New(u.CreatedAt),
 		UpdatedAt:         timestamppb.New(u.UpdatedAt),
+		Role:              string(u.Role),
+		Etag:              etag.Format(u.Version),
 	}
 }
 
+// convertUsers returns the public profile of every user, plus the full
+// record of those the caller may see in private.
+func convertUsers(caller *auth.Caller, users []User) ([]*userpb.User, []*userpb.PublicProfile) {
+	var pbUsers []*userpb.User
+	var pbProfiles []*userpb.PublicProfile
+	for _, u := range users {
+		pbProfiles = append(pbProfiles, convertProfile(u))
+		if full := privateUser(caller, u); full != nil {
+			pbUsers = append(pbUsers, full)
+		}
+	}
+	return pbUsers, pbProfiles
+}
+
 func (s *UserServer) CreateUser(ctx context.Context, req *userpb.CreateUserRequest) (*userpb.CreateUserResponse, error) {
 	input := &CreateUserInput{
 		Username:          req.GetUsername(),
@@ -42,100 +68,201 @@ func (s *UserServer) CreateUser(ctx context.Context, req *userpb.CreateUserReque
 		ProfilePictureUrl: req.GetProfilePictureUrl(),
 		Bio:               req.GetBio(),
 		Password:          req.GetPassword(),
+		InviteCode:        req.GetInviteCode(),
 	}
-	user, err := s.Service.CreateUser(input)
+	user, err := s.Service.CreateUser(ctx, input)
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
 	return &userpb.CreateUserResponse{User: convertUser(*user)}, nil
 }
 
 func (s *UserServer) GetUser(ctx context.Context, req *userpb.GetUserRequest) (*userpb.GetUserResponse, error) {
-	id, err := uuid.Parse(req.GetId())
+	id, err := parseID("id", req.GetId())
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
-	user, err := s.Service.GetUserByID(id)
+	user, err := s.Service.GetUserByID(ctx, id)
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
+	}
+	return &userpb.GetUserResponse{
+		User:    privateUser(auth.FromContext(ctx), *user),
+		Profile: convertProfile(*user),
+	}, nil
+}
+
+func (s *UserServer) BatchGetUsers(ctx context.Context, req *userpb.BatchGetUsersRequest) (*userpb.BatchGetUsersResponse, error) {
+	ids := make([]uuid.UUID, 0, len(req.GetIds()))
+	for _, raw := range req.GetIds() {
+		id, err := parseID("ids", raw)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		ids = append(ids, id)
+	}
+	batch, err := s.Service.BatchGetUsers(ctx, ids)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	caller := auth.FromContext(ctx)
+	resp := &userpb.BatchGetUsersResponse{
+		Users:    make(map[string]*userpb.User),
+		Profiles: make(map[string]*userpb.PublicProfile, len(batch.Users)),
 	}
-	return &userpb.GetUserResponse{User: convertUser(*user)}, nil
+	for id, u := range batch.Users {
+		resp.Profiles[id.String()] = convertProfile(u)
+		if full := privateUser(caller, u); full != nil {
+			resp.Users[id.String()] = full
+		}
+	}
+	for _, id := range batch.Missing {
+		resp.MissingIds = append(resp.MissingIds, id.String())
+	}
+	return resp, nil
 }
 
 func (s *UserServer) UpdateUser(ctx context.Context, req *userpb.UpdateUserRequest) (*userpb.UpdateUserResponse, error) {
-	id, err := uuid.Parse(req.GetId())
+	id, err := parseID("id", req.GetId())
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
+	}
+	if err := authorizeSelfOrAdmin(ctx, id); err != nil {
+		return nil, toStatus(err)
+	}
+	version, err := etag.Parse(req.GetEtag())
+	if err != nil {
+		return nil, toStatus(err)
 	}
 	input := &UpdateUserInput{
 		ID:                id,
 		FullName:          req.GetFullName(),
 		ProfilePictureUrl: req.GetProfilePictureUrl(),
 		Bio:               req.GetBio(),
+		Version:           version,
 	}
-	user, err := s.Service.UpdateUser(input)
+	user, err := s.Service.UpdateUser(ctx, input)
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
 	return &userpb.UpdateUserResponse{User: convertUser(*user)}, nil
 }
 
 func (s *UserServer) DeleteUser(ctx context.Context, req *userpb.DeleteUserRequest) (*userpb.DeleteUserResponse, error) {
-	id, err := uuid.Parse(req.GetId())
+	id, err := parseID("id", req.GetId())
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
-	success, err := s.Service.DeleteUser(id)
+	if err := authorizeCredentialChange(ctx, id); err != nil {
+		return nil, toStatus(err)
+	}
+	success, err := s.Service.DeleteUser(ctx, id)
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
 	return &userpb.DeleteUserResponse{Success: success}, nil
 }
 
 func (s *UserServer) ListUsers(ctx context.Context, req *userpb.ListUsersRequest) (*userpb.ListUsersResponse, error) {
-	users, err := s.Service.ListUsers(int(req.GetLimit()), int(req.GetOffset()))
+	page, err := s.Service.ListUsers(ctx, &ListUsersInput{
+		Limit:             int(req.GetLimit()),
+		Offset:            int(req.GetOffset()),
+		PageToken:         req.GetPageToken(),
+		IncludeTotalCount: req.GetIncludeTotalCount(),
+	})
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
-	var pbUsers []*userpb.User
-	for _, u := range users {
-		pbUsers = append(pbUsers, convertUser(u))
-	}
-	return &userpb.ListUsersResponse{Users: pbUsers}, nil
+	pbUsers, pbProfiles := convertUsers(auth.FromContext(ctx), page.Users)
+	return &userpb.ListUsersResponse{
+		Users:         pbUsers,
+		Profiles:      pbProfiles,
+		NextPageToken: page.NextPageToken,
+		TotalCount:    page.TotalCount,
+	}, nil
 }
 
+// SearchByEmail only returns the matching user to admins. Everyone else
+// gets an existence check for the exact address.
 func (s *UserServer) SearchByEmail(ctx context.Context, req *userpb.SearchByEmailRequest) (*userpb.SearchByEmailResponse, error) {
-	user, err := s.Service.SearchByEmail(req.GetEmail())
+	user, err := s.Service.SearchByEmail(ctx, req.GetEmail())
+	if errors.Is(err, ErrUserNotFound) {
+		return &userpb.SearchByEmailResponse{Exists: false}, nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
+	}
+	resp := &userpb.SearchByEmailResponse{Exists: true}
+	if auth.FromContext(ctx).IsAdmin() {
+		resp.User = convertUser(*user)
 	}
-	return &userpb.SearchByEmailResponse{User: convertUser(*user)}, nil
+	return resp, nil
 }
 
 func (s *UserServer) SearchByUsername(ctx context.Context, req *userpb.SearchByUsernameRequest) (*userpb.SearchByUsernameResponse, error) {
-	users, err := s.Service.SearchByUserName(req.GetUsername(), int(req.GetLimit()), int(req.GetOffset()))
+	page, err := s.Service.SearchByUserName(ctx, &SearchByUsernameInput{
+		Username:          req.GetUsername(),
+		Limit:             int(req.GetLimit()),
+		Offset:            int(req.GetOffset()),
+		PageToken:         req.GetPageToken(),
+		IncludeTotalCount: req.GetIncludeTotalCount(),
+	})
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
-	var pbUsers []*userpb.User
-	for _, u := range users {
-		pbUsers = append(pbUsers, convertUser(u))
+	pbUsers, pbProfiles := convertUsers(auth.FromContext(ctx), page.Users)
+	return &userpb.SearchByUsernameResponse{
+		Users:         pbUsers,
+		Profiles:      pbProfiles,
+		NextPageToken: page.NextPageToken,
+		TotalCount:    page.TotalCount,
+	}, nil
+}
+
+func (s *UserServer) SearchUsers(ctx context.Context, req *userpb.SearchUsersRequest) (*userpb.SearchUsersResponse, error) {
+	results, err := s.Service.SearchUsers(ctx, &SearchUsersInput{
+		Query:  req.GetQuery(),
+		Limit:  int(req.GetLimit()),
+		Offset: int(req.GetOffset()),
+		Prefix: req.GetPrefix(),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	caller := auth.FromContext(ctx)
+	var pbResults []*userpb.UserSearchResult
+	for _, r := range results {
+		var highlights []*userpb.SearchHighlight
+		for _, h := range r.Highlights {
+			highlights = append(highlights, &userpb.SearchHighlight{Field: h.Field, Fragment: h.Fragment})
+		}
+		pbResults = append(pbResults, &userpb.UserSearchResult{
+			User:       privateUser(caller, r.User),
+			Profile:    convertProfile(r.User),
+			Score:      r.Score,
+			Highlights: highlights,
+		})
 	}
-	return &userpb.SearchByUsernameResponse{Users: pbUsers}, nil
+	return &userpb.SearchUsersResponse{Results: pbResults}, nil
 }
 
 func (s *UserServer) Login(ctx context.Context, req *userpb.LoginRequest) (*userpb.LoginResponse, error) {
 	input := &LoginInput{
 		Email:    req.GetEmail(),
 		Password: req.GetPassword(),
+		Client:   clientInfo(ctx, req.GetDeviceId()),
 	}
-	user, err := s.Service.Login(input)
+	user, err := s.Service.Login(ctx, input)
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
+	}
+	token, err := s.Tokens.Issue(user.ID, user.Role)
+	if err != nil {
+		return nil, toStatus(err)
 	}
 	return &userpb.LoginResponse{
 		User:  convertUser(*user),
-		Token: "dummy-token", // replace with actual JWT if available
+		Token: token,
 	}, nil
 }
 
@@ -144,28 +271,385 @@ func (s *UserServer) Validate(ctx context.Context, req *userpb.ValidateRequest)
 		Email:    req.GetEmail(),
 		Password: req.GetPassword(),
 	}
-	valid := s.Service.Validate(input)
+	valid := s.Service.Validate(ctx, input)
 	return &userpb.ValidateResponse{Valid: valid}, nil
 }
 
 func (s *UserServer) ChangePassword(ctx context.Context, req *userpb.ChangePasswordRequest) (*userpb.ChangePasswordResponse, error) {
-	id, err := uuid.Parse(req.GetId())
+	id, err := parseID("id", req.GetId())
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
+	}
+	if err := authorizeCredentialChange(ctx, id); err != nil {
+		return nil, toStatus(err)
 	}
 	input := &ChangePasswordInput{
 		ID:          id,
 		NewPassword: req.GetNewPassword(),
 	}
-	success := s.Service.ChangePassword(input)
+	success := s.Service.ChangePassword(ctx, input)
 	return &userpb.ChangePasswordResponse{Success: success}, nil
 }
 
 func (s *UserServer) DeactivateUser(ctx context.Context, req *userpb.DeactivateUserRequest) (*userpb.DeactivateUserResponse, error) {
-	id, err := uuid.Parse(req.GetId())
+	id, err := parseID("id", req.GetId())
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
-	success := s.Service.DeactivateUser(id)
+	if err := authorizeCredentialChange(ctx, id); err != nil {
+		return nil, toStatus(err)
+	}
+	success := s.Service.DeactivateUser(ctx, id)
 	return &userpb.DeactivateUserResponse{Success: success}, nil
 }
+
+// CheckAccount implements auth.AccountCheck so tokens stop working as soon
+// as their account is suspended, banned, deactivated or deleted.
+func (s *UserServer) CheckAccount(ctx context.Context, id uuid.UUID) error {
+	err := s.Service.CheckAccount(ctx, id)
+	if errors.Is(err, ErrUserNotFound) {
+		return status.Error(codes.Unauthenticated, auth.ErrInvalidToken.Error())
+	}
+	return toStatus(err)
+}
+
+func convertModerationAction(a *ModerationAction) *userpb.ModerationAction {
+	pb := &userpb.ModerationAction{
+		Id:          a.ID.String(),
+		UserId:      a.UserID.String(),
+		ModeratorId: a.ModeratorID.String(),
+		Action:      string(a.Action),
+		Reason:      a.Reason,
+		Notes:       a.Notes,
+		CreatedAt:   timestamppb.New(a.CreatedAt),
+	}
+	if a.ExpiresAt.Valid {
+		pb.ExpiresAt = timestamppb.New(a.ExpiresAt.Time)
+	}
+	return pb
+}
+
+// moderationInput builds the service input for a moderation RPC after
+// checking that the caller is a moderator.
+func moderationInput(ctx context.Context, rawID, reason, notes string) (*ModerationInput, error) {
+	caller := auth.FromContext(ctx)
+	if caller == nil {
+		return nil, ErrUnauthenticated
+	}
+	if !caller.IsModerator() {
+		return nil, ErrPermissionDenied
+	}
+	id, err := parseID("id", rawID)
+	if err != nil {
+		return nil, err
+	}
+	return &ModerationInput{UserID: id, Moderator: *caller, Reason: reason, Notes: notes}, nil
+}
+
+func (s *UserServer) SuspendUser(ctx context.Context, req *userpb.SuspendUserRequest) (*userpb.SuspendUserResponse, error) {
+	input, err := moderationInput(ctx, req.GetId(), req.GetReason(), req.GetNotes())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	input.Until = req.GetUntil().AsTime()
+	action, err := s.Service.SuspendUser(ctx, input)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &userpb.SuspendUserResponse{Action: convertModerationAction(action)}, nil
+}
+
+func (s *UserServer) LiftSuspension(ctx context.Context, req *userpb.LiftSuspensionRequest) (*userpb.LiftSuspensionResponse, error) {
+	input, err := moderationInput(ctx, req.GetId(), req.GetReason(), req.GetNotes())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	action, err := s.Service.LiftSuspension(ctx, input)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &userpb.LiftSuspensionResponse{Action: convertModerationAction(action)}, nil
+}
+
+func (s *UserServer) BanUser(ctx context.Context, req *userpb.BanUserRequest) (*userpb.BanUserResponse, error) {
+	input, err := moderationInput(ctx, req.GetId(), req.GetReason(), req.GetNotes())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	action, err := s.Service.BanUser(ctx, input)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &userpb.BanUserResponse{Action: convertModerationAction(action)}, nil
+}
+
+// GetUserStats is public, but the monthly download breakdown is only
+// returned to the creator and admins.
+func (s *UserServer) GetUserStats(ctx context.Context, req *userpb.GetUserStatsRequest) (*userpb.GetUserStatsResponse, error) {
+	id, err := parseID("id", req.GetId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	months := 0
+	if canViewPrivate(auth.FromContext(ctx), id) {
+		months = int(req.GetMonths())
+		if months == 0 {
+			months = DefaultStatsMonths
+		}
+	}
+	stats, err := s.Service.GetUserStats(ctx, id, months)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	pb := &userpb.UserStats{
+		UserId:         stats.UserID.String(),
+		PublicAssets:   stats.PublicAssets,
+		TotalDownloads: stats.TotalDownloads,
+		TotalLikes:     stats.TotalLikes,
+		Followers:      stats.Followers,
+		JoinedAt:       timestamppb.New(stats.JoinedAt),
+	}
+	for _, m := range stats.MonthlyDownloads {
+		pb.MonthlyDownloads = append(pb.MonthlyDownloads, &userpb.MonthlyDownloads{
+			Month:     timestamppb.New(m.Month),
+			Downloads: m.Downloads,
+		})
+	}
+	return &userpb.GetUserStatsResponse{Stats: pb}, nil
+}
+
+func convertInvitation(inv *Invitation) *userpb.Invitation {
+	pb := &userpb.Invitation{
+		Id:        inv.ID.String(),
+		MaxUses:   int32(inv.MaxUses),
+		Uses:      int32(inv.Uses),
+		Email:     inv.Email.String,
+		CreatedAt: timestamppb.New(inv.CreatedAt),
+	}
+	if inv.IssuerID.Valid {
+		pb.IssuerId = inv.IssuerID.UUID.String()
+	}
+	if inv.ExpiresAt.Valid {
+		pb.ExpiresAt = timestamppb.New(inv.ExpiresAt.Time)
+	}
+	if inv.RevokedAt.Valid {
+		pb.RevokedAt = timestamppb.New(inv.RevokedAt.Time)
+	}
+	for _, id := range inv.InviteeIDs {
+		pb.InviteeIds = append(pb.InviteeIds, id.String())
+	}
+	return pb
+}
+
+func (s *UserServer) CreateInvitation(ctx context.Context, req *userpb.CreateInvitationRequest) (*userpb.CreateInvitationResponse, error) {
+	caller := auth.FromContext(ctx)
+	if caller == nil {
+		return nil, toStatus(ErrUnauthenticated)
+	}
+	// Invitation codes are bearer tokens, which impersonated sessions
+	// may not hand out or take back.
+	if caller.IsImpersonated() {
+		return nil, toStatus(ErrImpersonated)
+	}
+	input := &CreateInvitationInput{
+		Issuer:  *caller,
+		MaxUses: int(req.GetMaxUses()),
+		Email:   req.GetEmail(),
+	}
+	if req.GetExpiresAt() != nil {
+		input.ExpiresAt = req.GetExpiresAt().AsTime()
+	}
+	invitation, code, err := s.Service.CreateInvitation(ctx, input)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &userpb.CreateInvitationResponse{Invitation: convertInvitation(invitation), Code: code}, nil
+}
+
+func (s *UserServer) ListInvitations(ctx context.Context, req *userpb.ListInvitationsRequest) (*userpb.ListInvitationsResponse, error) {
+	caller := auth.FromContext(ctx)
+	if caller == nil {
+		return nil, toStatus(ErrUnauthenticated)
+	}
+	issuer := caller.UserID
+	if raw := req.GetIssuerId(); raw != "" {
+		id, err := parseID("issuer_id", raw)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		issuer = id
+	} else if caller.IsAdmin() {
+		issuer = uuid.Nil
+	}
+	if !caller.IsAdmin() && issuer != caller.UserID {
+		return nil, toStatus(ErrPermissionDenied)
+	}
+	invitations, err := s.Service.ListInvitations(ctx, &ListInvitationsInput{
+		IssuerID: issuer,
+		Limit:    int(req.GetLimit()),
+		Offset:   int(req.GetOffset()),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &userpb.ListInvitationsResponse{}
+	for i := range invitations {
+		resp.Invitations = append(resp.Invitations, convertInvitation(&invitations[i]))
+	}
+	return resp, nil
+}
+
+func (s *UserServer) RevokeInvitation(ctx context.Context, req *userpb.RevokeInvitationRequest) (*userpb.RevokeInvitationResponse, error) {
+	caller := auth.FromContext(ctx)
+	if caller == nil {
+		return nil, toStatus(ErrUnauthenticated)
+	}
+	// Invitation codes are bearer tokens, which impersonated sessions
+	// may not hand out or take back.
+	if caller.IsImpersonated() {
+		return nil, toStatus(ErrImpersonated)
+	}
+	id, err := parseID("id", req.GetId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	invitation, err := s.Service.RevokeInvitation(ctx, id, *caller)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &userpb.RevokeInvitationResponse{Invitation: convertInvitation(invitation)}, nil
+}
+
+// clientInfo describes the caller of ctx for the login history. The
+// address is the gRPC peer's, so behind a proxy it is the proxy's.
+func clientInfo(ctx context.Context, deviceID string) ClientInfo {
+	info := ClientInfo{DeviceID: deviceID}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		info.IP = host
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ua := md.Get("user-agent"); len(ua) > 0 {
+			info.UserAgent = ua[0]
+		}
+	}
+	return info
+}
+
+func (s *UserServer) ListLoginHistory(ctx context.Context, req *userpb.ListLoginHistoryRequest) (*userpb.ListLoginHistoryResponse, error) {
+	id, err := parseID("id", req.GetId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if err := authorizeSelfOrAdmin(ctx, id); err != nil {
+		return nil, toStatus(err)
+	}
+	events, err := s.Service.ListLoginHistory(ctx, id, int(req.GetLimit()), int(req.GetOffset()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &userpb.ListLoginHistoryResponse{}
+	for _, e := range events {
+		resp.Events = append(resp.Events, &userpb.LoginEvent{
+			Id:          e.ID.String(),
+			Ip:          e.IP.String,
+			UserAgent:   e.UserAgent.String,
+			Outcome:     string(e.Outcome),
+			NewDevice:   e.NewDevice,
+			NewLocation: e.NewLocation,
+			CreatedAt:   timestamppb.New(e.CreatedAt),
+		})
+	}
+	return resp, nil
+}
+
+// GetJWKS publishes the public keys access tokens are signed with, for
+// services that verify tokens themselves.
+func (s *UserServer) GetJWKS(ctx context.Context, req *userpb.GetJWKSRequest) (*userpb.GetJWKSResponse, error) {
+	resp := &userpb.GetJWKSResponse{}
+	for _, k := range s.Tokens.JWKS().Keys {
+		resp.Keys = append(resp.Keys, &userpb.JSONWebKey{
+			Kty: k.Kty,
+			Crv: k.Crv,
+			Kid: k.Kid,
+			Use: k.Use,
+			Alg: k.Alg,
+			X:   k.X,
+			Y:   k.Y,
+		})
+	}
+	return resp, nil
+}
+
+func (s *UserServer) ImpersonateUser(ctx context.Context, req *userpb.ImpersonateUserRequest) (*userpb.ImpersonateUserResponse, error) {
+	caller := auth.FromContext(ctx)
+	if caller == nil {
+		return nil, toStatus(ErrUnauthenticated)
+	}
+	if caller.IsImpersonated() {
+		return nil, toStatus(ErrImpersonated)
+	}
+	id, err := parseID("id", req.GetId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	user, err := s.Service.ImpersonateUser(ctx, &ImpersonationInput{UserID: id, Admin: *caller, Reason: req.GetReason()})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	token, expiresAt, err := s.Tokens.Impersonate(user.ID, user.Role, caller.UserID, auth.DefaultImpersonationTTL)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &userpb.ImpersonateUserResponse{
+		Token:     token,
+		ExpiresAt: timestamppb.New(expiresAt),
+		User:      convertUser(*user),
+	}, nil
+}
+
+func (s *UserServer) ListSecurityEvents(ctx context.Context, req *userpb.ListSecurityEventsRequest) (*userpb.ListSecurityEventsResponse, error) {
+	id, err := parseID("id", req.GetId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if err := authorizeSelfOrAdmin(ctx, id); err != nil {
+		return nil, toStatus(err)
+	}
+	events, err := s.Service.ListSecurityEvents(ctx, id, int(req.GetLimit()), int(req.GetOffset()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &userpb.ListSecurityEventsResponse{}
+	for _, e := range events {
+		pb := &userpb.SecurityEvent{
+			Id:        e.ID.String(),
+			Event:     string(e.Event),
+			Method:    e.Method.String,
+			Reason:    e.Reason.String,
+			CreatedAt: timestamppb.New(e.CreatedAt),
+		}
+		if e.ActorID.Valid {
+			pb.ActorId = e.ActorID.UUID.String()
+		}
+		resp.Events = append(resp.Events, pb)
+	}
+	return resp, nil
+}
+
+// AuditInterceptor records every request made with an impersonation token
+// in the impersonated user's security history before it runs. A request
+// that can't be recorded is refused.
+func (s *UserServer) AuditInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if caller := auth.FromContext(ctx); caller.IsImpersonated() {
+			if err := s.Service.RecordImpersonatedAction(ctx, caller, info.FullMethod); err != nil {
+				return nil, toStatus(err)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
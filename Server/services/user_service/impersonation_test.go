@@ -0,0 +1,32 @@
+package userservice
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	userpb "github.com/shatwik7/polycrate/lib/protos/user"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestImpersonatedSessionsCannotChangeCredentials(t *testing.T) {
+	user := uuid.New()
+	ctx := auth.NewContext(context.Background(), &auth.Caller{UserID: user, Role: auth.RoleUser, Actor: uuid.New()})
+	server := &UserServer{}
+
+	_, err := server.ChangePassword(ctx, &userpb.ChangePasswordRequest{Id: user.String(), NewPassword: "new password"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.DeleteUser(ctx, &userpb.DeleteUserRequest{Id: user.String()})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.DeactivateUser(ctx, &userpb.DeactivateUserRequest{Id: user.String()})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.ImpersonateUser(ctx, &userpb.ImpersonateUserRequest{Id: uuid.NewString(), Reason: "chain"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.CreateInvitation(ctx, &userpb.CreateInvitationRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.RevokeInvitation(ctx, &userpb.RevokeInvitationRequest{Id: uuid.NewString()})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
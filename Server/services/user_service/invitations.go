@@ -0,0 +1,93 @@
+package userservice
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RegistrationMode controls who may call CreateUser.
+type RegistrationMode string
+
+const (
+	RegistrationOpen       RegistrationMode = "open"
+	RegistrationInviteOnly RegistrationMode = "invite_only"
+	RegistrationClosed     RegistrationMode = "closed"
+)
+
+const (
+	DefaultInvitationUses = 1
+	MaxInvitationUses     = 1000
+	MaxInviteCodeLength   = 64
+	inviteCodeBytes       = 10
+	inviteCodeGroup       = 4
+)
+
+var (
+	ErrRegistrationClosed  = errors.New("registration is closed")
+	ErrInvitationRequired  = errors.New("an invitation code is required")
+	ErrInvalidInvitation   = errors.New("invitation code is invalid, used up or expired")
+	ErrInvitationNotFound  = errors.New("invitation not found")
+	errUnknownRegistration = errors.New("unknown registration mode")
+)
+
+// ParseRegistrationMode parses the REGISTRATION_MODE setting. An empty
+// string means open registration.
+func ParseRegistrationMode(s string) (RegistrationMode, error) {
+	switch mode := RegistrationMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case "":
+		return RegistrationOpen, nil
+	case RegistrationOpen, RegistrationInviteOnly, RegistrationClosed:
+		return mode, nil
+	}
+	return "", fmt.Errorf("%w %q", errUnknownRegistration, s)
+}
+
+// newInviteCode returns a random code such as "K7QD-2MZX-W4PB-9HNA".
+func newInviteCode() (string, error) {
+	b := make([]byte, inviteCodeBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	raw := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	var groups []string
+	for len(raw) > inviteCodeGroup {
+		groups = append(groups, raw[:inviteCodeGroup])
+		raw = raw[inviteCodeGroup:]
+	}
+	return strings.Join(append(groups, raw), "-"), nil
+}
+
+// hashInviteCode returns the value stored in invitations.code_hash. Case,
+// dashes and spaces are ignored so codes survive being retyped.
+func hashInviteCode(code string) string {
+	normalized := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// redeemableBy reports whether the invitation can still be used to
+// register email at time now.
+func (inv *Invitation) redeemableBy(email string, now time.Time) bool {
+	switch {
+	case inv.RevokedAt.Valid:
+		return false
+	case inv.ExpiresAt.Valid && !inv.ExpiresAt.Time.After(now):
+		return false
+	case inv.Uses >= inv.MaxUses:
+		return false
+	case inv.Email.Valid && !strings.EqualFold(inv.Email.String, email):
+		return false
+	}
+	return true
+}
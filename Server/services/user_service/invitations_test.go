@@ -0,0 +1,59 @@
+package userservice
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRegistrationMode(t *testing.T) {
+	for raw, want := range map[string]RegistrationMode{
+		"":            RegistrationOpen,
+		"open":        RegistrationOpen,
+		"Invite_Only": RegistrationInviteOnly,
+		" closed ":    RegistrationClosed,
+	} {
+		mode, err := ParseRegistrationMode(raw)
+		assert.NoError(t, err, raw)
+		assert.Equal(t, want, mode, raw)
+	}
+	_, err := ParseRegistrationMode("beta")
+	assert.Error(t, err)
+}
+
+func TestInviteCodeHashIgnoresFormatting(t *testing.T) {
+	code, err := newInviteCode()
+	assert.NoError(t, err)
+	assert.Regexp(t, `^[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}$`, code)
+
+	other, _ := newInviteCode()
+	assert.NotEqual(t, code, other)
+
+	assert.Equal(t, hashInviteCode("K7QD-2MZX-W4PB-9HNA"), hashInviteCode("k7qd 2mzx w4pb 9hna"))
+	assert.NotEqual(t, hashInviteCode(code), hashInviteCode(other))
+}
+
+func TestInvitationRedeemable(t *testing.T) {
+	now := time.Now()
+	base := Invitation{MaxUses: 2, Uses: 1}
+	assert.True(t, base.redeemableBy("a@site.com", now))
+
+	used := base
+	used.Uses = 2
+	assert.False(t, used.redeemableBy("a@site.com", now))
+
+	revoked := base
+	revoked.RevokedAt = sql.NullTime{Time: now, Valid: true}
+	assert.False(t, revoked.redeemableBy("a@site.com", now))
+
+	expired := base
+	expired.ExpiresAt = sql.NullTime{Time: now.Add(-time.Minute), Valid: true}
+	assert.False(t, expired.redeemableBy("a@site.com", now))
+
+	locked := base
+	locked.Email = sql.NullString{String: "A@Site.com", Valid: true}
+	assert.True(t, locked.redeemableBy("a@site.com", now))
+	assert.False(t, locked.redeemableBy("b@site.com", now))
+}
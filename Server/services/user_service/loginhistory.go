@@ -0,0 +1,100 @@
+package userservice
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+type LoginOutcome string
+
+const (
+	LoginSuccess         LoginOutcome = "success"
+	LoginInvalidPassword LoginOutcome = "invalid_password"
+	LoginInactive        LoginOutcome = "inactive"
+	LoginSuspended       LoginOutcome = "suspended"
+	LoginBanned          LoginOutcome = "banned"
+)
+
+const MaxDeviceIDLength = 128
+
+// ClientInfo describes where a login request came from.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+	DeviceID  string
+}
+
+// ip returns the client address for storage, or NULL when it isn't a
+// valid IP address.
+func (c ClientInfo) ip() sql.NullString {
+	addr, err := netip.ParseAddr(c.IP)
+	if err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: addr.Unmap().String(), Valid: true}
+}
+
+// deviceHash identifies a device without storing its id.
+func (c ClientInfo) deviceHash() string {
+	sum := sha256.Sum256([]byte(c.UserAgent + "\x00" + c.DeviceID))
+	return hex.EncodeToString(sum[:])
+}
+
+// network returns the /24 or /48 that c.IP belongs to, or "" if the
+// address is unknown.
+func (c ClientInfo) network() string {
+	addr, err := netip.ParseAddr(c.IP)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+// loginOutcome maps the error that ended a login to the outcome recorded
+// for it.
+func loginOutcome(err error) LoginOutcome {
+	switch {
+	case err == nil:
+		return LoginSuccess
+	case errors.Is(err, ErrAccountBanned):
+		return LoginBanned
+	case errors.Is(err, ErrAccountSuspended):
+		return LoginSuspended
+	case errors.Is(err, ErrAccountInactive):
+		return LoginInactive
+	}
+	return LoginInvalidPassword
+}
+
+func newSignInAlert(u User, event *LoginEvent) Notification {
+	what := "a new device"
+	switch {
+	case event.NewDevice && event.NewLocation:
+		what = "a new device and location"
+	case event.NewLocation:
+		what = "a new location"
+	}
+	ip := event.IP.String
+	if ip == "" {
+		ip = "an unknown address"
+	}
+	return Notification{
+		UserID:      u.ID,
+		Destination: u.Email,
+		Subject:     "New sign-in to your Polycrate account",
+		Message: fmt.Sprintf("Your account %s was signed in to from %s (%s, %s) at %s. "+
+			"If this wasn't you, change your password now.",
+			u.Username, what, ip, event.UserAgent.String, event.CreatedAt.UTC().Format(time.RFC1123)),
+	}
+}
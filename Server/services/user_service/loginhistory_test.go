@@ -0,0 +1,30 @@
+package userservice
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientNetwork(t *testing.T) {
+	assert.Equal(t, "203.0.113.0/24", ClientInfo{IP: "203.0.113.77"}.network())
+	assert.Equal(t, "203.0.113.0/24", ClientInfo{IP: "::ffff:203.0.113.77"}.network())
+	assert.Equal(t, "2001:db8:1::/48", ClientInfo{IP: "2001:db8:1:2::5"}.network())
+	assert.Equal(t, "", ClientInfo{IP: "bufconn"}.network())
+	assert.False(t, ClientInfo{IP: "bufconn"}.ip().Valid)
+}
+
+func TestDeviceHash(t *testing.T) {
+	phone := ClientInfo{UserAgent: "app/1.0", DeviceID: "abc"}
+	assert.Equal(t, phone.deviceHash(), ClientInfo{IP: "198.51.100.1", UserAgent: "app/1.0", DeviceID: "abc"}.deviceHash())
+	assert.NotEqual(t, phone.deviceHash(), ClientInfo{UserAgent: "app/1.0", DeviceID: "abd"}.deviceHash())
+}
+
+func TestLoginOutcome(t *testing.T) {
+	assert.Equal(t, LoginSuccess, loginOutcome(nil))
+	assert.Equal(t, LoginSuspended, loginOutcome(fmt.Errorf("%w until tomorrow", ErrAccountSuspended)))
+	assert.Equal(t, LoginBanned, loginOutcome(ErrAccountBanned))
+	assert.Equal(t, LoginInactive, loginOutcome(ErrAccountInactive))
+	assert.Equal(t, LoginInvalidPassword, loginOutcome(ErrInvalidCredentials))
+}
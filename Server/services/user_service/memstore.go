@@ -0,0 +1,1365 @@
+package userservice
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shatwik7/polycrate/lib/events"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
+)
+
+// MemoryStore is a UserStore that keeps everything in memory, for tests
+// and local runs without Postgres. It enforces the length, check, unique
+// and foreign key constraints of the schema, cascades deletes the same way
+// and reports violations as the same *pgconn.PgError, so errors reach
+// callers exactly as they would from UserRepository.
+//
+// MemoryStore is safe for concurrent use. A transaction holds the whole
+// store until it ends, so transactions never conflict. Profile counters
+// are maintained by triggers on asset tables the store doesn't have:
+// GetUserStats always reports zeros and there is no download history.
+type MemoryStore struct {
+	db *memDB
+	// tx is nil outside a transaction.
+	tx *memTx
+}
+
+type memDB struct {
+	mu     sync.Mutex
+	clock  time.Time
+	tables memTables
+}
+
+type memTx struct {
+	// now is when the transaction started, which is the time Postgres'
+	// now() returns for every statement in it.
+	now     time.Time
+	aborted bool
+}
+
+type memUser struct {
+	User
+	SuspendedUntil sql.NullTime
+	BannedAt       sql.NullTime
+}
+
+type memInvitation struct {
+	Invitation
+	CodeHash string
+}
+
+type memInvitationUse struct {
+	InvitationID uuid.UUID
+	UserID       uuid.UUID
+}
+
+type memLoginEvent struct {
+	LoginEvent
+	Network string
+}
+
+type memTables struct {
+	users          map[uuid.UUID]memUser
+	usernames      map[string]uuid.UUID
+	emails         map[string]uuid.UUID
+	credentials    map[uuid.UUID]UserCredential
+	moderation     []ModerationAction
+	invitations    map[uuid.UUID]memInvitation
+	invitationUses []memInvitationUse
+	logins         []memLoginEvent
+	notifications  []Notification
+	securityEvents []SecurityEvent
+	signingKeys    []auth.StoredKey
+	outbox         []events.Event
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{db: &memDB{tables: memTables{
+		users:       make(map[uuid.UUID]memUser),
+		usernames:   make(map[string]uuid.UUID),
+		emails:      make(map[string]uuid.UUID),
+		credentials: make(map[uuid.UUID]UserCredential),
+		invitations: make(map[uuid.UUID]memInvitation),
+	}}}
+}
+
+// clone copies the tables deeply enough that writes to either copy don't
+// show in the other. Rows are values, so copying the maps and slices is
+// enough.
+func (t memTables) clone() memTables {
+	return memTables{
+		users:          maps.Clone(t.users),
+		usernames:      maps.Clone(t.usernames),
+		emails:         maps.Clone(t.emails),
+		credentials:    maps.Clone(t.credentials),
+		moderation:     slices.Clone(t.moderation),
+		invitations:    maps.Clone(t.invitations),
+		invitationUses: slices.Clone(t.invitationUses),
+		logins:         slices.Clone(t.logins),
+		notifications:  slices.Clone(t.notifications),
+		securityEvents: slices.Clone(t.securityEvents),
+		signingKeys:    slices.Clone(t.signingKeys),
+		outbox:         slices.Clone(t.outbox),
+	}
+}
+
+// tick returns a new statement time. Times have the microsecond precision
+// Postgres stores and strictly increase, so rows written by different
+// transactions never tie.
+func (d *memDB) tick() time.Time {
+	now := time.Now().Truncate(time.Microsecond)
+	if !now.After(d.clock) {
+		now = d.clock.Add(time.Microsecond)
+	}
+	d.clock = now
+	return now
+}
+
+// now returns the time a statement sees as now().
+func (m *MemoryStore) now() time.Time {
+	if m.tx != nil {
+		return m.tx.now
+	}
+	return m.db.tick()
+}
+
+// dbTime returns t as it reads back from a timestamptz column.
+func dbTime(t time.Time) time.Time {
+	return t.Truncate(time.Microsecond).Local()
+}
+
+func dbNullTime(t sql.NullTime) sql.NullTime {
+	if !t.Valid {
+		return t
+	}
+	return sql.NullTime{Time: dbTime(t.Time), Valid: true}
+}
+
+// acquire checks that a statement may run and, outside a transaction,
+// locks the store for it. Inside one, WithTx already holds the lock.
+func (m *MemoryStore) acquire(ctx context.Context) (release func(), err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if m.tx == nil {
+		m.db.mu.Lock()
+		return m.db.mu.Unlock, nil
+	}
+	if m.tx.aborted {
+		return nil, errTxAborted()
+	}
+	return func() {}, nil
+}
+
+// fail reports a failed statement. Like in Postgres, it aborts the
+// transaction the statement ran in until that is rolled back.
+func (m *MemoryStore) fail(err *pgconn.PgError) error {
+	if m.tx != nil {
+		m.tx.aborted = true
+	}
+	return err
+}
+
+func errTxAborted() *pgconn.PgError {
+	return &pgconn.PgError{Severity: "ERROR", Code: "25P02",
+		Message: "current transaction is aborted, commands ignored until end of transaction block"}
+}
+
+func uniqueViolation(table, constraint string) *pgconn.PgError {
+	return &pgconn.PgError{Severity: "ERROR", Code: "23505", TableName: table, ConstraintName: constraint,
+		Message: fmt.Sprintf("duplicate key value violates unique constraint %q", constraint)}
+}
+
+func foreignKeyViolation(table, constraint string) *pgconn.PgError {
+	return &pgconn.PgError{Severity: "ERROR", Code: "23503", TableName: table, ConstraintName: constraint,
+		Message: fmt.Sprintf("insert or update on table %q violates foreign key constraint %q", table, constraint)}
+}
+
+func checkViolation(table, constraint string) *pgconn.PgError {
+	return &pgconn.PgError{Severity: "ERROR", Code: "23514", TableName: table, ConstraintName: constraint,
+		Message: fmt.Sprintf("new row for relation %q violates check constraint %q", table, constraint)}
+}
+
+func invalidTextRepresentation(typ, value string) *pgconn.PgError {
+	return &pgconn.PgError{Severity: "ERROR", Code: "22P02",
+		Message: fmt.Sprintf("invalid input syntax for type %s: %q", typ, value)}
+}
+
+// checkLength fails like a VARCHAR(n) column given a longer value.
+func checkLength(value string, n int) *pgconn.PgError {
+	if utf8.RuneCountInString(value) <= n {
+		return nil
+	}
+	return &pgconn.PgError{Severity: "ERROR", Code: "22001",
+		Message: fmt.Sprintf("value too long for type character varying(%d)", n)}
+}
+
+func checkUserLengths(u User) *pgconn.PgError {
+	for _, c := range []struct {
+		value string
+		n     int
+	}{{u.Username, 50}, {u.Email, 255}, {u.FullName, 100}, {u.Location.String, 100}} {
+		if err := checkLength(c.value, c.n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithTx runs fn with the store locked. Everything fn writes is undone if
+// it returns an error, panics or leaves the transaction aborted. Called on
+// a store that is already inside a transaction, fn runs in a savepoint.
+func (m *MemoryStore) WithTx(ctx context.Context, fn func(tx UserStore) error) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.tx != nil {
+		return m.savepoint(fn)
+	}
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+	saved := m.db.tables.clone()
+	defer func() {
+		if p := recover(); p != nil {
+			m.db.tables = saved
+			panic(p)
+		}
+		if err != nil {
+			m.db.tables = saved
+		}
+	}()
+	tx := &MemoryStore{db: m.db, tx: &memTx{now: m.db.tick()}}
+	if err = fn(tx); err != nil {
+		return err
+	}
+	if tx.tx.aborted {
+		return fmt.Errorf("failed to commit transaction: %w", pgx.ErrTxCommitRollback)
+	}
+	return nil
+}
+
+func (m *MemoryStore) savepoint(fn func(tx UserStore) error) (err error) {
+	if m.tx.aborted {
+		return fmt.Errorf("failed to create savepoint: %w", errTxAborted())
+	}
+	saved := m.db.tables.clone()
+	defer func() {
+		if p := recover(); p != nil {
+			m.db.tables, m.tx.aborted = saved, false
+			panic(p)
+		}
+		if err != nil {
+			m.db.tables, m.tx.aborted = saved, false
+		}
+	}()
+	if err = fn(m); err != nil {
+		return err
+	}
+	if m.tx.aborted {
+		return fmt.Errorf("failed to release savepoint: %w", errTxAborted())
+	}
+	return nil
+}
+
+// ------------------- Users -------------------
+
+func compareCreated(aAt time.Time, aID uuid.UUID, bAt time.Time, bID uuid.UUID) int {
+	if c := aAt.Compare(bAt); c != 0 {
+		return c
+	}
+	return bytes.Compare(aID[:], bID[:])
+}
+
+// window applies LIMIT and OFFSET to rows.
+func window[T any](rows []T, limit, offset int) []T {
+	offset = max(offset, 0)
+	if limit <= 0 || offset >= len(rows) {
+		return nil
+	}
+	rows = rows[offset:]
+	if limit < len(rows) {
+		rows = rows[:limit]
+	}
+	return rows
+}
+
+// listUsers returns the users that match in (created_at, id) order.
+func (t *memTables) listUsers(match func(memUser) bool) []User {
+	var users []User
+	for _, u := range t.users {
+		if match(u) {
+			users = append(users, u.User)
+		}
+	}
+	slices.SortFunc(users, func(a, b User) int { return compareCreated(a.CreatedAt, a.ID, b.CreatedAt, b.ID) })
+	return users
+}
+
+func (page Page) admits(u memUser) bool {
+	return page.After == nil || compareCreated(u.CreatedAt, u.ID, page.After.CreatedAt, page.After.ID) > 0
+}
+
+// insertUser adds u, failing on the same constraints as INSERT INTO users.
+func (t *memTables) insertUser(u memUser) *pgconn.PgError {
+	if err := checkUserLengths(u.User); err != nil {
+		return err
+	}
+	if _, ok := t.usernames[u.Username]; ok {
+		return uniqueViolation("users", "users_username_key")
+	}
+	if _, ok := t.emails[u.Email]; ok {
+		return uniqueViolation("users", "users_email_key")
+	}
+	t.users[u.ID] = u
+	t.usernames[u.Username] = u.ID
+	t.emails[u.Email] = u.ID
+	return nil
+}
+
+func (m *MemoryStore) InsertUser(ctx context.Context, input CreateUserInput) (*User, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	now := m.now()
+	u := memUser{User: User{
+		ID:                uuid.New(),
+		Username:          input.Username,
+		Email:             input.Email,
+		FullName:          input.FullName,
+		ProfilePictureUrl: input.ProfilePictureUrl,
+		Bio:               input.Bio,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+		Role:              auth.RoleUser,
+		Version:           1,
+	}}
+	if err := m.db.tables.insertUser(u); err != nil {
+		return nil, mapDBError(m.fail(err))
+	}
+	return &u.User, nil
+}
+
+func (m *MemoryStore) FindUserById(ctx context.Context, id uuid.UUID) (*User, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	u, ok := m.db.tables.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &u.User, nil
+}
+
+func (m *MemoryStore) FindUsersByIds(ctx context.Context, ids []uuid.UUID) ([]User, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var users []User
+	seen := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		if u, ok := m.db.tables.users[id]; ok && !seen[id] {
+			seen[id] = true
+			users = append(users, u.User)
+		}
+	}
+	return users, nil
+}
+
+func (m *MemoryStore) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	id, ok := m.db.tables.emails[email]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	u := m.db.tables.users[id].User
+	return &u, nil
+}
+
+func (m *MemoryStore) UpdateUser(ctx context.Context, input UpdateUserInput) (*User, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	u, ok := m.db.tables.users[input.ID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if input.Version != 0 && input.Version != u.Version {
+		return nil, ErrVersionConflict
+	}
+	u.FullName, u.ProfilePictureUrl, u.Bio = input.FullName, input.ProfilePictureUrl, input.Bio
+	if err := checkUserLengths(u.User); err != nil {
+		return nil, m.fail(err)
+	}
+	u.UpdatedAt = m.now()
+	u.Version++
+	m.db.tables.users[u.ID] = u
+	return &u.User, nil
+}
+
+// DeleteUser removes the user with everything that references them, and
+// clears the references that outlive them, as the schema's ON DELETE
+// clauses do.
+func (m *MemoryStore) DeleteUser(ctx context.Context, id uuid.UUID) (bool, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	t := &m.db.tables
+	u, ok := t.users[id]
+	if !ok {
+		return false, ErrUserNotFound
+	}
+	delete(t.users, id)
+	delete(t.usernames, u.Username)
+	delete(t.emails, u.Email)
+	delete(t.credentials, id)
+	t.moderation = slices.DeleteFunc(t.moderation, func(a ModerationAction) bool { return a.UserID == id })
+	for i := range t.moderation {
+		if t.moderation[i].ModeratorID == id {
+			t.moderation[i].ModeratorID = uuid.Nil
+		}
+	}
+	for invID, inv := range t.invitations {
+		if inv.IssuerID.Valid && inv.IssuerID.UUID == id {
+			inv.IssuerID = uuid.NullUUID{}
+			t.invitations[invID] = inv
+		}
+	}
+	t.invitationUses = slices.DeleteFunc(t.invitationUses, func(use memInvitationUse) bool { return use.UserID == id })
+	t.logins = slices.DeleteFunc(t.logins, func(e memLoginEvent) bool { return e.UserID == id })
+	t.notifications = slices.DeleteFunc(t.notifications, func(n Notification) bool { return n.UserID == id })
+	t.securityEvents = slices.DeleteFunc(t.securityEvents, func(e SecurityEvent) bool { return e.UserID == id })
+	for i := range t.securityEvents {
+		if t.securityEvents[i].ActorID.Valid && t.securityEvents[i].ActorID.UUID == id {
+			t.securityEvents[i].ActorID = uuid.NullUUID{}
+		}
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) ListUsers(ctx context.Context, page Page) ([]User, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return window(m.db.tables.listUsers(page.admits), page.Limit, page.Offset), nil
+}
+
+func (m *MemoryStore) CountUsers(ctx context.Context) (int64, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return int64(len(m.db.tables.users)), nil
+}
+
+// containsFold matches like ILIKE '%' || substr || '%' with substr escaped.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func (m *MemoryStore) FindUsersByUsernamePartial(ctx context.Context, partial string, page Page) ([]User, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	users := m.db.tables.listUsers(func(u memUser) bool {
+		return containsFold(u.Username, partial) && page.admits(u)
+	})
+	return window(users, page.Limit, page.Offset), nil
+}
+
+func (m *MemoryStore) CountUsersByUsernamePartial(ctx context.Context, partial string) (int64, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var count int64
+	for _, u := range m.db.tables.users {
+		if containsFold(u.Username, partial) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Thresholds of the pg_trgm % and <% operators at their default settings.
+const (
+	similarityThreshold     = 0.3
+	wordSimilarityThreshold = 0.6
+)
+
+// SearchUsers scores users with the same pg_trgm formulas as
+// UserRepository.SearchUsers.
+func (m *MemoryStore) SearchUsers(ctx context.Context, query string, prefix bool, limit, offset int) ([]UserSearchResult, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	lowerQuery := strings.ToLower(query)
+	var results []UserSearchResult
+	for _, u := range m.db.tables.users {
+		var score float64
+		if prefix {
+			username, fullName := strings.ToLower(u.Username), strings.ToLower(u.FullName)
+			byUsername := strings.HasPrefix(username, lowerQuery)
+			if !byUsername && !strings.HasPrefix(fullName, lowerQuery) && !strings.Contains(fullName, " "+lowerQuery) {
+				continue
+			}
+			weight := 0.5
+			if byUsername {
+				weight = 1
+			}
+			score = weight * float64(similarity(u.Username+" "+u.FullName, query))
+		} else {
+			username := similarity(u.Username, query)
+			fullName := similarity(u.FullName, query)
+			bio := wordSimilarity(query, u.Bio)
+			if username < similarityThreshold && fullName < similarityThreshold && bio < wordSimilarityThreshold {
+				continue
+			}
+			score = max(float64(username), float64(fullName)*0.8, float64(bio)*0.5)
+		}
+		results = append(results, UserSearchResult{User: u.User, Score: score})
+	}
+	slices.SortFunc(results, func(a, b UserSearchResult) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.User.Username, b.User.Username)
+	})
+	return window(results, limit, offset), nil
+}
+
+// ------------------- Credentials -------------------
+
+func (m *MemoryStore) InsertCredential(ctx context.Context, cred UserCredential) (bool, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	t := &m.db.tables
+	if _, ok := t.credentials[cred.UserID]; ok {
+		return false, mapDBError(m.fail(uniqueViolation("user_credentials", "user_credentials_pkey")))
+	}
+	if _, ok := t.users[cred.UserID]; !ok {
+		return false, m.fail(foreignKeyViolation("user_credentials", "user_credentials_user_id_fkey"))
+	}
+	cred.LastLogin = dbNullTime(cred.LastLogin)
+	t.credentials[cred.UserID] = cred
+	return true, nil
+}
+
+func (m *MemoryStore) GetCredential(ctx context.Context, userID uuid.UUID) (*UserCredential, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	cred, ok := m.db.tables.credentials[userID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &cred, nil
+}
+
+func (m *MemoryStore) UpdateCredential(ctx context.Context, cred UserCredential) (bool, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	if _, ok := m.db.tables.credentials[cred.UserID]; !ok {
+		return false, nil
+	}
+	cred.LastLogin = dbNullTime(cred.LastLogin)
+	m.db.tables.credentials[cred.UserID] = cred
+	return true, nil
+}
+
+func (m *MemoryStore) DeleteCredential(ctx context.Context, userID uuid.UUID) error {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	delete(m.db.tables.credentials, userID)
+	return nil
+}
+
+// ------------------- Moderation -------------------
+
+func (m *MemoryStore) GetAccountStanding(ctx context.Context, id uuid.UUID) (*AccountStanding, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	u, ok := m.db.tables.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &AccountStanding{
+		IsActive:       m.db.tables.credentials[id].IsActive,
+		SuspendedUntil: u.SuspendedUntil,
+		BannedAt:       u.BannedAt,
+	}, nil
+}
+
+func (m *MemoryStore) SetSuspension(ctx context.Context, id uuid.UUID, until time.Time) error {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	u, ok := m.db.tables.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.SuspendedUntil = dbNullTime(sql.NullTime{Time: until, Valid: !until.IsZero()})
+	u.UpdatedAt = m.now()
+	u.Version++
+	m.db.tables.users[id] = u
+	return nil
+}
+
+func (m *MemoryStore) SetBanned(ctx context.Context, id uuid.UUID) error {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	u, ok := m.db.tables.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	now := m.now()
+	if !u.BannedAt.Valid {
+		u.BannedAt = sql.NullTime{Time: now, Valid: true}
+	}
+	u.UpdatedAt = now
+	u.Version++
+	m.db.tables.users[id] = u
+	return nil
+}
+
+func (m *MemoryStore) InsertModerationAction(ctx context.Context, action ModerationAction) (*ModerationAction, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	t := &m.db.tables
+	if action.Action != ModerationSuspend && action.Action != ModerationLift && action.Action != ModerationBan {
+		return nil, m.fail(checkViolation("user_moderation_actions", "user_moderation_actions_action_check"))
+	}
+	if _, ok := t.users[action.UserID]; !ok {
+		return nil, m.fail(foreignKeyViolation("user_moderation_actions", "user_moderation_actions_user_id_fkey"))
+	}
+	if _, ok := t.users[action.ModeratorID]; !ok {
+		return nil, m.fail(foreignKeyViolation("user_moderation_actions", "user_moderation_actions_moderator_id_fkey"))
+	}
+	action.ID = uuid.New()
+	action.ExpiresAt = dbNullTime(action.ExpiresAt)
+	action.CreatedAt = m.now()
+	t.moderation = append(t.moderation, action)
+	return &action, nil
+}
+
+// ------------------- Stats -------------------
+
+func (m *MemoryStore) GetUserStats(ctx context.Context, id uuid.UUID) (*UserStats, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	u, ok := m.db.tables.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &UserStats{UserID: id, JoinedAt: u.CreatedAt}, nil
+}
+
+func (m *MemoryStore) ListMonthlyDownloads(ctx context.Context, id uuid.UUID, since time.Time) ([]MonthlyDownloads, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return nil, nil
+}
+
+// ------------------- Invitations -------------------
+
+// invitation returns inv as read back, with the users who redeemed it in
+// the order they did.
+func (t *memTables) invitation(inv memInvitation) *Invitation {
+	out := inv.Invitation
+	out.InviteeIDs = nil
+	for _, use := range t.invitationUses {
+		if use.InvitationID == inv.ID {
+			out.InviteeIDs = append(out.InviteeIDs, use.UserID)
+		}
+	}
+	return &out
+}
+
+func (m *MemoryStore) InsertInvitation(ctx context.Context, codeHash string, input CreateInvitationInput) (*Invitation, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	t := &m.db.tables
+	if err := checkLength(input.Email, 255); err != nil {
+		return nil, m.fail(err)
+	}
+	if input.MaxUses <= 0 {
+		return nil, m.fail(checkViolation("invitations", "invitations_max_uses_check"))
+	}
+	for _, inv := range t.invitations {
+		if inv.CodeHash == codeHash {
+			return nil, mapDBError(m.fail(uniqueViolation("invitations", "invitations_code_hash_key")))
+		}
+	}
+	if _, ok := t.users[input.Issuer.UserID]; !ok {
+		return nil, m.fail(foreignKeyViolation("invitations", "invitations_issuer_id_fkey"))
+	}
+	inv := memInvitation{CodeHash: codeHash, Invitation: Invitation{
+		ID:        uuid.New(),
+		IssuerID:  uuid.NullUUID{UUID: input.Issuer.UserID, Valid: true},
+		MaxUses:   input.MaxUses,
+		Email:     sql.NullString{String: input.Email, Valid: input.Email != ""},
+		ExpiresAt: dbNullTime(sql.NullTime{Time: input.ExpiresAt, Valid: !input.ExpiresAt.IsZero()}),
+		CreatedAt: m.now(),
+	}}
+	t.invitations[inv.ID] = inv
+	return t.invitation(inv), nil
+}
+
+func (m *MemoryStore) FindInvitationById(ctx context.Context, id uuid.UUID) (*Invitation, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	inv, ok := m.db.tables.invitations[id]
+	if !ok {
+		return nil, ErrInvitationNotFound
+	}
+	return m.db.tables.invitation(inv), nil
+}
+
+// LockInvitationByCode finds an invitation by code hash. The transaction
+// it runs in already holds the whole store.
+func (m *MemoryStore) LockInvitationByCode(ctx context.Context, codeHash string) (*Invitation, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	for _, inv := range m.db.tables.invitations {
+		if inv.CodeHash == codeHash {
+			return m.db.tables.invitation(inv), nil
+		}
+	}
+	return nil, ErrInvitationNotFound
+}
+
+func (m *MemoryStore) ListInvitations(ctx context.Context, issuerID uuid.UUID, limit, offset int) ([]Invitation, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var matched []memInvitation
+	for _, inv := range m.db.tables.invitations {
+		if issuerID == uuid.Nil || (inv.IssuerID.Valid && inv.IssuerID.UUID == issuerID) {
+			matched = append(matched, inv)
+		}
+	}
+	slices.SortFunc(matched, func(a, b memInvitation) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+	var invitations []Invitation
+	for _, inv := range window(matched, limit, offset) {
+		invitations = append(invitations, *m.db.tables.invitation(inv))
+	}
+	return invitations, nil
+}
+
+func (m *MemoryStore) RevokeInvitation(ctx context.Context, id uuid.UUID) (*Invitation, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	inv, ok := m.db.tables.invitations[id]
+	if !ok {
+		return nil, ErrInvitationNotFound
+	}
+	if !inv.RevokedAt.Valid {
+		inv.RevokedAt = sql.NullTime{Time: m.now(), Valid: true}
+		m.db.tables.invitations[id] = inv
+	}
+	return m.db.tables.invitation(inv), nil
+}
+
+// RecordInvitationUse runs the same two statements as the repository, so
+// outside a transaction a use that can't be recorded is still counted.
+func (m *MemoryStore) RecordInvitationUse(ctx context.Context, invitationID, userID uuid.UUID) error {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	t := &m.db.tables
+	if inv, ok := t.invitations[invitationID]; ok {
+		if inv.Uses+1 > inv.MaxUses {
+			return m.fail(checkViolation("invitations", "invitations_check"))
+		}
+		inv.Uses++
+		t.invitations[invitationID] = inv
+	}
+	for _, use := range t.invitationUses {
+		if use.InvitationID == invitationID && use.UserID == userID {
+			return m.fail(uniqueViolation("invitation_uses", "invitation_uses_pkey"))
+		}
+	}
+	for _, use := range t.invitationUses {
+		if use.UserID == userID {
+			return m.fail(uniqueViolation("invitation_uses", "invitation_uses_user_id_key"))
+		}
+	}
+	if _, ok := t.invitations[invitationID]; !ok {
+		return m.fail(foreignKeyViolation("invitation_uses", "invitation_uses_invitation_id_fkey"))
+	}
+	if _, ok := t.users[userID]; !ok {
+		return m.fail(foreignKeyViolation("invitation_uses", "invitation_uses_user_id_fkey"))
+	}
+	t.invitationUses = append(t.invitationUses, memInvitationUse{InvitationID: invitationID, UserID: userID})
+	return nil
+}
+
+// ------------------- Bulk -------------------
+
+func (m *MemoryStore) FindExistingUsers(ctx context.Context, usernames, emails []string) (byUsername, byEmail map[string]uuid.UUID, err error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	byUsername = make(map[string]uuid.UUID)
+	byEmail = make(map[string]uuid.UUID)
+	for _, u := range m.db.tables.users {
+		if slices.Contains(usernames, u.Username) || slices.Contains(emails, u.Email) {
+			byUsername[u.Username] = u.ID
+			byEmail[u.Email] = u.ID
+		}
+	}
+	return byUsername, byEmail, nil
+}
+
+// InsertUserRecords leaves out records whose username or email is taken,
+// including by an earlier record of the same batch, like ON CONFLICT DO
+// NOTHING.
+func (m *MemoryStore) InsertUserRecords(ctx context.Context, records []UserRecord) (int, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	t := &m.db.tables
+	now := m.now()
+	hashes := make(map[string]string, len(records))
+	users := make([]memUser, len(records))
+	for i, r := range records {
+		hashes[r.Email] = r.PasswordHash
+		users[i] = memUser{User: User{
+			ID:        uuid.New(),
+			Username:  r.Username,
+			Email:     r.Email,
+			FullName:  r.FullName,
+			Bio:       r.Bio,
+			Website:   sql.NullString{String: r.Website, Valid: r.Website != ""},
+			Location:  sql.NullString{String: r.Location, Valid: r.Location != ""},
+			CreatedAt: now,
+			UpdatedAt: now,
+			Role:      auth.RoleUser,
+			Version:   1,
+		}}
+		if err := checkUserLengths(users[i].User); err != nil {
+			return 0, m.fail(err)
+		}
+	}
+	inserted := 0
+	for _, u := range users {
+		if t.insertUser(u) != nil {
+			continue
+		}
+		hash := hashes[u.Email]
+		if hash == "" {
+			hash = unusablePasswordHash
+		}
+		t.credentials[u.ID] = UserCredential{UserID: u.ID, PasswordHash: hash, IsActive: true}
+		inserted++
+	}
+	return inserted, nil
+}
+
+func (m *MemoryStore) UpdateUserRecords(ctx context.Context, ids []uuid.UUID, records []UserRecord) error {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	t := &m.db.tables
+	now := m.now()
+	// Work out every row first: the UPDATE either changes all of them or,
+	// when one breaks a constraint, none.
+	ids = ids[:min(len(ids), len(records))]
+	usernames := maps.Clone(t.usernames)
+	var updated []memUser
+	for i, id := range ids {
+		u, ok := t.users[id]
+		if !ok {
+			continue
+		}
+		r := records[i]
+		delete(usernames, u.Username)
+		u.Username, u.FullName, u.Bio = r.Username, r.FullName, r.Bio
+		u.Website = sql.NullString{String: r.Website, Valid: r.Website != ""}
+		u.Location = sql.NullString{String: r.Location, Valid: r.Location != ""}
+		u.UpdatedAt = now
+		u.Version++
+		if err := checkUserLengths(u.User); err != nil {
+			return m.fail(err)
+		}
+		if _, taken := usernames[u.Username]; taken {
+			return mapDBError(m.fail(uniqueViolation("users", "users_username_key")))
+		}
+		usernames[u.Username] = id
+		updated = append(updated, u)
+	}
+	for _, u := range updated {
+		t.users[u.ID] = u
+	}
+	t.usernames = usernames
+
+	for i, id := range ids {
+		if records[i].PasswordHash == "" {
+			continue
+		}
+		if _, ok := t.users[id]; !ok {
+			return m.fail(foreignKeyViolation("user_credentials", "user_credentials_user_id_fkey"))
+		}
+	}
+	for i, id := range ids {
+		if hash := records[i].PasswordHash; hash != "" {
+			cred, ok := t.credentials[id]
+			if !ok {
+				cred = UserCredential{UserID: id, IsActive: true}
+			}
+			cred.PasswordHash = hash
+			t.credentials[id] = cred
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) FindPasswordHashes(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]string, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	hashes := make(map[uuid.UUID]string, len(ids))
+	for _, id := range ids {
+		if cred, ok := m.db.tables.credentials[id]; ok {
+			hashes[id] = cred.PasswordHash
+		}
+	}
+	return hashes, nil
+}
+
+// ------------------- Login history -------------------
+
+var loginOutcomes = []LoginOutcome{LoginSuccess, LoginInvalidPassword, LoginInactive, LoginSuspended, LoginBanned}
+
+// parseCIDR reads network the way a cidr column does: host bits must be
+// zero and the text comes back normalized.
+func parseCIDR(network string) (string, *pgconn.PgError) {
+	if network == "" {
+		return "", nil
+	}
+	prefix, err := netip.ParsePrefix(network)
+	if err != nil || prefix.Masked() != prefix {
+		return "", invalidTextRepresentation("cidr", network)
+	}
+	return prefix.String(), nil
+}
+
+func (m *MemoryStore) KnownLoginSources(ctx context.Context, userID uuid.UUID, deviceHash, network string) (seen, device, location bool, err error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return false, false, false, err
+	}
+	defer release()
+	network, pgErr := parseCIDR(network)
+	if pgErr != nil {
+		return false, false, false, m.fail(pgErr)
+	}
+	for _, e := range m.db.tables.logins {
+		if e.UserID != userID || e.Outcome != LoginSuccess {
+			continue
+		}
+		seen = true
+		device = device || e.DeviceHash == deviceHash
+		location = location || (network != "" && e.Network == network)
+	}
+	return seen, device, location, nil
+}
+
+func (m *MemoryStore) InsertLoginEvent(ctx context.Context, event LoginEvent, network string) (*LoginEvent, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	t := &m.db.tables
+	if event.IP.Valid {
+		addr, err := netip.ParseAddr(event.IP.String)
+		if err != nil {
+			return nil, m.fail(invalidTextRepresentation("inet", event.IP.String))
+		}
+		event.IP.String = addr.String()
+	}
+	network, pgErr := parseCIDR(network)
+	if pgErr != nil {
+		return nil, m.fail(pgErr)
+	}
+	if !slices.Contains(loginOutcomes, event.Outcome) {
+		return nil, m.fail(checkViolation("login_history", "login_history_outcome_check"))
+	}
+	if _, ok := t.users[event.UserID]; !ok {
+		return nil, m.fail(foreignKeyViolation("login_history", "login_history_user_id_fkey"))
+	}
+	event.ID = uuid.New()
+	event.CreatedAt = m.now()
+	t.logins = append(t.logins, memLoginEvent{LoginEvent: event, Network: network})
+	return &event, nil
+}
+
+func (m *MemoryStore) ListLoginHistory(ctx context.Context, userID uuid.UUID, limit, offset int) ([]LoginEvent, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var events []LoginEvent
+	for _, e := range m.db.tables.logins {
+		if e.UserID == userID {
+			events = append(events, e.LoginEvent)
+		}
+	}
+	slices.SortFunc(events, func(a, b LoginEvent) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+	return window(events, limit, offset), nil
+}
+
+func (m *MemoryStore) TouchLastLogin(ctx context.Context, userID uuid.UUID, at time.Time) error {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if cred, ok := m.db.tables.credentials[userID]; ok {
+		cred.LastLogin = sql.NullTime{Time: dbTime(at), Valid: true}
+		m.db.tables.credentials[userID] = cred
+	}
+	return nil
+}
+
+func (m *MemoryStore) EnqueueNotification(ctx context.Context, n Notification) error {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := checkLength(n.Destination, 255); err != nil {
+		return m.fail(err)
+	}
+	if _, ok := m.db.tables.users[n.UserID]; !ok {
+		return m.fail(foreignKeyViolation("notifications", "notifications_user_id_fkey"))
+	}
+	m.db.tables.notifications = append(m.db.tables.notifications, n)
+	return nil
+}
+
+// Notifications returns the notifications queued for userID, oldest
+// first. Postgres keeps them in tables the notification worker reads;
+// here they are only kept for tests to look at.
+func (m *MemoryStore) Notifications(userID uuid.UUID) []Notification {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+	var out []Notification
+	for _, n := range m.db.tables.notifications {
+		if n.UserID == userID {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// ------------------- Outbox -------------------
+
+func (m *MemoryStore) EnqueueEvent(ctx context.Context, topic, key string, payload any) error {
+	if topic == "" {
+		return events.ErrEmptyTopic
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", topic, err)
+	}
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	m.db.tables.outbox = append(m.db.tables.outbox, events.Event{
+		ID:        uuid.New(),
+		Topic:     topic,
+		Key:       key,
+		Payload:   body,
+		CreatedAt: m.now(),
+	})
+	return nil
+}
+
+// Events returns the events enqueued so far, oldest first. Postgres keeps
+// them in the outbox for the relay; here they are only kept for tests to
+// look at.
+func (m *MemoryStore) Events() []events.Event {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+	return slices.Clone(m.db.tables.outbox)
+}
+
+// ------------------- Security events -------------------
+
+func (m *MemoryStore) InsertSecurityEvent(ctx context.Context, event SecurityEvent) error {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	t := &m.db.tables
+	if event.Event != SecurityImpersonationStarted && event.Event != SecurityImpersonatedAction {
+		return m.fail(checkViolation("security_events", "security_events_event_check"))
+	}
+	if _, ok := t.users[event.UserID]; !ok {
+		return m.fail(foreignKeyViolation("security_events", "security_events_user_id_fkey"))
+	}
+	if _, ok := t.users[event.ActorID.UUID]; event.ActorID.Valid && !ok {
+		return m.fail(foreignKeyViolation("security_events", "security_events_actor_id_fkey"))
+	}
+	event.ID = uuid.New()
+	event.CreatedAt = m.now()
+	t.securityEvents = append(t.securityEvents, event)
+	return nil
+}
+
+func (m *MemoryStore) ListSecurityEvents(ctx context.Context, userID uuid.UUID, limit, offset int) ([]SecurityEvent, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var events []SecurityEvent
+	for _, e := range m.db.tables.securityEvents {
+		if e.UserID == userID {
+			events = append(events, e)
+		}
+	}
+	slices.SortFunc(events, func(a, b SecurityEvent) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+	return window(events, limit, offset), nil
+}
+
+// ------------------- Signing keys -------------------
+
+// SigningKeys implements auth.KeyStore.
+func (m *MemoryStore) SigningKeys(ctx context.Context) ([]auth.StoredKey, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	keys := slices.Clone(m.db.tables.signingKeys)
+	slices.SortStableFunc(keys, func(a, b auth.StoredKey) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return keys, nil
+}
+
+// AddSigningKey implements auth.KeyStore. Like the repository's, it runs
+// in a savepoint of its own, so a failure doesn't abort the caller's
+// transaction.
+func (m *MemoryStore) AddSigningKey(ctx context.Context, key auth.StoredKey, staleBefore time.Time) (bool, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	t := &m.db.tables
+	for _, k := range t.signingKeys {
+		if k.RetiredAt.IsZero() && k.CreatedAt.After(staleBefore) {
+			return false, nil
+		}
+	}
+	if err := checkLength(key.Algorithm, 10); err != nil {
+		return false, err
+	}
+	for _, k := range t.signingKeys {
+		if k.ID == key.ID {
+			return false, uniqueViolation("signing_keys", "signing_keys_pkey")
+		}
+	}
+	key.CreatedAt = dbTime(key.CreatedAt)
+	for i, k := range t.signingKeys {
+		if k.RetiredAt.IsZero() {
+			t.signingKeys[i].RetiredAt = key.CreatedAt
+		}
+	}
+	key.RetiredAt = time.Time{}
+	t.signingKeys = append(t.signingKeys, key)
+	return true, nil
+}
+
+// DeleteSigningKeys implements auth.KeyStore.
+func (m *MemoryStore) DeleteSigningKeys(ctx context.Context, retiredBefore time.Time) error {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	m.db.tables.signingKeys = slices.DeleteFunc(m.db.tables.signingKeys, func(k auth.StoredKey) bool {
+		return !k.RetiredAt.IsZero() && k.RetiredAt.Before(retiredBefore)
+	})
+	return nil
+}
+
+// ------------------- Trigrams -------------------
+
+// trigrams extracts trigrams the way pg_trgm does: every run of letters
+// and digits is lowercased, padded with two spaces in front and one
+// behind, and contributes each three-character window, in order.
+func trigrams(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var out []string
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			out = append(out, string(padded[i:i+3]))
+		}
+	}
+	return out
+}
+
+func trigramSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, t := range trigrams(s) {
+		set[t] = true
+	}
+	return set
+}
+
+// similarity is pg_trgm's similarity(a, b): the share of their distinct
+// trigrams the two strings have in common.
+func similarity(a, b string) float32 {
+	setA, setB := trigramSet(a), trigramSet(b)
+	common := 0
+	for t := range setA {
+		if setB[t] {
+			common++
+		}
+	}
+	if common == 0 {
+		return 0
+	}
+	return float32(common) / float32(len(setA)+len(setB)-common)
+}
+
+// wordSimilarity is pg_trgm's word_similarity(a, b): the best similarity
+// between the trigrams of a and any continuous extent of the ordered
+// trigrams of b.
+func wordSimilarity(a, b string) float32 {
+	setA := trigramSet(a)
+	ordered := trigrams(b)
+	var best float32
+	for i := range ordered {
+		if !setA[ordered[i]] {
+			continue
+		}
+		extent := make(map[string]bool)
+		common := 0
+		for _, t := range ordered[i:] {
+			if !extent[t] {
+				extent[t] = true
+				if setA[t] {
+					common++
+				}
+			}
+			best = max(best, float32(common)/float32(len(setA)+len(extent)-common))
+		}
+	}
+	return best
+}
@@ -0,0 +1,87 @@
+package userservice
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// PageCursor is the position of the last row of a page in the
+// (created_at, id) ordering used by every listing query.
+type PageCursor struct {
+	CreatedAt time.Time `json:"c"`
+	ID        uuid.UUID `json:"i"`
+}
+
+// Page describes which slice of an ordered listing to read. After takes
+// precedence over Offset; Offset is only kept for older clients.
+type Page struct {
+	Limit  int
+	Offset int
+	After  *PageCursor
+}
+
+func normalizePageSize(limit int) int {
+	if limit <= 0 {
+		return DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return limit
+}
+
+func encodePageToken(cursor PageCursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageToken(token string) (*PageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	cursor := &PageCursor{}
+	if err := json.Unmarshal(b, cursor); err != nil || cursor.ID == uuid.Nil {
+		return nil, ErrInvalidPageToken
+	}
+	return cursor, nil
+}
+
+// newPage builds the repository page for a request. One extra row is
+// requested so the caller can tell whether a next page exists.
+func newPage(limit, offset int, token string) (Page, int, error) {
+	size := normalizePageSize(limit)
+	page := Page{Limit: size + 1}
+	if token != "" {
+		cursor, err := decodePageToken(token)
+		if err != nil {
+			return Page{}, 0, err
+		}
+		page.After = cursor
+	} else if offset > 0 {
+		page.Offset = offset
+	}
+	return page, size, nil
+}
+
+// trimPage cuts the look-ahead row off users and returns the token for the
+// following page, or "" when this was the last one.
+func trimPage(users []User, size int) ([]User, string) {
+	if len(users) <= size {
+		return users, ""
+	}
+	users = users[:size]
+	last := users[size-1]
+	return users, encodePageToken(PageCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+}
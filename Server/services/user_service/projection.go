@@ -0,0 +1,59 @@
+package userservice
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	userpb "github.com/shatwik7/polycrate/lib/protos/user"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
+)
+
+func convertProfile(u User) *userpb.PublicProfile {
+	return &userpb.PublicProfile{
+		Id:                u.ID.String(),
+		Username:          u.Username,
+		FullName:          u.FullName,
+		ProfilePictureUrl: u.ProfilePictureUrl,
+		Bio:               u.Bio,
+		Website:           u.Website.String,
+		Location:          u.Location.String,
+	}
+}
+
+// canViewPrivate reports whether the caller may see the full User record,
+// including email, for the user with the given ID.
+func canViewPrivate(caller *auth.Caller, id uuid.UUID) bool {
+	return caller.Is(id) || caller.IsAdmin()
+}
+
+// privateUser returns the full projection of u when the caller is allowed
+// to see it, or nil.
+func privateUser(caller *auth.Caller, u User) *userpb.User {
+	if !canViewPrivate(caller, u.ID) {
+		return nil
+	}
+	return convertUser(u)
+}
+
+// authorizeSelfOrAdmin rejects requests that act on an account other than
+// the caller's own, unless the caller is an admin.
+func authorizeSelfOrAdmin(ctx context.Context, id uuid.UUID) error {
+	caller := auth.FromContext(ctx)
+	if caller == nil {
+		return ErrUnauthenticated
+	}
+	if !canViewPrivate(caller, id) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// authorizeCredentialChange is authorizeSelfOrAdmin for requests that
+// change how an account signs in or whether it exists, which impersonated
+// sessions may never make.
+func authorizeCredentialChange(ctx context.Context, id uuid.UUID) error {
+	if auth.FromContext(ctx).IsImpersonated() {
+		return ErrImpersonated
+	}
+	return authorizeSelfOrAdmin(ctx, id)
+}
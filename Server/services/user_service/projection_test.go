@@ -0,0 +1,143 @@
+package userservice
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	userpb "github.com/shatwik7/polycrate/lib/protos/user"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type projectionCaller struct {
+	name   string
+	caller *auth.Caller
+	// private is whether the caller may see the full record.
+	private bool
+}
+
+// projectionCallers are the callers every projection rule is checked
+// against: nobody, the owner of the account, someone else and an admin.
+func projectionCallers(owner uuid.UUID) []projectionCaller {
+	return []projectionCaller{
+		{"anonymous", nil, false},
+		{"self", &auth.Caller{UserID: owner, Role: auth.RoleUser}, true},
+		{"other user", &auth.Caller{UserID: uuid.New(), Role: auth.RoleUser}, false},
+		{"admin", &auth.Caller{UserID: uuid.New(), Role: auth.RoleAdmin}, true},
+	}
+}
+
+func callerContext(caller *auth.Caller) context.Context {
+	if caller == nil {
+		return context.Background()
+	}
+	return auth.NewContext(context.Background(), caller)
+}
+
+func newProjectionServer(t *testing.T) (*UserServer, *User) {
+	t.Helper()
+	service := NewUserServiceWithStore(NewMemoryStore())
+	user, err := service.CreateUser(context.Background(), &CreateUserInput{
+		Username: "owner",
+		Email:    "owner@site.com",
+		FullName: "Owner",
+		Bio:      "Makes chairs",
+		Password: "password",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &UserServer{Service: *service}, user
+}
+
+func TestGetUserProjection(t *testing.T) {
+	server, user := newProjectionServer(t)
+	for _, tc := range projectionCallers(user.ID) {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := server.GetUser(callerContext(tc.caller), &userpb.GetUserRequest{Id: user.ID.String()})
+			assert.NoError(t, err)
+			assert.Equal(t, "owner", resp.GetProfile().GetUsername())
+			assert.Equal(t, "Makes chairs", resp.GetProfile().GetBio())
+			if tc.private {
+				assert.Equal(t, "owner@site.com", resp.GetUser().GetEmail())
+				assert.NotEmpty(t, resp.GetUser().GetEtag())
+			} else {
+				assert.Nil(t, resp.GetUser(), "only the owner and admins see the full record")
+			}
+		})
+	}
+}
+
+func TestListAndBatchGetProjection(t *testing.T) {
+	server, user := newProjectionServer(t)
+	for _, tc := range projectionCallers(user.ID) {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := callerContext(tc.caller)
+
+			list, err := server.ListUsers(ctx, &userpb.ListUsersRequest{Limit: 10})
+			assert.NoError(t, err)
+			assert.Len(t, list.GetProfiles(), 1)
+			batch, err := server.BatchGetUsers(ctx, &userpb.BatchGetUsersRequest{Ids: []string{user.ID.String()}})
+			assert.NoError(t, err)
+			assert.Contains(t, batch.GetProfiles(), user.ID.String())
+
+			if tc.private {
+				if assert.Len(t, list.GetUsers(), 1) {
+					assert.Equal(t, "owner@site.com", list.GetUsers()[0].GetEmail())
+				}
+				assert.Equal(t, "owner@site.com", batch.GetUsers()[user.ID.String()].GetEmail())
+			} else {
+				assert.Empty(t, list.GetUsers())
+				assert.Empty(t, batch.GetUsers())
+			}
+		})
+	}
+}
+
+func TestSearchByEmailProjection(t *testing.T) {
+	server, user := newProjectionServer(t)
+	for _, tc := range projectionCallers(user.ID) {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := callerContext(tc.caller)
+			resp, err := server.SearchByEmail(ctx, &userpb.SearchByEmailRequest{Email: "owner@site.com"})
+			assert.NoError(t, err)
+			assert.True(t, resp.GetExists())
+			// Only admins get the user back, not even its owner.
+			if tc.caller.IsAdmin() {
+				assert.Equal(t, user.ID.String(), resp.GetUser().GetId())
+			} else {
+				assert.Nil(t, resp.GetUser())
+			}
+
+			resp, err = server.SearchByEmail(ctx, &userpb.SearchByEmailRequest{Email: "nobody@site.com"})
+			assert.NoError(t, err)
+			assert.False(t, resp.GetExists())
+			assert.Nil(t, resp.GetUser())
+		})
+	}
+}
+
+func TestUpdateUserAuthorization(t *testing.T) {
+	server, user := newProjectionServer(t)
+	want := map[string]codes.Code{
+		"anonymous":  codes.Unauthenticated,
+		"self":       codes.OK,
+		"other user": codes.PermissionDenied,
+		"admin":      codes.OK,
+	}
+	for _, tc := range projectionCallers(user.ID) {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := server.UpdateUser(callerContext(tc.caller), &userpb.UpdateUserRequest{
+				Id:       user.ID.String(),
+				FullName: "Renamed by " + tc.name,
+			})
+			assert.Equal(t, want[tc.name], status.Code(err))
+			if err == nil {
+				assert.Equal(t, "Renamed by "+tc.name, resp.GetUser().GetFullName())
+			}
+		})
+	}
+}
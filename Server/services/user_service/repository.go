@@ -1,37 +1,86 @@
 package userservice
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/shatwik7/polycrate/lib/db"
+	"github.com/shatwik7/polycrate/lib/events"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
 )
 
+// DefaultQueryTimeout bounds each repository call whose context has no
+// earlier deadline, so a stuck query can't hold a connection forever.
+const DefaultQueryTimeout = 5 * time.Second
+
 type UserRepository struct {
-	database *db.DB
+	q db.Querier
+	// QueryTimeout is applied to every call; zero disables it.
+	QueryTimeout time.Duration
+}
+
+// NewUserRepository returns a repository that runs its queries on q,
+// either a *db.DB or a *db.Tx.
+func NewUserRepository(q db.Querier) *UserRepository {
+	return &UserRepository{q: q, QueryTimeout: DefaultQueryTimeout}
+}
+
+// withTimeout derives the context a single call runs its queries with.
+func (repo *UserRepository) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if repo.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, repo.QueryTimeout)
+}
+
+// WithTx runs fn against a repository bound to a transaction, with the
+// commit, rollback and retry behaviour of db.DB.WithTx. Called on a
+// repository that is already inside a transaction, fn runs in a savepoint:
+// if it fails, only its own writes are undone. fn may run more than once.
+func (repo *UserRepository) WithTx(ctx context.Context, fn func(tx UserStore) error) error {
+	return repo.withTx(ctx, func(txRepo *UserRepository) error { return fn(txRepo) })
 }
 
-func NewUserRepository(db *db.DB) *UserRepository {
-	return &UserRepository{database: db}
+func (repo *UserRepository) withTx(ctx context.Context, fn func(txRepo *UserRepository) error) error {
+	return repo.q.WithTx(ctx, nil, func(tx *db.Tx) error {
+		return fn(&UserRepository{q: tx, QueryTimeout: repo.QueryTimeout})
+	})
 }
 
-func (repo *UserRepository) InsertUser(input CreateUserInput) (*User, error) {
+const userColumns = `id, username, email, full_name, profile_picture_url, bio, website, location, created_at, updated_at, role, version`
+
+// userFields returns scan destinations matching userColumns.
+func userFields(u *User) []interface{} {
+	return []interface{}{&u.ID, &u.Username, &u.Email, &u.FullName, &u.ProfilePictureUrl, &u.Bio, &u.Website, &u.Location, &u.CreatedAt, &u.UpdatedAt, &u.Role, &u.Version}
+}
+
+func (repo *UserRepository) InsertUser(ctx context.Context, input CreateUserInput) (*User, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
 	query := `INSERT INTO users (username, email, full_name, profile_picture_url, bio, created_at, updated_at)
 	          VALUES ($1, $2, $3, $4, $5, now(), now())
-	          RETURNING id, username, email, full_name, profile_picture_url, bio, website, location, created_at, updated_at`
+	          RETURNING ` + userColumns
 	user := &User{}
-	err := repo.database.QueryRow(query, input.Username, input.Email, input.FullName, input.ProfilePictureUrl, input.Bio).
-		Scan(&user.ID, &user.Username, &user.Email, &user.FullName, &user.ProfilePictureUrl, &user.Bio, &user.Website, &user.Location, &user.CreatedAt, &user.UpdatedAt)
-	return user, err
+	err := repo.q.QueryRowContext(ctx, query, input.Username, input.Email, input.FullName, input.ProfilePictureUrl, input.Bio).
+		Scan(userFields(user)...)
+	if err != nil {
+		return nil, mapDBError(err)
+	}
+	return user, nil
 }
 
-func (repo *UserRepository) FindUserById(id uuid.UUID) (*User, error) {
-	query := `SELECT id, username, email, full_name, profile_picture_url, bio, website, location, created_at, updated_at FROM users WHERE id = $1`
+func (repo *UserRepository) FindUserById(ctx context.Context, id uuid.UUID) (*User, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
 	user := &User{}
-	err := repo.database.QueryRow(query, id).Scan(&user.ID, &user.Username, &user.Email, &user.FullName, &user.ProfilePictureUrl, &user.Bio, &user.Website, &user.Location, &user.CreatedAt, &user.UpdatedAt)
+	err := repo.q.QueryRowContext(ctx, query, id).Scan(userFields(user)...)
 	if err == sql.ErrNoRows {
-		return nil, nil
+		return nil, ErrUserNotFound
 	}
 	if err != nil {
 		return nil, err
@@ -39,113 +88,771 @@ func (repo *UserRepository) FindUserById(id uuid.UUID) (*User, error) {
 	return user, err
 }
 
-func (repo *UserRepository) UpdateUser(input UpdateUserInput) (*User, error) {
-	query := `UPDATE users SET full_name = $1, profile_picture_url = $2, bio = $3, updated_at = now()
-	          WHERE id = $4
-	          RETURNING id, username, email, full_name, profile_picture_url, bio, website, location, created_at, updated_at`
+func (repo *UserRepository) FindUsersByIds(ctx context.Context, ids []uuid.UUID) ([]User, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ANY($1::uuid[])`
+	rows, err := repo.q.QueryContext(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+// UpdateUser applies input in a single statement. With a version set, the
+// WHERE clause only matches the row at that version, so a concurrent update
+// can't land between the check and the write.
+func (repo *UserRepository) UpdateUser(ctx context.Context, input UpdateUserInput) (*User, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `UPDATE users SET full_name = $1, profile_picture_url = $2, bio = $3, updated_at = now(), version = version + 1
+	          WHERE id = $4`
+	args := []interface{}{input.FullName, input.ProfilePictureUrl, input.Bio, input.ID}
+	if input.Version != 0 {
+		query += ` AND version = $5`
+		args = append(args, input.Version)
+	}
+	query += ` RETURNING ` + userColumns
 	user := &User{}
-	err := repo.database.QueryRow(
-		query,
-		input.FullName,
-		input.ProfilePictureUrl,
-		input.Bio, input.ID).
-		Scan(
-			&user.ID,
-			&user.Username,
-			&user.Email,
-			&user.FullName,
-			&user.ProfilePictureUrl,
-			&user.Bio,
-			&user.Website,
-			&user.Location,
-			&user.CreatedAt,
-			&user.UpdatedAt)
+	err := repo.q.QueryRowContext(ctx, query, args...).Scan(userFields(user)...)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, errors.New("user not found")
+			return nil, repo.updateMissed(ctx, input.ID, input.Version)
 		}
 		return nil, err
 	}
 	return user, err
 }
 
-func (repo *UserRepository) DeleteUser(id uuid.UUID) (bool, error) {
-	res, err := repo.database.Exec(`DELETE FROM users WHERE id = $1`, id)
+// updateMissed explains why a conditional update matched no row: either
+// the user is gone or it is no longer at the expected version.
+func (repo *UserRepository) updateMissed(ctx context.Context, id uuid.UUID, version int64) error {
+	if version == 0 {
+		return ErrUserNotFound
+	}
+	var exists bool
+	err := repo.q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	return ErrVersionConflict
+}
+
+func (repo *UserRepository) DeleteUser(ctx context.Context, id uuid.UUID) (bool, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	res, err := repo.q.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
 	if err != nil {
 		return false, err
 	}
-	affected, _ := res.RowsAffected()
-	if affected == 0 {
-		return false, errors.New("no user deleted")
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return false, ErrUserNotFound
 	}
-	count, err := res.RowsAffected()
-	return count > 0, err
+	return true, nil
+}
+
+func (repo *UserRepository) DeleteCredential(ctx context.Context, userID uuid.UUID) error {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	_, err := repo.q.ExecContext(ctx, `DELETE FROM user_credentials WHERE user_id = $1`, userID)
+	return err
 }
 
-func (repo *UserRepository) ListUsers(limit, offset int) ([]User, error) {
-	query := `SELECT id, username, email, full_name, profile_picture_url, bio, website, location, created_at, updated_at FROM users LIMIT $1 OFFSET $2`
-	rows, err := repo.database.Query(query, limit, offset)
+func (repo *UserRepository) ListUsers(ctx context.Context, page Page) ([]User, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT ` + userColumns + ` FROM users`
+	var args []interface{}
+	if page.After != nil {
+		query += ` WHERE (created_at, id) > ($1, $2)`
+		args = append(args, page.After.CreatedAt, page.After.ID)
+	}
+	query += fmt.Sprintf(` ORDER BY created_at, id LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+	args = append(args, page.Limit, page.Offset)
+	rows, err := repo.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+func (repo *UserRepository) CountUsers(ctx context.Context) (int64, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	var count int64
+	err := repo.q.QueryRowContext(ctx, `SELECT count(*) FROM users`).Scan(&count)
+	return count, err
+}
+
+func (repo *UserRepository) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = $1`
+	user := &User{}
+	err := repo.q.QueryRowContext(ctx, query, email).Scan(userFields(user)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (repo *UserRepository) FindUsersByUsernamePartial(ctx context.Context, partial string, page Page) ([]User, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT ` + userColumns + `
+			  FROM users WHERE username ILIKE $1 ESCAPE '\'`
+	args := []interface{}{"%" + escapeLike(partial) + "%"}
+	if page.After != nil {
+		query += ` AND (created_at, id) > ($2, $3)`
+		args = append(args, page.After.CreatedAt, page.After.ID)
+	}
+	query += fmt.Sprintf(` ORDER BY created_at, id LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+	args = append(args, page.Limit, page.Offset)
+	rows, err := repo.q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	return scanUsers(rows)
+}
+
+func (repo *UserRepository) CountUsersByUsernamePartial(ctx context.Context, partial string) (int64, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	var count int64
+	err := repo.q.QueryRowContext(ctx, `SELECT count(*) FROM users WHERE username ILIKE $1 ESCAPE '\'`, "%"+escapeLike(partial)+"%").Scan(&count)
+	return count, err
+}
+
+// SearchUsers ranks users by trigram similarity of query against username,
+// full_name and bio. In prefix mode only username and full_name words that
+// start with query match, which is what autocomplete needs.
+func (repo *UserRepository) SearchUsers(ctx context.Context, query string, prefix bool, limit, offset int) ([]UserSearchResult, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	fuzzy := `SELECT ` + userColumns + `,
+			  GREATEST(similarity(username, $1), similarity(coalesce(full_name, ''), $1) * 0.8, word_similarity($1, coalesce(bio, '')) * 0.5) AS score
+			  FROM users
+			  WHERE username % $1 OR full_name % $1 OR $1 <% bio
+			  ORDER BY score DESC, username
+			  LIMIT $2 OFFSET $3`
+	autocomplete := `SELECT ` + userColumns + `,
+			  CASE WHEN username ILIKE $2 ESCAPE '\' THEN 1 ELSE 0.5 END * similarity(username || ' ' || coalesce(full_name, ''), $1) AS score
+			  FROM users
+			  WHERE username ILIKE $2 ESCAPE '\' OR full_name ILIKE $2 ESCAPE '\' OR full_name ILIKE ('% ' || $2) ESCAPE '\'
+			  ORDER BY score DESC, username
+			  LIMIT $3 OFFSET $4`
 
+	var rows *sql.Rows
+	var err error
+	if prefix {
+		rows, err = repo.q.QueryContext(ctx, autocomplete, query, escapeLike(query)+"%", limit, offset)
+	} else {
+		rows, err = repo.q.QueryContext(ctx, fuzzy, query, limit, offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []UserSearchResult
+	for rows.Next() {
+		var r UserSearchResult
+		err := rows.Scan(append(userFields(&r.User), &r.Score)...)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+func scanUsers(rows *sql.Rows) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.FullName, &user.ProfilePictureUrl, &user.Bio, &user.Website, &user.Location, &user.CreatedAt, &user.UpdatedAt)
+		err := rows.Scan(userFields(&user)...)
 		if err != nil {
 			return nil, err
 		}
 		users = append(users, user)
 	}
-	return users, nil
+	return users, rows.Err()
 }
 
-func (repo *UserRepository) FindUserByEmail(email string) (*User, error) {
-	query := `SELECT id, username, email, full_name, profile_picture_url, bio, website, location, created_at, updated_at FROM users WHERE email = $1`
-	user := &User{}
-	err := repo.database.QueryRow(query, email).Scan(&user.ID, &user.Username, &user.Email, &user.FullName, &user.ProfilePictureUrl, &user.Bio, &user.Website, &user.Location, &user.CreatedAt, &user.UpdatedAt)
-	return user, err
+func (repo *UserRepository) GetAccountStanding(ctx context.Context, id uuid.UUID) (*AccountStanding, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT coalesce(c.is_active, false), u.suspended_until, u.banned_at
+	          FROM users u LEFT JOIN user_credentials c ON c.user_id = u.id
+	          WHERE u.id = $1`
+	standing := &AccountStanding{}
+	err := repo.q.QueryRowContext(ctx, query, id).Scan(&standing.IsActive, &standing.SuspendedUntil, &standing.BannedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return standing, nil
+}
+
+// SetSuspension sets or, with a zero until, clears a user's suspension.
+func (repo *UserRepository) SetSuspension(ctx context.Context, id uuid.UUID, until time.Time) error {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	res, err := repo.q.ExecContext(ctx, `UPDATE users SET suspended_until = $1, updated_at = now(), version = version + 1 WHERE id = $2`,
+		sql.NullTime{Time: until, Valid: !until.IsZero()}, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (repo *UserRepository) SetBanned(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	res, err := repo.q.ExecContext(ctx, `UPDATE users SET banned_at = coalesce(banned_at, now()), updated_at = now(), version = version + 1 WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (repo *UserRepository) InsertModerationAction(ctx context.Context, action ModerationAction) (*ModerationAction, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `INSERT INTO user_moderation_actions (user_id, moderator_id, action, reason, notes, expires_at)
+	          VALUES ($1, $2, $3, $4, $5, $6)
+	          RETURNING id, user_id, moderator_id, action, reason, notes, expires_at, created_at`
+	out := &ModerationAction{}
+	err := repo.q.QueryRowContext(ctx, query, action.UserID, action.ModeratorID, action.Action, action.Reason, action.Notes, action.ExpiresAt).
+		Scan(&out.ID, &out.UserID, &out.ModeratorID, &out.Action, &out.Reason, &out.Notes, &out.ExpiresAt, &out.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetUserStats reads the counters kept up to date by the user_stats
+// triggers. Users with no activity yet have no row and get zeros.
+func (repo *UserRepository) GetUserStats(ctx context.Context, id uuid.UUID) (*UserStats, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT u.id, coalesce(s.public_assets, 0), coalesce(s.total_downloads, 0),
+	                 coalesce(s.total_likes, 0), coalesce(s.followers, 0), u.created_at
+	          FROM users u LEFT JOIN user_stats s ON s.user_id = u.id
+	          WHERE u.id = $1`
+	stats := &UserStats{}
+	err := repo.q.QueryRowContext(ctx, query, id).
+		Scan(&stats.UserID, &stats.PublicAssets, &stats.TotalDownloads, &stats.TotalLikes, &stats.Followers, &stats.JoinedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
 }
 
-func (repo *UserRepository) FindUsersByUsernamePartial(partial string, limit, offset int) ([]User, error) {
-	query := `SELECT id, username, email, full_name, profile_picture_url, bio, website, location, created_at, updated_at 
-			  FROM users WHERE username ILIKE $1 LIMIT $2 OFFSET $3`
-	rows, err := repo.database.Query(query, "%"+partial+"%", limit, offset)
+func (repo *UserRepository) ListMonthlyDownloads(ctx context.Context, id uuid.UUID, since time.Time) ([]MonthlyDownloads, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT month, downloads FROM user_download_stats_monthly
+	          WHERE user_id = $1 AND month >= $2
+	          ORDER BY month`
+	rows, err := repo.q.QueryContext(ctx, query, id, since)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var users []User
+	var months []MonthlyDownloads
 	for rows.Next() {
-		var user User
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.FullName, &user.ProfilePictureUrl, &user.Bio, &user.Website, &user.Location, &user.CreatedAt, &user.UpdatedAt)
+		var m MonthlyDownloads
+		if err := rows.Scan(&m.Month, &m.Downloads); err != nil {
+			return nil, err
+		}
+		months = append(months, m)
+	}
+	return months, rows.Err()
+}
+
+const invitationColumns = `i.id, i.issuer_id, i.max_uses, i.uses, i.email, i.expires_at, i.revoked_at, i.created_at,
+	ARRAY(SELECT u.user_id::text FROM invitation_uses u WHERE u.invitation_id = i.id ORDER BY u.used_at)`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInvitation(row rowScanner) (*Invitation, error) {
+	inv := &Invitation{}
+	var invitees []string
+	err := row.Scan(&inv.ID, &inv.IssuerID, &inv.MaxUses, &inv.Uses, &inv.Email, &inv.ExpiresAt, &inv.RevokedAt, &inv.CreatedAt, db.Array(&invitees))
+	if err != nil {
+		return nil, err
+	}
+	for _, raw := range invitees {
+		id, err := uuid.Parse(raw)
 		if err != nil {
 			return nil, err
 		}
-		users = append(users, user)
+		inv.InviteeIDs = append(inv.InviteeIDs, id)
+	}
+	return inv, nil
+}
+
+func (repo *UserRepository) InsertInvitation(ctx context.Context, codeHash string, input CreateInvitationInput) (*Invitation, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `INSERT INTO invitations AS i (code_hash, issuer_id, max_uses, email, expires_at)
+	          VALUES ($1, $2, $3, $4, $5)
+	          RETURNING ` + invitationColumns
+	inv, err := scanInvitation(repo.q.QueryRowContext(ctx, query, codeHash, input.Issuer.UserID, input.MaxUses,
+		sql.NullString{String: input.Email, Valid: input.Email != ""},
+		sql.NullTime{Time: input.ExpiresAt, Valid: !input.ExpiresAt.IsZero()}))
+	if err != nil {
+		return nil, mapDBError(err)
+	}
+	return inv, nil
+}
+
+func (repo *UserRepository) FindInvitationById(ctx context.Context, id uuid.UUID) (*Invitation, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	inv, err := scanInvitation(repo.q.QueryRowContext(ctx, `SELECT `+invitationColumns+` FROM invitations i WHERE i.id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvitationNotFound
+	}
+	return inv, err
+}
+
+// LockInvitationByCode finds an invitation by code hash and locks its row
+// until the transaction ends, so concurrent registrations can't both take
+// its last use.
+func (repo *UserRepository) LockInvitationByCode(ctx context.Context, codeHash string) (*Invitation, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT ` + invitationColumns + ` FROM invitations i WHERE i.code_hash = $1 FOR UPDATE`
+	inv, err := scanInvitation(repo.q.QueryRowContext(ctx, query, codeHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvitationNotFound
+	}
+	return inv, err
+}
+
+// ListInvitations lists the invitations issued by issuerID, newest first,
+// or everyone's when issuerID is uuid.Nil.
+func (repo *UserRepository) ListInvitations(ctx context.Context, issuerID uuid.UUID, limit, offset int) ([]Invitation, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT ` + invitationColumns + ` FROM invitations i`
+	var args []interface{}
+	if issuerID != uuid.Nil {
+		query += ` WHERE i.issuer_id = $1`
+		args = append(args, issuerID)
+	}
+	query += fmt.Sprintf(` ORDER BY i.created_at DESC, i.id LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+	args = append(args, limit, offset)
+	rows, err := repo.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []Invitation
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, *inv)
 	}
-	return users, nil
+	return invitations, rows.Err()
+}
+
+func (repo *UserRepository) RevokeInvitation(ctx context.Context, id uuid.UUID) (*Invitation, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `UPDATE invitations i SET revoked_at = coalesce(i.revoked_at, now())
+	          WHERE i.id = $1
+	          RETURNING ` + invitationColumns
+	inv, err := scanInvitation(repo.q.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvitationNotFound
+	}
+	return inv, err
+}
+
+// RecordInvitationUse counts one use of the invitation and remembers which
+// user it registered.
+func (repo *UserRepository) RecordInvitationUse(ctx context.Context, invitationID, userID uuid.UUID) error {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	if _, err := repo.q.ExecContext(ctx, `UPDATE invitations SET uses = uses + 1 WHERE id = $1`, invitationID); err != nil {
+		return err
+	}
+	_, err := repo.q.ExecContext(ctx, `INSERT INTO invitation_uses (invitation_id, user_id) VALUES ($1, $2)`, invitationID, userID)
+	return err
+}
+
+// FindExistingUsers returns the ids of users that already hold any of the
+// given usernames or emails.
+func (repo *UserRepository) FindExistingUsers(ctx context.Context, usernames, emails []string) (byUsername, byEmail map[string]uuid.UUID, err error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	rows, err := repo.q.QueryContext(ctx, `SELECT id, username, email FROM users WHERE username = ANY($1) OR email = ANY($2)`,
+		usernames, emails)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	byUsername = make(map[string]uuid.UUID)
+	byEmail = make(map[string]uuid.UUID)
+	for rows.Next() {
+		var id uuid.UUID
+		var username, email string
+		if err := rows.Scan(&id, &username, &email); err != nil {
+			return nil, nil, err
+		}
+		byUsername[username] = id
+		byEmail[email] = id
+	}
+	return byUsername, byEmail, rows.Err()
+}
+
+// InsertUserRecords inserts users and their credentials with one statement
+// each. Records that hit a unique constraint are left out; the number of
+// users actually inserted is returned.
+func (repo *UserRepository) InsertUserRecords(ctx context.Context, records []UserRecord) (int, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	cols := make([][]string, 6)
+	hashes := make(map[string]string, len(records))
+	for _, r := range records {
+		for i, v := range []string{r.Username, r.Email, r.FullName, r.Bio, r.Website, r.Location} {
+			cols[i] = append(cols[i], v)
+		}
+		hashes[r.Email] = r.PasswordHash
+	}
+	query := `INSERT INTO users (username, email, full_name, bio, website, location, created_at, updated_at)
+	          SELECT username, email, full_name, bio, nullif(website, ''), nullif(location, ''), now(), now()
+	          FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[])
+	               AS t(username, email, full_name, bio, website, location)
+	          ON CONFLICT DO NOTHING
+	          RETURNING id, email`
+	rows, err := repo.q.QueryContext(ctx, query, cols[0], cols[1], cols[2], cols[3], cols[4], cols[5])
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	var passwordHashes []string
+	for rows.Next() {
+		var id uuid.UUID
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			return 0, err
+		}
+		hash := hashes[email]
+		if hash == "" {
+			hash = unusablePasswordHash
+		}
+		ids = append(ids, id)
+		passwordHashes = append(passwordHashes, hash)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	_, err = repo.q.ExecContext(ctx, `INSERT INTO user_credentials (user_id, password_hash, is_active)
+	          SELECT user_id, password_hash, true FROM unnest($1::uuid[], $2::text[]) AS t(user_id, password_hash)`,
+		ids, passwordHashes)
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// UpdateUserRecords overwrites the profiles of the users with the given
+// ids, and their password hashes where the record has one.
+func (repo *UserRepository) UpdateUserRecords(ctx context.Context, ids []uuid.UUID, records []UserRecord) error {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	cols := make([][]string, 6)
+	for _, r := range records {
+		for j, v := range []string{r.Username, r.FullName, r.Bio, r.Website, r.Location, r.PasswordHash} {
+			cols[j] = append(cols[j], v)
+		}
+	}
+	query := `UPDATE users u
+	          SET username = t.username, full_name = t.full_name, bio = t.bio,
+	              website = nullif(t.website, ''), location = nullif(t.location, ''), updated_at = now(),
+	              version = u.version + 1
+	          FROM unnest($1::uuid[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[])
+	               AS t(id, username, full_name, bio, website, location)
+	          WHERE u.id = t.id`
+	_, err := repo.q.ExecContext(ctx, query, ids, cols[0], cols[1], cols[2], cols[3], cols[4])
+	if err != nil {
+		return mapDBError(err)
+	}
+	_, err = repo.q.ExecContext(ctx, `INSERT INTO user_credentials (user_id, password_hash, is_active)
+	          SELECT user_id, password_hash, true FROM unnest($1::uuid[], $2::text[]) AS t(user_id, password_hash)
+	          WHERE password_hash <> ''
+	          ON CONFLICT (user_id) DO UPDATE SET password_hash = EXCLUDED.password_hash`,
+		ids, cols[5])
+	return err
+}
+
+func (repo *UserRepository) FindPasswordHashes(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]string, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	rows, err := repo.q.QueryContext(ctx, `SELECT user_id, password_hash FROM user_credentials WHERE user_id = ANY($1::uuid[])`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[uuid.UUID]string, len(ids))
+	for rows.Next() {
+		var id uuid.UUID
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		hashes[id] = hash
+	}
+	return hashes, rows.Err()
+}
+
+const loginEventColumns = `id, user_id, host(ip), user_agent, device_hash, outcome, new_device, new_location, created_at`
+
+func loginEventFields(e *LoginEvent) []interface{} {
+	return []interface{}{&e.ID, &e.UserID, &e.IP, &e.UserAgent, &e.DeviceHash, &e.Outcome, &e.NewDevice, &e.NewLocation, &e.CreatedAt}
+}
+
+// KnownLoginSources reports whether the user has signed in successfully
+// before at all, and from the given device and network in particular.
+func (repo *UserRepository) KnownLoginSources(ctx context.Context, userID uuid.UUID, deviceHash, network string) (seen, device, location bool, err error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT count(*) > 0,
+	                 coalesce(bool_or(device_hash = $2), false),
+	                 coalesce(bool_or(network = $3::cidr), false)
+	          FROM login_history WHERE user_id = $1 AND outcome = 'success'`
+	err = repo.q.QueryRowContext(ctx, query, userID, deviceHash, sql.NullString{String: network, Valid: network != ""}).
+		Scan(&seen, &device, &location)
+	return seen, device, location, err
 }
 
-func (repo *UserRepository) InsertCredential(cred UserCredential) (bool, error) {
+func (repo *UserRepository) InsertLoginEvent(ctx context.Context, event LoginEvent, network string) (*LoginEvent, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `INSERT INTO login_history (user_id, ip, network, user_agent, device_hash, outcome, new_device, new_location)
+	          VALUES ($1, $2::inet, $3::cidr, $4, $5, $6, $7, $8)
+	          RETURNING ` + loginEventColumns
+	out := &LoginEvent{}
+	err := repo.q.QueryRowContext(ctx, query, event.UserID, event.IP, sql.NullString{String: network, Valid: network != ""},
+		event.UserAgent, event.DeviceHash, event.Outcome, event.NewDevice, event.NewLocation).
+		Scan(loginEventFields(out)...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (repo *UserRepository) ListLoginHistory(ctx context.Context, userID uuid.UUID, limit, offset int) ([]LoginEvent, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT ` + loginEventColumns + ` FROM login_history
+	          WHERE user_id = $1
+	          ORDER BY created_at DESC, id
+	          LIMIT $2 OFFSET $3`
+	rows, err := repo.q.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []LoginEvent
+	for rows.Next() {
+		var e LoginEvent
+		if err := rows.Scan(loginEventFields(&e)...); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (repo *UserRepository) TouchLastLogin(ctx context.Context, userID uuid.UUID, at time.Time) error {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	_, err := repo.q.ExecContext(ctx, `UPDATE user_credentials SET last_login = $1 WHERE user_id = $2`, at, userID)
+	return err
+}
+
+// EnqueueNotification stores an email notification and puts it on the
+// queue the notification worker reads.
+func (repo *UserRepository) EnqueueNotification(ctx context.Context, n Notification) error {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	var id uuid.UUID
+	err := repo.q.QueryRowContext(ctx, `INSERT INTO notifications (user_id, type, destination, subject, message, status)
+	          VALUES ($1, 'email', $2, $3, $4, 'queued')
+	          RETURNING id`, n.UserID, n.Destination, n.Subject, n.Message).Scan(&id)
+	if err != nil {
+		return err
+	}
+	_, err = repo.q.ExecContext(ctx, `INSERT INTO notification_queue (notification_id) VALUES ($1)`, id)
+	return err
+}
+
+func (repo *UserRepository) EnqueueEvent(ctx context.Context, topic, key string, payload any) error {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	_, err := events.Enqueue(ctx, repo.q, topic, key, payload)
+	return err
+}
+
+const securityEventColumns = `id, user_id, actor_id, event, method, reason, created_at`
+
+func (repo *UserRepository) InsertSecurityEvent(ctx context.Context, event SecurityEvent) error {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	_, err := repo.q.ExecContext(ctx, `INSERT INTO security_events (user_id, actor_id, event, method, reason) VALUES ($1, $2, $3, $4, $5)`,
+		event.UserID, event.ActorID, event.Event, event.Method, event.Reason)
+	return err
+}
+
+func (repo *UserRepository) ListSecurityEvents(ctx context.Context, userID uuid.UUID, limit, offset int) ([]SecurityEvent, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	query := `SELECT ` + securityEventColumns + ` FROM security_events
+	          WHERE user_id = $1
+	          ORDER BY created_at DESC, id
+	          LIMIT $2 OFFSET $3`
+	rows, err := repo.q.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []SecurityEvent
+	for rows.Next() {
+		var e SecurityEvent
+		if err := rows.Scan(&e.ID, &e.UserID, &e.ActorID, &e.Event, &e.Method, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// SigningKeys implements auth.KeyStore.
+func (repo *UserRepository) SigningKeys(ctx context.Context) ([]auth.StoredKey, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	rows, err := repo.q.QueryContext(ctx, `SELECT kid, algorithm, private_key, created_at, retired_at FROM signing_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []auth.StoredKey
+	for rows.Next() {
+		var k auth.StoredKey
+		var retired sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Algorithm, &k.Sealed, &k.CreatedAt, &retired); err != nil {
+			return nil, err
+		}
+		k.RetiredAt = retired.Time
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// AddSigningKey implements auth.KeyStore. The advisory lock keeps two
+// instances that decide to rotate at the same moment from both adding a
+// key.
+func (repo *UserRepository) AddSigningKey(ctx context.Context, key auth.StoredKey, staleBefore time.Time) (bool, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	added := false
+	err := repo.withTx(ctx, func(repo *UserRepository) error {
+		if _, err := repo.q.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('signing_keys'))`); err != nil {
+			return err
+		}
+		var fresh bool
+		err := repo.q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM signing_keys WHERE retired_at IS NULL AND created_at > $1)`, staleBefore).Scan(&fresh)
+		if err != nil || fresh {
+			return err
+		}
+		if _, err := repo.q.ExecContext(ctx, `UPDATE signing_keys SET retired_at = $1 WHERE retired_at IS NULL`, key.CreatedAt); err != nil {
+			return err
+		}
+		_, err = repo.q.ExecContext(ctx, `INSERT INTO signing_keys (kid, algorithm, private_key, created_at) VALUES ($1, $2, $3, $4)`,
+			key.ID, key.Algorithm, key.Sealed, key.CreatedAt)
+		added = err == nil
+		return err
+	})
+	return added, err
+}
+
+// DeleteSigningKeys implements auth.KeyStore.
+func (repo *UserRepository) DeleteSigningKeys(ctx context.Context, retiredBefore time.Time) error {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
+	_, err := repo.q.ExecContext(ctx, `DELETE FROM signing_keys WHERE retired_at < $1`, retiredBefore)
+	return err
+}
+
+func (repo *UserRepository) InsertCredential(ctx context.Context, cred UserCredential) (bool, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
 	query := `INSERT INTO user_credentials (user_id, password_hash, last_login, is_active) VALUES ($1, $2, $3, $4)`
-	_, err := repo.database.Exec(query, cred.UserID, cred.PasswordHash, cred.LastLogin, cred.IsActive)
-	return err == nil, err
+	_, err := repo.q.ExecContext(ctx, query, cred.UserID, cred.PasswordHash, cred.LastLogin, cred.IsActive)
+	return err == nil, mapDBError(err)
 }
 
-func (repo *UserRepository) GetCredential(userID uuid.UUID) (*UserCredential, error) {
+func (repo *UserRepository) GetCredential(ctx context.Context, userID uuid.UUID) (*UserCredential, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
 	query := `SELECT user_id, password_hash, last_login, is_active FROM user_credentials WHERE user_id = $1`
 	cred := &UserCredential{}
-	err := repo.database.QueryRow(query, userID).Scan(&cred.UserID, &cred.PasswordHash, &cred.LastLogin, &cred.IsActive)
-	return cred, err
+	err := repo.q.QueryRowContext(ctx, query, userID).Scan(&cred.UserID, &cred.PasswordHash, &cred.LastLogin, &cred.IsActive)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cred, nil
 }
 
-func (repo *UserRepository) UpdateCredential(cred UserCredential) (bool, error) {
+func (repo *UserRepository) UpdateCredential(ctx context.Context, cred UserCredential) (bool, error) {
+	ctx, cancel := repo.withTimeout(ctx)
+	defer cancel()
 	query := `UPDATE user_credentials SET password_hash = $1, last_login = $2, is_active = $3 WHERE user_id = $4`
-	res, err := repo.database.Exec(query, cred.PasswordHash, cred.LastLogin, cred.IsActive, cred.UserID)
+	res, err := repo.q.ExecContext(ctx, query, cred.PasswordHash, cred.LastLogin, cred.IsActive, cred.UserID)
 	if err != nil {
 		return false, err
 	}
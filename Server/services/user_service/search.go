@@ -0,0 +1,106 @@
+package userservice
+
+import (
+	"errors"
+	"html"
+	"strings"
+	"unicode"
+)
+
+const (
+	highlightOpen  = "<em>"
+	highlightClose = "</em>"
+	fragmentRadius = 40
+)
+
+var ErrEmptySearchQuery = errors.New("search query is empty")
+
+// escapeLike escapes the LIKE/ILIKE wildcards in s so it matches literally
+// when used with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func searchTerms(query string) []string {
+	var terms []string
+	for _, f := range strings.Fields(query) {
+		terms = append(terms, strings.ToLower(f))
+	}
+	return terms
+}
+
+// highlightUser returns a fragment for every searched field that contains
+// one of the terms literally. Fuzzy-only matches produce no highlight.
+func highlightUser(u User, terms []string) []SearchHighlight {
+	var highlights []SearchHighlight
+	fields := []struct {
+		name  string
+		value string
+		clip  bool
+	}{
+		{"username", u.Username, false},
+		{"full_name", u.FullName, false},
+		{"bio", u.Bio, true},
+	}
+	for _, f := range fields {
+		if fragment, ok := highlight(f.value, terms, f.clip); ok {
+			highlights = append(highlights, SearchHighlight{Field: f.name, Fragment: fragment})
+		}
+	}
+	return highlights
+}
+
+// highlight wraps every case-insensitive occurrence of terms in text with
+// <em> tags, HTML-escaping everything else. When clip is set only a window
+// around the first match is returned.
+func highlight(text string, terms []string, clip bool) (string, bool) {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	marked := make([]bool, len(runes))
+	found := false
+	for _, term := range terms {
+		t := []rune(term)
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if string(lower[i:i+len(t)]) == term {
+				for j := i; j < i+len(t); j++ {
+					marked[j] = true
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return "", false
+	}
+
+	start, end := 0, len(runes)
+	if clip {
+		first := 0
+		for first < len(marked) && !marked[first] {
+			first++
+		}
+		start = max(0, first-fragmentRadius)
+		end = min(len(runes), first+fragmentRadius)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; i++ {
+		if marked[i] && (i == start || !marked[i-1]) {
+			b.WriteString(highlightOpen)
+		}
+		b.WriteString(html.EscapeString(string(runes[i])))
+		if marked[i] && (i == end-1 || !marked[i+1]) {
+			b.WriteString(highlightClose)
+		}
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
@@ -1,8 +1,12 @@
 package userservice
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,50 +15,136 @@ import (
 )
 
 type UserService struct {
-	Repo *UserRepository
+	Repo UserStore
+	// Registration decides whether CreateUser needs an invitation. The
+	// zero value means open registration.
+	Registration RegistrationMode
 }
 
-func NewUserService(database *db.DB) *UserService {
+func NewUserService(database db.Querier) *UserService {
 	UserRepo := NewUserRepository(database)
 	return &UserService{Repo: UserRepo}
 }
 
+// NewUserServiceWithStore returns a service that keeps its data in store,
+// such as a MemoryStore in tests.
+func NewUserServiceWithStore(store UserStore) *UserService {
+	return &UserService{Repo: store}
+}
+
 // ------------------- Create -------------------
 
-func (service *UserService) CreateUser(u *CreateUserInput) (*User, error) {
+func (service *UserService) CreateUser(ctx context.Context, u *CreateUserInput) (*User, error) {
+	switch service.Registration {
+	case RegistrationClosed:
+		return nil, ErrRegistrationClosed
+	case RegistrationInviteOnly:
+		if u.InviteCode == "" {
+			return nil, ErrInvitationRequired
+		}
+	}
 	hashed, err := auth.HashPassword(u.Password)
 	if err != nil {
 		return nil, err
 	}
 	u.Password = hashed
-	User, err := service.Repo.InsertUser(*u)
+	var User *User
+	err = service.Repo.WithTx(ctx, func(repo UserStore) error {
+		var invitation *Invitation
+		if u.InviteCode != "" {
+			invitation, err = repo.LockInvitationByCode(ctx, hashInviteCode(u.InviteCode))
+			if errors.Is(err, ErrInvitationNotFound) {
+				return ErrInvalidInvitation
+			}
+			if err != nil {
+				return err
+			}
+			if !invitation.redeemableBy(u.Email, time.Now()) {
+				return ErrInvalidInvitation
+			}
+		}
+		User, err = repo.InsertUser(ctx, *u)
+		if err != nil {
+			return err
+		}
+		UserCredential := &UserCredential{
+			UserID:       User.ID,
+			PasswordHash: hashed,
+			IsActive:     true,
+		}
+		_, err = repo.InsertCredential(ctx, *UserCredential)
+		if err != nil {
+			return err
+		}
+		event := UserRegistered{UserID: User.ID, Username: User.Username, RegisteredAt: User.CreatedAt}
+		if invitation != nil {
+			if err := repo.RecordInvitationUse(ctx, invitation.ID, User.ID); err != nil {
+				return err
+			}
+			event.InvitationID = &invitation.ID
+		}
+		return repo.EnqueueEvent(ctx, TopicUserRegistered, User.ID.String(), event)
+	})
 	if err != nil {
 		return nil, err
 	}
-	UserCredential := &UserCredential{
-		UserID:       User.ID,
-		PasswordHash: hashed,
-		LastLogin:    sql.NullTime{Time: time.Now(), Valid: true},
-		IsActive:     true,
-	}
-	service.Repo.InsertCredential(*UserCredential)
 	return User, nil
 }
 
 // ------------------- Get By ID -------------------
 
-func (s *UserService) GetUserByID(id uuid.UUID) (*User, error) {
-	user, err := s.Repo.FindUserById(id)
+func (s *UserService) GetUserByID(ctx context.Context, id uuid.UUID) (*User, error) {
+	user, err := s.Repo.FindUserById(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
+// ------------------- Batch Get -------------------
+
+const MaxBatchGetUsers = 100
+
+var ErrBatchTooLarge = fmt.Errorf("at most %d ids can be fetched in one batch", MaxBatchGetUsers)
+
+// BatchGetUsers fetches every distinct id in one query, from a read
+// replica when there is one. Ids without a matching row are returned in
+// Missing rather than as an error.
+func (s *UserService) BatchGetUsers(ctx context.Context, ids []uuid.UUID) (*UserBatch, error) {
+	unique := make([]uuid.UUID, 0, len(ids))
+	seen := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) > MaxBatchGetUsers {
+		return nil, ErrBatchTooLarge
+	}
+	batch := &UserBatch{Users: make(map[uuid.UUID]User, len(unique))}
+	if len(unique) == 0 {
+		return batch, nil
+	}
+	users, err := s.Repo.FindUsersByIds(db.ReadOnly(ctx), unique)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		batch.Users[u.ID] = u
+	}
+	for _, id := range unique {
+		if _, ok := batch.Users[id]; !ok {
+			batch.Missing = append(batch.Missing, id)
+		}
+	}
+	return batch, nil
+}
+
 // ------------------- Update -------------------
 
-func (s *UserService) UpdateUser(u *UpdateUserInput) (*User, error) {
-	updatedUser, err := s.Repo.UpdateUser(*u)
+func (s *UserService) UpdateUser(ctx context.Context, u *UpdateUserInput) (*User, error) {
+	updatedUser, err := s.Repo.UpdateUser(ctx, *u)
 	if err != nil {
 		return nil, err
 	}
@@ -63,22 +153,50 @@ func (s *UserService) UpdateUser(u *UpdateUserInput) (*User, error) {
 
 // ------------------- Delete -------------------
 
-func (s *UserService) DeleteUser(id uuid.UUID) (bool, error) {
-	res, err := s.Repo.DeleteUser(id)
+func (s *UserService) DeleteUser(ctx context.Context, id uuid.UUID) (bool, error) {
+	var res bool
+	err := s.Repo.WithTx(ctx, func(repo UserStore) error {
+		if err := repo.DeleteCredential(ctx, id); err != nil {
+			return err
+		}
+		var err error
+		res, err = repo.DeleteUser(ctx, id)
+		if err != nil || !res {
+			return err
+		}
+		return repo.EnqueueEvent(ctx, TopicUserDeleted, id.String(), UserDeleted{UserID: id, DeletedAt: time.Now()})
+	})
 	return res, err
 }
 
 // ------------------- List All -------------------
 
-func (s *UserService) ListUsers(limit int, offset int) ([]User, error) {
-	Users, err := s.Repo.ListUsers(limit, offset)
-	return Users, err
+// ListUsers pages through every user. It may be served by a read replica.
+func (s *UserService) ListUsers(ctx context.Context, input *ListUsersInput) (*UserPage, error) {
+	ctx = db.ReadOnly(ctx)
+	page, size, err := newPage(input.Limit, input.Offset, input.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.Repo.ListUsers(ctx, page)
+	if err != nil {
+		return nil, err
+	}
+	result := &UserPage{}
+	result.Users, result.NextPageToken = trimPage(users, size)
+	if input.IncludeTotalCount {
+		result.TotalCount, err = s.Repo.CountUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
 }
 
 // ------------------- Find By Email -------------------
 
-func (s *UserService) SearchByEmail(email string) (*User, error) {
-	User, err := s.Repo.FindUserByEmail(email)
+func (s *UserService) SearchByEmail(ctx context.Context, email string) (*User, error) {
+	User, err := s.Repo.FindUserByEmail(ctx, email)
 	if err != nil {
 		return nil, err
 	}
@@ -87,21 +205,59 @@ func (s *UserService) SearchByEmail(email string) (*User, error) {
 
 // ------------------- FIND BY USERNAME -------------------
 
-func (s *UserService) SearchByUserName(name string, limit int, offset int) ([]User, error) {
-	return s.Repo.FindUsersByUsernamePartial(name, limit, offset)
+func (s *UserService) SearchByUserName(ctx context.Context, input *SearchByUsernameInput) (*UserPage, error) {
+	page, size, err := newPage(input.Limit, input.Offset, input.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.Repo.FindUsersByUsernamePartial(ctx, input.Username, page)
+	if err != nil {
+		return nil, err
+	}
+	result := &UserPage{}
+	result.Users, result.NextPageToken = trimPage(users, size)
+	if input.IncludeTotalCount {
+		result.TotalCount, err = s.Repo.CountUsersByUsernamePartial(ctx, input.Username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// ------------------- SEARCH -------------------
+
+func (s *UserService) SearchUsers(ctx context.Context, input *SearchUsersInput) ([]UserSearchResult, error) {
+	query := strings.TrimSpace(input.Query)
+	if query == "" {
+		return nil, ErrEmptySearchQuery
+	}
+	results, err := s.Repo.SearchUsers(db.ReadOnly(ctx), query, input.Prefix, normalizePageSize(input.Limit), max(input.Offset, 0))
+	if err != nil {
+		return nil, err
+	}
+	terms := searchTerms(query)
+	for i := range results {
+		results[i].Highlights = highlightUser(results[i].User, terms)
+	}
+	return results, nil
 }
 
 // ------------------- ChangePassword -------------------
 
-func (s *UserService) ChangePassword(ChangePasswordInput *ChangePasswordInput) bool {
+func (s *UserService) ChangePassword(ctx context.Context, ChangePasswordInput *ChangePasswordInput) bool {
 	hashed, _ := auth.HashPassword(ChangePasswordInput.NewPassword)
+	current, err := s.Repo.GetCredential(ctx, ChangePasswordInput.ID)
+	if err != nil {
+		return false
+	}
 	UpdateCred := &UserCredential{
 		UserID:       ChangePasswordInput.ID,
 		PasswordHash: hashed,
-		LastLogin:    sql.NullTime{Time: time.Now(), Valid: true},
+		LastLogin:    current.LastLogin,
 		IsActive:     true,
 	}
-	bol, err := s.Repo.UpdateCredential(*UpdateCred)
+	bol, err := s.Repo.UpdateCredential(ctx, *UpdateCred)
 	if err != nil {
 		return false
 	}
@@ -110,30 +266,127 @@ func (s *UserService) ChangePassword(ChangePasswordInput *ChangePasswordInput) b
 
 // ------------------- LOGIN -------------------
 
-func (s *UserService) Login(u *LoginInput) (*User, error) {
-	User, err := s.Repo.FindUserByEmail(u.Email)
+// Login checks the password and account standing. Every attempt against an
+// existing account is written to the login history; a successful one from
+// a device or network the user hasn't signed in from before also queues a
+// security alert.
+func (s *UserService) Login(ctx context.Context, u *LoginInput) (*User, error) {
+	User, err := s.Repo.FindUserByEmail(ctx, u.Email)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidCredentials
+	}
 	if err != nil {
 		return nil, err
 	}
-	cred, err := s.Repo.GetCredential(User.ID)
+	cred, err := s.Repo.GetCredential(ctx, User.ID)
+	if errors.Is(err, ErrUserNotFound) {
+		s.recordFailedLogin(ctx, User.ID, u.Client, ErrInvalidCredentials)
+		return nil, ErrInvalidCredentials
+	}
 	if err != nil {
 		return nil, err
 	}
 	val := auth.CheckPasswordHash(u.Password, cred.PasswordHash)
 	if !val {
-		return nil, errors.New("unauthorized")
+		s.recordFailedLogin(ctx, User.ID, u.Client, ErrInvalidCredentials)
+		return nil, ErrInvalidCredentials
 	}
+	if err := s.CheckAccount(ctx, User.ID); err != nil {
+		s.recordFailedLogin(ctx, User.ID, u.Client, err)
+		return nil, err
+	}
+	s.recordLogin(ctx, *User, u.Client)
 	return User, nil
 }
 
+// recordLogin writes a successful login to the login history and queues
+// the alert for a new device or network. The history is for auditing, so
+// a failure here is logged rather than failing a login that has already
+// passed every check.
+func (s *UserService) recordLogin(ctx context.Context, u User, client ClientInfo) {
+	if err := s.insertLogin(ctx, u, client); err != nil {
+		log.Printf("userservice: recording login for %s: %v", u.ID, err)
+	}
+}
+
+func (s *UserService) insertLogin(ctx context.Context, u User, client ClientInfo) error {
+	return s.Repo.WithTx(ctx, func(repo UserStore) error {
+		network := client.network()
+		seen, knownDevice, knownNetwork, err := repo.KnownLoginSources(ctx, u.ID, client.deviceHash(), network)
+		if err != nil {
+			return err
+		}
+		event, err := repo.InsertLoginEvent(ctx, LoginEvent{
+			UserID:      u.ID,
+			IP:          client.ip(),
+			UserAgent:   sql.NullString{String: client.UserAgent, Valid: client.UserAgent != ""},
+			DeviceHash:  client.deviceHash(),
+			Outcome:     LoginSuccess,
+			NewDevice:   seen && !knownDevice,
+			NewLocation: seen && network != "" && !knownNetwork,
+		}, network)
+		if err != nil {
+			return err
+		}
+		if err := repo.TouchLastLogin(ctx, u.ID, event.CreatedAt); err != nil {
+			return err
+		}
+		if event.NewDevice || event.NewLocation {
+			return repo.EnqueueNotification(ctx, newSignInAlert(u, event))
+		}
+		return nil
+	})
+}
+
+// recordFailedLogin writes a failed attempt to the login history, even if
+// the client has already given up on the call. The login has already
+// failed, so an error here is only logged.
+func (s *UserService) recordFailedLogin(ctx context.Context, userID uuid.UUID, client ClientInfo, cause error) {
+	_, err := s.Repo.InsertLoginEvent(context.WithoutCancel(ctx), LoginEvent{
+		UserID:     userID,
+		IP:         client.ip(),
+		UserAgent:  sql.NullString{String: client.UserAgent, Valid: client.UserAgent != ""},
+		DeviceHash: client.deviceHash(),
+		Outcome:    loginOutcome(cause),
+	}, client.network())
+	if err != nil {
+		log.Printf("userservice: recording failed login for %s: %v", userID, err)
+	}
+}
+
+func (s *UserService) ListLoginHistory(ctx context.Context, userID uuid.UUID, limit, offset int) ([]LoginEvent, error) {
+	if _, err := s.Repo.FindUserById(ctx, userID); err != nil {
+		return nil, err
+	}
+	return s.Repo.ListLoginHistory(ctx, userID, normalizePageSize(limit), max(offset, 0))
+}
+
+// CheckAccount returns nil if the account exists and may sign in and use
+// its tokens, or the reason it may not.
+func (s *UserService) CheckAccount(ctx context.Context, id uuid.UUID) error {
+	standing, err := s.Repo.GetAccountStanding(ctx, id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case standing.BannedAt.Valid:
+		return ErrAccountBanned
+	case standing.SuspendedUntil.Valid && standing.SuspendedUntil.Time.After(time.Now()):
+		return fmt.Errorf("%w until %s", ErrAccountSuspended, standing.SuspendedUntil.Time.UTC().Format(time.RFC3339))
+	case !standing.IsActive:
+		return ErrAccountInactive
+	}
+	return nil
+}
+
 // ------------------- VALIDATE -------------------
 
-func (s *UserService) Validate(u *LoginInput) bool {
-	User, err := s.Repo.FindUserByEmail(u.Email)
+func (s *UserService) Validate(ctx context.Context, u *LoginInput) bool {
+	User, err := s.Repo.FindUserByEmail(ctx, u.Email)
 	if err != nil {
 		return false
 	}
-	cred, err := s.Repo.GetCredential(User.ID)
+	cred, err := s.Repo.GetCredential(ctx, User.ID)
 	if err != nil {
 		return false
 	}
@@ -143,15 +396,241 @@ func (s *UserService) Validate(u *LoginInput) bool {
 
 // ------------------- DEACTIVATE -------------------
 
-func (s *UserService) DeactivateUser(ID uuid.UUID) bool {
-	UserCredential, err := s.Repo.GetCredential(ID)
+func (s *UserService) DeactivateUser(ctx context.Context, ID uuid.UUID) bool {
+	UserCredential, err := s.Repo.GetCredential(ctx, ID)
 	if err != nil {
 		return false
 	}
 	UserCredential.IsActive = false
-	res, err := s.Repo.UpdateCredential(*UserCredential)
+	res, err := s.Repo.UpdateCredential(ctx, *UserCredential)
 	if err != nil {
 		return false
 	}
 	return res
 }
+
+// ------------------- MODERATION -------------------
+
+// authorizeModeration checks that the moderator may act on target: nobody
+// moderates themselves and only admins moderate admins.
+func (s *UserService) authorizeModeration(ctx context.Context, repo UserStore, input *ModerationInput) error {
+	if input.Moderator.Is(input.UserID) {
+		return ErrPermissionDenied
+	}
+	target, err := repo.FindUserById(ctx, input.UserID)
+	if err != nil {
+		return err
+	}
+	if target.Role == auth.RoleAdmin && !input.Moderator.IsAdmin() {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+func (s *UserService) SuspendUser(ctx context.Context, input *ModerationInput) (*ModerationAction, error) {
+	if !input.Until.After(time.Now()) {
+		return nil, NewValidationError("until", "must be in the future")
+	}
+	var action *ModerationAction
+	err := s.Repo.WithTx(ctx, func(repo UserStore) error {
+		if err := s.authorizeModeration(ctx, repo, input); err != nil {
+			return err
+		}
+		if err := repo.SetSuspension(ctx, input.UserID, input.Until); err != nil {
+			return err
+		}
+		var err error
+		action, err = repo.InsertModerationAction(ctx, ModerationAction{
+			UserID:      input.UserID,
+			ModeratorID: input.Moderator.UserID,
+			Action:      ModerationSuspend,
+			Reason:      input.Reason,
+			Notes:       input.Notes,
+			ExpiresAt:   sql.NullTime{Time: input.Until, Valid: true},
+		})
+		return err
+	})
+	return action, err
+}
+
+func (s *UserService) LiftSuspension(ctx context.Context, input *ModerationInput) (*ModerationAction, error) {
+	var action *ModerationAction
+	err := s.Repo.WithTx(ctx, func(repo UserStore) error {
+		if err := s.authorizeModeration(ctx, repo, input); err != nil {
+			return err
+		}
+		standing, err := repo.GetAccountStanding(ctx, input.UserID)
+		if err != nil {
+			return err
+		}
+		if !standing.SuspendedUntil.Valid || !standing.SuspendedUntil.Time.After(time.Now()) {
+			return ErrNotSuspended
+		}
+		if err := repo.SetSuspension(ctx, input.UserID, time.Time{}); err != nil {
+			return err
+		}
+		action, err = repo.InsertModerationAction(ctx, ModerationAction{
+			UserID:      input.UserID,
+			ModeratorID: input.Moderator.UserID,
+			Action:      ModerationLift,
+			Reason:      input.Reason,
+			Notes:       input.Notes,
+		})
+		return err
+	})
+	return action, err
+}
+
+func (s *UserService) BanUser(ctx context.Context, input *ModerationInput) (*ModerationAction, error) {
+	var action *ModerationAction
+	err := s.Repo.WithTx(ctx, func(repo UserStore) error {
+		if err := s.authorizeModeration(ctx, repo, input); err != nil {
+			return err
+		}
+		if err := repo.SetBanned(ctx, input.UserID); err != nil {
+			return err
+		}
+		var err error
+		action, err = repo.InsertModerationAction(ctx, ModerationAction{
+			UserID:      input.UserID,
+			ModeratorID: input.Moderator.UserID,
+			Action:      ModerationBan,
+			Reason:      input.Reason,
+			Notes:       input.Notes,
+		})
+		return err
+	})
+	return action, err
+}
+
+// ------------------- STATS -------------------
+
+const (
+	DefaultStatsMonths = 12
+	MaxStatsMonths     = 60
+)
+
+// GetUserStats returns a creator's profile totals. When months > 0 it also
+// returns the per-month download history for that many months, with months
+// that had no downloads filled in as zero.
+func (s *UserService) GetUserStats(ctx context.Context, id uuid.UUID, months int) (*UserStats, error) {
+	stats, err := s.Repo.GetUserStats(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if months <= 0 {
+		return stats, nil
+	}
+	months = min(months, MaxStatsMonths)
+
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -(months - 1), 0)
+	recorded, err := s.Repo.ListMonthlyDownloads(ctx, id, since)
+	if err != nil {
+		return nil, err
+	}
+	byMonth := make(map[time.Time]int64, len(recorded))
+	for _, m := range recorded {
+		byMonth[time.Date(m.Month.Year(), m.Month.Month(), 1, 0, 0, 0, 0, time.UTC)] = m.Downloads
+	}
+	for i := 0; i < months; i++ {
+		month := since.AddDate(0, i, 0)
+		stats.MonthlyDownloads = append(stats.MonthlyDownloads, MonthlyDownloads{Month: month, Downloads: byMonth[month]})
+	}
+	return stats, nil
+}
+
+// ------------------- INVITATIONS -------------------
+
+// CreateInvitation stores a new invitation and returns it along with its
+// code. The code is not stored and can't be recovered later.
+func (s *UserService) CreateInvitation(ctx context.Context, input *CreateInvitationInput) (*Invitation, string, error) {
+	if input.MaxUses == 0 {
+		input.MaxUses = DefaultInvitationUses
+	}
+	if !input.ExpiresAt.IsZero() && !input.ExpiresAt.After(time.Now()) {
+		return nil, "", NewValidationError("expires_at", "must be in the future")
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		return nil, "", err
+	}
+	invitation, err := s.Repo.InsertInvitation(ctx, hashInviteCode(code), *input)
+	if err != nil {
+		return nil, "", err
+	}
+	return invitation, code, nil
+}
+
+func (s *UserService) ListInvitations(ctx context.Context, input *ListInvitationsInput) ([]Invitation, error) {
+	return s.Repo.ListInvitations(ctx, input.IssuerID, normalizePageSize(input.Limit), max(input.Offset, 0))
+}
+
+// RevokeInvitation stops an invitation from being redeemed again. Only its
+// issuer and admins may revoke it. Accounts already created with it are
+// not affected.
+func (s *UserService) RevokeInvitation(ctx context.Context, id uuid.UUID, caller auth.Caller) (*Invitation, error) {
+	var invitation *Invitation
+	err := s.Repo.WithTx(ctx, func(repo UserStore) error {
+		existing, err := repo.FindInvitationById(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !caller.IsAdmin() && !(existing.IssuerID.Valid && caller.Is(existing.IssuerID.UUID)) {
+			return ErrPermissionDenied
+		}
+		invitation, err = repo.RevokeInvitation(ctx, id)
+		return err
+	})
+	return invitation, err
+}
+
+// ------------------- IMPERSONATION -------------------
+
+// ImpersonateUser checks that an admin may act as the user and records that
+// they started doing so. Admins can't impersonate other admins, and an
+// impersonated session can't start another one.
+func (s *UserService) ImpersonateUser(ctx context.Context, input *ImpersonationInput) (*User, error) {
+	if !input.Admin.IsAdmin() || input.Admin.IsImpersonated() || input.Admin.Is(input.UserID) {
+		return nil, ErrPermissionDenied
+	}
+	var target *User
+	err := s.Repo.WithTx(ctx, func(repo UserStore) error {
+		var err error
+		target, err = repo.FindUserById(ctx, input.UserID)
+		if err != nil {
+			return err
+		}
+		if target.Role == auth.RoleAdmin {
+			return ErrPermissionDenied
+		}
+		return repo.InsertSecurityEvent(ctx, SecurityEvent{
+			UserID:  target.ID,
+			ActorID: uuid.NullUUID{UUID: input.Admin.UserID, Valid: true},
+			Event:   SecurityImpersonationStarted,
+			Reason:  sql.NullString{String: input.Reason, Valid: true},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// RecordImpersonatedAction adds a call made by an impersonated session to
+// the user's security history.
+func (s *UserService) RecordImpersonatedAction(ctx context.Context, caller *auth.Caller, method string) error {
+	return s.Repo.InsertSecurityEvent(ctx, SecurityEvent{
+		UserID:  caller.UserID,
+		ActorID: uuid.NullUUID{UUID: caller.Actor, Valid: true},
+		Event:   SecurityImpersonatedAction,
+		Method:  sql.NullString{String: method, Valid: true},
+	})
+}
+
+func (s *UserService) ListSecurityEvents(ctx context.Context, userID uuid.UUID, limit, offset int) ([]SecurityEvent, error) {
+	if _, err := s.Repo.FindUserById(ctx, userID); err != nil {
+		return nil, err
+	}
+	return s.Repo.ListSecurityEvents(ctx, userID, normalizePageSize(limit), max(offset, 0))
+}
@@ -0,0 +1,80 @@
+package userservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
+)
+
+// UserStore is the persistence UserService is built on. UserRepository
+// implements it on Postgres and MemoryStore in memory; both pass the
+// contract tests in store_contract_test.go, which pin down the behaviour
+// callers may rely on: unique usernames, emails, credentials and
+// invitation codes surface as *ConflictError, lookups of missing rows as
+// ErrUserNotFound or ErrInvitationNotFound, and deleting a user removes
+// everything that belongs to them.
+type UserStore interface {
+	auth.KeyStore
+
+	// WithTx runs fn against a store bound to a transaction. Everything fn
+	// writes is undone if it returns an error. Called on a store that is
+	// already inside a transaction, fn runs in a savepoint. fn may run more
+	// than once and must only use the store it is given.
+	WithTx(ctx context.Context, fn func(tx UserStore) error) error
+
+	InsertUser(ctx context.Context, input CreateUserInput) (*User, error)
+	FindUserById(ctx context.Context, id uuid.UUID) (*User, error)
+	FindUsersByIds(ctx context.Context, ids []uuid.UUID) ([]User, error)
+	FindUserByEmail(ctx context.Context, email string) (*User, error)
+	UpdateUser(ctx context.Context, input UpdateUserInput) (*User, error)
+	DeleteUser(ctx context.Context, id uuid.UUID) (bool, error)
+	ListUsers(ctx context.Context, page Page) ([]User, error)
+	CountUsers(ctx context.Context) (int64, error)
+	FindUsersByUsernamePartial(ctx context.Context, partial string, page Page) ([]User, error)
+	CountUsersByUsernamePartial(ctx context.Context, partial string) (int64, error)
+	SearchUsers(ctx context.Context, query string, prefix bool, limit, offset int) ([]UserSearchResult, error)
+
+	InsertCredential(ctx context.Context, cred UserCredential) (bool, error)
+	GetCredential(ctx context.Context, userID uuid.UUID) (*UserCredential, error)
+	UpdateCredential(ctx context.Context, cred UserCredential) (bool, error)
+	DeleteCredential(ctx context.Context, userID uuid.UUID) error
+
+	GetAccountStanding(ctx context.Context, id uuid.UUID) (*AccountStanding, error)
+	SetSuspension(ctx context.Context, id uuid.UUID, until time.Time) error
+	SetBanned(ctx context.Context, id uuid.UUID) error
+	InsertModerationAction(ctx context.Context, action ModerationAction) (*ModerationAction, error)
+
+	GetUserStats(ctx context.Context, id uuid.UUID) (*UserStats, error)
+	ListMonthlyDownloads(ctx context.Context, id uuid.UUID, since time.Time) ([]MonthlyDownloads, error)
+
+	InsertInvitation(ctx context.Context, codeHash string, input CreateInvitationInput) (*Invitation, error)
+	FindInvitationById(ctx context.Context, id uuid.UUID) (*Invitation, error)
+	LockInvitationByCode(ctx context.Context, codeHash string) (*Invitation, error)
+	ListInvitations(ctx context.Context, issuerID uuid.UUID, limit, offset int) ([]Invitation, error)
+	RevokeInvitation(ctx context.Context, id uuid.UUID) (*Invitation, error)
+	RecordInvitationUse(ctx context.Context, invitationID, userID uuid.UUID) error
+
+	FindExistingUsers(ctx context.Context, usernames, emails []string) (byUsername, byEmail map[string]uuid.UUID, err error)
+	InsertUserRecords(ctx context.Context, records []UserRecord) (int, error)
+	UpdateUserRecords(ctx context.Context, ids []uuid.UUID, records []UserRecord) error
+	FindPasswordHashes(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]string, error)
+
+	KnownLoginSources(ctx context.Context, userID uuid.UUID, deviceHash, network string) (seen, device, location bool, err error)
+	InsertLoginEvent(ctx context.Context, event LoginEvent, network string) (*LoginEvent, error)
+	ListLoginHistory(ctx context.Context, userID uuid.UUID, limit, offset int) ([]LoginEvent, error)
+	TouchLastLogin(ctx context.Context, userID uuid.UUID, at time.Time) error
+	EnqueueNotification(ctx context.Context, n Notification) error
+
+	InsertSecurityEvent(ctx context.Context, event SecurityEvent) error
+	ListSecurityEvents(ctx context.Context, userID uuid.UUID, limit, offset int) ([]SecurityEvent, error)
+
+	// EnqueueEvent writes an event to the outbox; see lib/events.
+	EnqueueEvent(ctx context.Context, topic, key string, payload any) error
+}
+
+var (
+	_ UserStore = (*UserRepository)(nil)
+	_ UserStore = (*MemoryStore)(nil)
+)
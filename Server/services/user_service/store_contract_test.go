@@ -0,0 +1,677 @@
+package userservice_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shatwik7/polycrate/lib/db/dbtest"
+	userservice "github.com/shatwik7/polycrate/services/user_service"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+// The contract tests describe what UserService may rely on from any
+// UserStore. They run against every implementation; a behaviour only one
+// of them has doesn't belong here.
+
+func TestUserStoreContract(t *testing.T) {
+	stores := []struct {
+		name     string
+		newStore func(t *testing.T) userservice.UserStore
+	}{
+		{"memory", func(*testing.T) userservice.UserStore { return userservice.NewMemoryStore() }},
+		{"postgres", postgresStore},
+	}
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store userservice.UserStore)
+	}{
+		{"Users", testStoreUsers},
+		{"Versions", testStoreVersions},
+		{"NotFound", testStoreNotFound},
+		{"UniqueConstraints", testStoreUniqueConstraints},
+		{"ForeignKeys", testStoreForeignKeys},
+		{"DeleteCascades", testStoreDeleteCascades},
+		{"Transactions", testStoreTransactions},
+		{"Listing", testStoreListing},
+		{"Search", testStoreSearch},
+		{"Moderation", testStoreModeration},
+		{"Invitations", testStoreInvitations},
+		{"Bulk", testStoreBulk},
+		{"LoginHistory", testStoreLoginHistory},
+		{"SecurityEvents", testStoreSecurityEvents},
+		{"SigningKeys", testStoreSigningKeys},
+	}
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			t.Parallel()
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					t.Parallel()
+					tt.run(t, s.newStore(t))
+				})
+			}
+		})
+	}
+}
+
+// postgresStore returns a repository on a schema of its own. The test is
+// skipped when TEST_DATABASE_URL isn't set.
+func postgresStore(t *testing.T) userservice.UserStore {
+	return userservice.NewUserRepository(dbtest.New(t))
+}
+
+func insertUser(t *testing.T, store userservice.UserStore, username string) *userservice.User {
+	t.Helper()
+	user, err := store.InsertUser(ctx, userservice.CreateUserInput{Username: username, Email: username + "@site.com"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return user
+}
+
+func assertPgCode(t *testing.T, err error, code string) {
+	t.Helper()
+	var pgErr *pgconn.PgError
+	if assert.ErrorAs(t, err, &pgErr) {
+		assert.Equal(t, code, pgErr.Code, pgErr.Message)
+	}
+}
+
+func testStoreUsers(t *testing.T, store userservice.UserStore) {
+	user, err := store.InsertUser(ctx, userservice.CreateUserInput{Username: "alice", Email: "alice@site.com", FullName: "Alice Archer", Bio: "hi"})
+	assert.NoError(t, err)
+	assert.Equal(t, auth.RoleUser, user.Role)
+	assert.False(t, user.Website.Valid)
+	assert.False(t, user.CreatedAt.IsZero())
+	assert.True(t, user.CreatedAt.Equal(user.UpdatedAt))
+
+	found, err := store.FindUserById(ctx, user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, *user, *found)
+	found, err = store.FindUserByEmail(ctx, "alice@site.com")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+	users, err := store.FindUsersByIds(ctx, []uuid.UUID{user.ID, user.ID, uuid.New()})
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+
+	updated, err := store.UpdateUser(ctx, userservice.UpdateUserInput{ID: user.ID, FullName: "Alice B", Bio: "hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice B", updated.FullName)
+	assert.Equal(t, "alice", updated.Username)
+	assert.False(t, updated.UpdatedAt.Before(user.UpdatedAt))
+	assert.Equal(t, user.Version+1, updated.Version)
+
+	stats, err := store.GetUserStats(ctx, user.ID)
+	assert.NoError(t, err)
+	assert.Zero(t, stats.PublicAssets)
+	assert.True(t, stats.JoinedAt.Equal(user.CreatedAt))
+
+	ok, err := store.DeleteUser(ctx, user.ID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	count, err := store.CountUsers(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func testStoreVersions(t *testing.T, store userservice.UserStore) {
+	user := insertUser(t, store, "alice")
+	assert.Equal(t, int64(1), user.Version)
+
+	updated, err := store.UpdateUser(ctx, userservice.UpdateUserInput{ID: user.ID, FullName: "First", Version: user.Version})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), updated.Version)
+
+	// A second writer that read the same version loses.
+	_, err = store.UpdateUser(ctx, userservice.UpdateUserInput{ID: user.ID, FullName: "Second", Version: user.Version})
+	assert.ErrorIs(t, err, userservice.ErrVersionConflict)
+	found, _ := store.FindUserById(ctx, user.ID)
+	assert.Equal(t, "First", found.FullName)
+	assert.Equal(t, int64(2), found.Version)
+
+	_, err = store.UpdateUser(ctx, userservice.UpdateUserInput{ID: uuid.New(), Version: 1})
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+
+	// Without a version the update always applies.
+	updated, err = store.UpdateUser(ctx, userservice.UpdateUserInput{ID: user.ID, FullName: "Third"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), updated.Version)
+
+	// Moderation changes updated_at, so it changes the version too.
+	assert.NoError(t, store.SetSuspension(ctx, user.ID, time.Now().Add(time.Hour)))
+	found, _ = store.FindUserById(ctx, user.ID)
+	assert.Equal(t, int64(4), found.Version)
+	assert.NoError(t, store.SetBanned(ctx, user.ID))
+	found, _ = store.FindUserById(ctx, user.ID)
+	assert.Equal(t, int64(5), found.Version)
+	_, err = store.UpdateUser(ctx, userservice.UpdateUserInput{ID: user.ID, FullName: "Fourth", Version: 3})
+	assert.ErrorIs(t, err, userservice.ErrVersionConflict)
+}
+
+func testStoreNotFound(t *testing.T, store userservice.UserStore) {
+	missing := uuid.New()
+	_, err := store.FindUserById(ctx, missing)
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+	_, err = store.FindUserByEmail(ctx, "nobody@site.com")
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+	_, err = store.UpdateUser(ctx, userservice.UpdateUserInput{ID: missing})
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+	ok, err := store.DeleteUser(ctx, missing)
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+	assert.False(t, ok)
+	_, err = store.GetCredential(ctx, missing)
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+	_, err = store.GetAccountStanding(ctx, missing)
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+	assert.ErrorIs(t, store.SetSuspension(ctx, missing, time.Now()), userservice.ErrUserNotFound)
+	assert.ErrorIs(t, store.SetBanned(ctx, missing), userservice.ErrUserNotFound)
+	_, err = store.GetUserStats(ctx, missing)
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+	ok, err = store.UpdateCredential(ctx, userservice.UserCredential{UserID: missing})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = store.FindInvitationById(ctx, missing)
+	assert.ErrorIs(t, err, userservice.ErrInvitationNotFound)
+	_, err = store.LockInvitationByCode(ctx, "no such code")
+	assert.ErrorIs(t, err, userservice.ErrInvitationNotFound)
+	_, err = store.RevokeInvitation(ctx, missing)
+	assert.ErrorIs(t, err, userservice.ErrInvitationNotFound)
+}
+
+func testStoreUniqueConstraints(t *testing.T, store userservice.UserStore) {
+	alice := insertUser(t, store, "alice")
+	var conflict *userservice.ConflictError
+
+	_, err := store.InsertUser(ctx, userservice.CreateUserInput{Username: "alice", Email: "other@site.com"})
+	if assert.ErrorAs(t, err, &conflict) {
+		assert.Equal(t, "username", conflict.Field)
+	}
+	_, err = store.InsertUser(ctx, userservice.CreateUserInput{Username: "other", Email: "alice@site.com"})
+	if assert.ErrorAs(t, err, &conflict) {
+		assert.Equal(t, "email", conflict.Field)
+	}
+	count, _ := store.CountUsers(ctx)
+	assert.Equal(t, int64(1), count)
+
+	cred := userservice.UserCredential{UserID: alice.ID, PasswordHash: "hash", IsActive: true}
+	ok, err := store.InsertCredential(ctx, cred)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = store.InsertCredential(ctx, cred)
+	assert.ErrorAs(t, err, &conflict)
+	assert.False(t, ok)
+
+	input := userservice.CreateInvitationInput{Issuer: auth.Caller{UserID: alice.ID}, MaxUses: 1}
+	_, err = store.InsertInvitation(ctx, "code", input)
+	assert.NoError(t, err)
+	_, err = store.InsertInvitation(ctx, "code", input)
+	assert.ErrorAs(t, err, &conflict)
+}
+
+func testStoreForeignKeys(t *testing.T, store userservice.UserStore) {
+	alice := insertUser(t, store, "alice")
+	missing := uuid.New()
+
+	_, err := store.InsertCredential(ctx, userservice.UserCredential{UserID: missing, PasswordHash: "hash"})
+	assertPgCode(t, err, "23503")
+	_, err = store.InsertModerationAction(ctx, userservice.ModerationAction{UserID: alice.ID, ModeratorID: missing, Action: userservice.ModerationBan})
+	assertPgCode(t, err, "23503")
+	_, err = store.InsertInvitation(ctx, "code", userservice.CreateInvitationInput{Issuer: auth.Caller{UserID: missing}, MaxUses: 1})
+	assertPgCode(t, err, "23503")
+	_, err = store.InsertLoginEvent(ctx, userservice.LoginEvent{UserID: missing, Outcome: userservice.LoginSuccess}, "")
+	assertPgCode(t, err, "23503")
+	err = store.EnqueueNotification(ctx, userservice.Notification{UserID: missing, Destination: "x@site.com"})
+	assertPgCode(t, err, "23503")
+	err = store.InsertSecurityEvent(ctx, userservice.SecurityEvent{UserID: alice.ID, ActorID: uuid.NullUUID{UUID: missing, Valid: true}, Event: userservice.SecurityImpersonatedAction})
+	assertPgCode(t, err, "23503")
+	assertPgCode(t, store.RecordInvitationUse(ctx, missing, alice.ID), "23503")
+}
+
+func testStoreDeleteCascades(t *testing.T, store userservice.UserStore) {
+	alice := insertUser(t, store, "alice")
+	bob := insertUser(t, store, "bob")
+
+	_, err := store.InsertCredential(ctx, userservice.UserCredential{UserID: bob.ID, PasswordHash: "hash", IsActive: true})
+	assert.NoError(t, err)
+	invitation, err := store.InsertInvitation(ctx, "code", userservice.CreateInvitationInput{Issuer: auth.Caller{UserID: alice.ID}, MaxUses: 2})
+	assert.NoError(t, err)
+	assert.NoError(t, store.RecordInvitationUse(ctx, invitation.ID, bob.ID))
+	_, err = store.InsertLoginEvent(ctx, userservice.LoginEvent{UserID: bob.ID, DeviceHash: "d", Outcome: userservice.LoginSuccess}, "")
+	assert.NoError(t, err)
+	assert.NoError(t, store.InsertSecurityEvent(ctx, userservice.SecurityEvent{
+		UserID:  bob.ID,
+		ActorID: uuid.NullUUID{UUID: alice.ID, Valid: true},
+		Event:   userservice.SecurityImpersonationStarted,
+	}))
+	_, err = store.InsertModerationAction(ctx, userservice.ModerationAction{UserID: bob.ID, ModeratorID: alice.ID, Action: userservice.ModerationBan, Reason: "spam"})
+	assert.NoError(t, err)
+	assert.NoError(t, store.EnqueueNotification(ctx, userservice.Notification{UserID: bob.ID, Destination: "bob@site.com"}))
+
+	// What alice issued or did outlives her, without her.
+	_, err = store.DeleteUser(ctx, alice.ID)
+	assert.NoError(t, err)
+	invitation, err = store.FindInvitationById(ctx, invitation.ID)
+	assert.NoError(t, err)
+	assert.False(t, invitation.IssuerID.Valid)
+	events, err := store.ListSecurityEvents(ctx, bob.ID, 10, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.False(t, events[0].ActorID.Valid)
+	}
+
+	// What belongs to bob goes with him.
+	_, err = store.DeleteUser(ctx, bob.ID)
+	assert.NoError(t, err)
+	_, err = store.GetCredential(ctx, bob.ID)
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+	history, err := store.ListLoginHistory(ctx, bob.ID, 10, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+	events, err = store.ListSecurityEvents(ctx, bob.ID, 10, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	invitation, err = store.FindInvitationById(ctx, invitation.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, invitation.InviteeIDs)
+	assert.Equal(t, 1, invitation.Uses, "a use stays counted")
+
+	// Their usernames and emails are free again.
+	insertUser(t, store, "bob")
+}
+
+func testStoreTransactions(t *testing.T, store userservice.UserStore) {
+	boom := errors.New("boom")
+	err := store.WithTx(ctx, func(tx userservice.UserStore) error {
+		insertUser(t, tx, "rolled_back")
+		return boom
+	})
+	assert.ErrorIs(t, err, boom)
+	_, err = store.FindUserByEmail(ctx, "rolled_back@site.com")
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+
+	err = store.WithTx(ctx, func(tx userservice.UserStore) error {
+		insertUser(t, tx, "outer")
+		nested := tx.WithTx(ctx, func(tx userservice.UserStore) error {
+			insertUser(t, tx, "inner")
+			_, err := tx.InsertUser(ctx, userservice.CreateUserInput{Username: "dup", Email: "outer@site.com"})
+			return err
+		})
+		var conflict *userservice.ConflictError
+		assert.ErrorAs(t, nested, &conflict)
+		// The savepoint was rolled back, so the transaction goes on.
+		_, err := tx.FindUserByEmail(ctx, "inner@site.com")
+		assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+		return nil
+	})
+	assert.NoError(t, err)
+	_, err = store.FindUserByEmail(ctx, "outer@site.com")
+	assert.NoError(t, err)
+
+	// A failed statement outside a savepoint aborts the transaction.
+	err = store.WithTx(ctx, func(tx userservice.UserStore) error {
+		insertUser(t, tx, "doomed")
+		_, err := tx.InsertUser(ctx, userservice.CreateUserInput{Username: "outer", Email: "other@site.com"})
+		assert.Error(t, err)
+		_, err = tx.FindUserByEmail(ctx, "doomed@site.com")
+		assertPgCode(t, err, "25P02")
+		return nil
+	})
+	assert.Error(t, err)
+	_, err = store.FindUserByEmail(ctx, "doomed@site.com")
+	assert.ErrorIs(t, err, userservice.ErrUserNotFound)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = store.FindUserByEmail(canceled, "outer@site.com")
+	assert.ErrorIs(t, err, context.Canceled)
+	err = store.WithTx(canceled, func(userservice.UserStore) error { return nil })
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func testStoreListing(t *testing.T, store userservice.UserStore) {
+	var ids []uuid.UUID
+	for _, name := range []string{"page_a", "page_b", "Page_c", "page_d", "page_e"} {
+		ids = append(ids, insertUser(t, store, name).ID)
+	}
+	// Would match "page_" if _ were a wildcard.
+	insertUser(t, store, "pagex1")
+
+	first, err := store.ListUsers(ctx, userservice.Page{Limit: 2})
+	assert.NoError(t, err)
+	if assert.Len(t, first, 2) {
+		assert.Equal(t, ids[:2], []uuid.UUID{first[0].ID, first[1].ID})
+	}
+	last := first[1]
+	next, err := store.ListUsers(ctx, userservice.Page{Limit: 2, After: &userservice.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}})
+	assert.NoError(t, err)
+	if assert.Len(t, next, 2) {
+		assert.Equal(t, ids[2], next[0].ID)
+	}
+	offset, err := store.ListUsers(ctx, userservice.Page{Limit: 2, Offset: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, next, offset)
+	none, err := store.ListUsers(ctx, userservice.Page{Limit: 10, Offset: 10})
+	assert.NoError(t, err)
+	assert.Empty(t, none)
+	count, err := store.CountUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), count)
+
+	partial, err := store.FindUsersByUsernamePartial(ctx, "PAGE_", userservice.Page{Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, partial, 5)
+	partial, err = store.FindUsersByUsernamePartial(ctx, "page_", userservice.Page{Limit: 10, After: &userservice.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}})
+	assert.NoError(t, err)
+	assert.Len(t, partial, 3)
+	count, err = store.CountUsersByUsernamePartial(ctx, "page_")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), count)
+}
+
+func testStoreSearch(t *testing.T, store userservice.UserStore) {
+	_, err := store.InsertUser(ctx, userservice.CreateUserInput{
+		Username: "sculptor_jane",
+		Email:    "jane@site.com",
+		FullName: "Jane Sculptor",
+		Bio:      "I model low-poly characters and props for indie games.",
+	})
+	assert.NoError(t, err)
+	_, err = store.InsertUser(ctx, userservice.CreateUserInput{Username: "blender_bob", Email: "bob@site.com", FullName: "Bob Builder"})
+	assert.NoError(t, err)
+
+	search := func(query string, prefix bool) []string {
+		t.Helper()
+		results, err := store.SearchUsers(ctx, query, prefix, 10, 0)
+		assert.NoError(t, err)
+		var names []string
+		for _, r := range results {
+			assert.Greater(t, r.Score, 0.0)
+			names = append(names, r.User.Username)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"sculptor_jane"}, search("sculptr", false))
+	assert.Equal(t, []string{"sculptor_jane"}, search("characters", false), "matches a word of the bio")
+	assert.Empty(t, search("zzzz", false))
+	assert.Equal(t, []string{"blender_bob"}, search("BLEND", true))
+	assert.Equal(t, []string{"blender_bob"}, search("build", true), "matches a later word of the full name")
+	assert.Empty(t, search("ender", true))
+	assert.Empty(t, search("%", true))
+}
+
+func testStoreModeration(t *testing.T, store userservice.UserStore) {
+	alice := insertUser(t, store, "alice")
+	mod := insertUser(t, store, "mod")
+
+	standing, err := store.GetAccountStanding(ctx, alice.ID)
+	assert.NoError(t, err)
+	assert.False(t, standing.IsActive, "no credential")
+	_, err = store.InsertCredential(ctx, userservice.UserCredential{UserID: alice.ID, PasswordHash: "hash", IsActive: true})
+	assert.NoError(t, err)
+
+	until := time.Now().Add(time.Hour)
+	assert.NoError(t, store.SetSuspension(ctx, alice.ID, until))
+	standing, err = store.GetAccountStanding(ctx, alice.ID)
+	assert.NoError(t, err)
+	assert.True(t, standing.IsActive)
+	assert.WithinDuration(t, until, standing.SuspendedUntil.Time, time.Millisecond)
+	assert.NoError(t, store.SetSuspension(ctx, alice.ID, time.Time{}))
+	standing, _ = store.GetAccountStanding(ctx, alice.ID)
+	assert.False(t, standing.SuspendedUntil.Valid)
+
+	assert.NoError(t, store.SetBanned(ctx, alice.ID))
+	first, _ := store.GetAccountStanding(ctx, alice.ID)
+	assert.True(t, first.BannedAt.Valid)
+	assert.NoError(t, store.SetBanned(ctx, alice.ID))
+	again, _ := store.GetAccountStanding(ctx, alice.ID)
+	assert.True(t, first.BannedAt.Time.Equal(again.BannedAt.Time), "a ban keeps its first date")
+
+	action, err := store.InsertModerationAction(ctx, userservice.ModerationAction{
+		UserID:      alice.ID,
+		ModeratorID: mod.ID,
+		Action:      userservice.ModerationSuspend,
+		Reason:      "spam",
+		Notes:       "private",
+		ExpiresAt:   sql.NullTime{Time: until, Valid: true},
+	})
+	assert.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, action.ID)
+	assert.Equal(t, mod.ID, action.ModeratorID)
+	assert.Equal(t, "private", action.Notes)
+	assert.WithinDuration(t, until, action.ExpiresAt.Time, time.Millisecond)
+	_, err = store.InsertModerationAction(ctx, userservice.ModerationAction{UserID: alice.ID, ModeratorID: mod.ID, Action: "warn"})
+	assertPgCode(t, err, "23514")
+}
+
+func testStoreInvitations(t *testing.T, store userservice.UserStore) {
+	alice := insertUser(t, store, "alice")
+	bob := insertUser(t, store, "bob")
+	carol := insertUser(t, store, "carol")
+	dave := insertUser(t, store, "dave")
+
+	expires := time.Now().Add(24 * time.Hour)
+	first, err := store.InsertInvitation(ctx, "first", userservice.CreateInvitationInput{
+		Issuer:    auth.Caller{UserID: alice.ID},
+		MaxUses:   2,
+		ExpiresAt: expires,
+		Email:     "guest@site.com",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, alice.ID, first.IssuerID.UUID)
+	assert.Equal(t, "guest@site.com", first.Email.String)
+	assert.WithinDuration(t, expires, first.ExpiresAt.Time, time.Millisecond)
+	assert.False(t, first.RevokedAt.Valid)
+	assert.Zero(t, first.Uses)
+	second, err := store.InsertInvitation(ctx, "second", userservice.CreateInvitationInput{Issuer: auth.Caller{UserID: bob.ID}, MaxUses: 1})
+	assert.NoError(t, err)
+	assert.False(t, second.Email.Valid)
+	_, err = store.InsertInvitation(ctx, "third", userservice.CreateInvitationInput{Issuer: auth.Caller{UserID: bob.ID}})
+	assertPgCode(t, err, "23514")
+
+	all, err := store.ListInvitations(ctx, uuid.Nil, 10, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, all, 2) {
+		assert.Equal(t, second.ID, all[0].ID, "newest first")
+	}
+	mine, err := store.ListInvitations(ctx, alice.ID, 10, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, mine, 1) {
+		assert.Equal(t, first.ID, mine[0].ID)
+	}
+
+	locked, err := store.LockInvitationByCode(ctx, "first")
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, locked.ID)
+
+	assert.NoError(t, store.RecordInvitationUse(ctx, first.ID, bob.ID))
+	assert.NoError(t, store.RecordInvitationUse(ctx, first.ID, carol.ID))
+	assertPgCode(t, store.RecordInvitationUse(ctx, first.ID, dave.ID), "23514")
+	assertPgCode(t, store.RecordInvitationUse(ctx, second.ID, bob.ID), "23505")
+	used, err := store.FindInvitationById(ctx, first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, used.Uses)
+	assert.Equal(t, []uuid.UUID{bob.ID, carol.ID}, used.InviteeIDs)
+
+	revoked, err := store.RevokeInvitation(ctx, first.ID)
+	assert.NoError(t, err)
+	assert.True(t, revoked.RevokedAt.Valid)
+	again, err := store.RevokeInvitation(ctx, first.ID)
+	assert.NoError(t, err)
+	assert.True(t, revoked.RevokedAt.Time.Equal(again.RevokedAt.Time), "revoking keeps the first date")
+}
+
+func testStoreBulk(t *testing.T, store userservice.UserStore) {
+	alice := insertUser(t, store, "alice")
+
+	byUsername, byEmail, err := store.FindExistingUsers(ctx, []string{"alice", "nobody"}, []string{"nobody@site.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uuid.UUID{"alice": alice.ID}, byUsername)
+	assert.Equal(t, map[string]uuid.UUID{"alice@site.com": alice.ID}, byEmail)
+
+	inserted, err := store.InsertUserRecords(ctx, []userservice.UserRecord{
+		{Username: "fresh", Email: "fresh@site.com", Website: "https://fresh.site", PasswordHash: "fresh-hash"},
+		{Username: "alice", Email: "alice2@site.com"},
+		{Username: "fresh", Email: "fresh2@site.com"},
+		{Username: "quiet", Email: "quiet@site.com"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, inserted)
+	fresh, err := store.FindUserByEmail(ctx, "fresh@site.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://fresh.site", fresh.Website.String)
+	assert.False(t, fresh.Location.Valid)
+	quiet, err := store.FindUserByEmail(ctx, "quiet@site.com")
+	assert.NoError(t, err)
+	hashes, err := store.FindPasswordHashes(ctx, []uuid.UUID{fresh.ID, quiet.ID, uuid.New()})
+	assert.NoError(t, err)
+	assert.Len(t, hashes, 2)
+	assert.Equal(t, "fresh-hash", hashes[fresh.ID])
+	assert.NotEmpty(t, hashes[quiet.ID], "users without a password get an unusable hash")
+
+	err = store.UpdateUserRecords(ctx, []uuid.UUID{alice.ID, quiet.ID}, []userservice.UserRecord{
+		{Username: "alice2", FullName: "Renamed", PasswordHash: "alice-hash"},
+		{Username: "quiet", Location: "Oslo"},
+	})
+	assert.NoError(t, err)
+	renamed, _ := store.FindUserById(ctx, alice.ID)
+	assert.Equal(t, "alice2", renamed.Username)
+	assert.Equal(t, "Renamed", renamed.FullName)
+	assert.Equal(t, alice.Version+1, renamed.Version)
+	quiet, _ = store.FindUserById(ctx, quiet.ID)
+	assert.Equal(t, "Oslo", quiet.Location.String)
+	hashes, _ = store.FindPasswordHashes(ctx, []uuid.UUID{alice.ID, quiet.ID})
+	assert.Equal(t, "alice-hash", hashes[alice.ID])
+	assert.NotEqual(t, "", hashes[quiet.ID], "a record without a password keeps the old hash")
+
+	err = store.UpdateUserRecords(ctx, []uuid.UUID{alice.ID}, []userservice.UserRecord{{Username: "fresh"}})
+	var conflict *userservice.ConflictError
+	if assert.ErrorAs(t, err, &conflict) {
+		assert.Equal(t, "username", conflict.Field)
+	}
+	renamed, _ = store.FindUserById(ctx, alice.ID)
+	assert.Equal(t, "alice2", renamed.Username)
+}
+
+func testStoreLoginHistory(t *testing.T, store userservice.UserStore) {
+	alice := insertUser(t, store, "alice")
+	_, err := store.InsertCredential(ctx, userservice.UserCredential{UserID: alice.ID, PasswordHash: "hash", IsActive: true})
+	assert.NoError(t, err)
+
+	seen, device, location, err := store.KnownLoginSources(ctx, alice.ID, "laptop", "203.0.113.0/24")
+	assert.NoError(t, err)
+	assert.False(t, seen || device || location)
+
+	success, err := store.InsertLoginEvent(ctx, userservice.LoginEvent{
+		UserID:     alice.ID,
+		IP:         sql.NullString{String: "203.0.113.10", Valid: true},
+		UserAgent:  sql.NullString{String: "browser/1.0", Valid: true},
+		DeviceHash: "laptop",
+		Outcome:    userservice.LoginSuccess,
+	}, "203.0.113.0/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.10", success.IP.String)
+	_, err = store.InsertLoginEvent(ctx, userservice.LoginEvent{UserID: alice.ID, DeviceHash: "phone", Outcome: userservice.LoginInvalidPassword}, "198.51.100.0/24")
+	assert.NoError(t, err)
+	_, err = store.InsertLoginEvent(ctx, userservice.LoginEvent{UserID: alice.ID, DeviceHash: "phone", Outcome: "maybe"}, "")
+	assertPgCode(t, err, "23514")
+
+	seen, device, location, err = store.KnownLoginSources(ctx, alice.ID, "laptop", "203.0.113.0/24")
+	assert.NoError(t, err)
+	assert.True(t, seen && device && location)
+	seen, device, location, err = store.KnownLoginSources(ctx, alice.ID, "phone", "198.51.100.0/24")
+	assert.NoError(t, err)
+	assert.True(t, seen)
+	assert.False(t, device || location, "failed logins don't make a source known")
+	_, _, location, err = store.KnownLoginSources(ctx, alice.ID, "laptop", "")
+	assert.NoError(t, err)
+	assert.False(t, location)
+
+	events, err := store.ListLoginHistory(ctx, alice.ID, 10, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, userservice.LoginInvalidPassword, events[0].Outcome, "newest first")
+		assert.Equal(t, success.ID, events[1].ID)
+	}
+	events, err = store.ListLoginHistory(ctx, alice.ID, 1, 1)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+
+	assert.NoError(t, store.TouchLastLogin(ctx, alice.ID, success.CreatedAt))
+	cred, err := store.GetCredential(ctx, alice.ID)
+	assert.NoError(t, err)
+	assert.True(t, success.CreatedAt.Equal(cred.LastLogin.Time))
+
+	assert.NoError(t, store.EnqueueNotification(ctx, userservice.Notification{UserID: alice.ID, Destination: "alice@site.com", Subject: "New sign-in"}))
+}
+
+func testStoreSecurityEvents(t *testing.T, store userservice.UserStore) {
+	alice := insertUser(t, store, "alice")
+	admin := insertUser(t, store, "admin")
+
+	assert.NoError(t, store.InsertSecurityEvent(ctx, userservice.SecurityEvent{
+		UserID:  alice.ID,
+		ActorID: uuid.NullUUID{UUID: admin.ID, Valid: true},
+		Event:   userservice.SecurityImpersonationStarted,
+		Reason:  sql.NullString{String: "ticket 42", Valid: true},
+	}))
+	assert.NoError(t, store.InsertSecurityEvent(ctx, userservice.SecurityEvent{
+		UserID:  alice.ID,
+		ActorID: uuid.NullUUID{UUID: admin.ID, Valid: true},
+		Event:   userservice.SecurityImpersonatedAction,
+		Method:  sql.NullString{String: "/user.UserService/UpdateUser", Valid: true},
+	}))
+	err := store.InsertSecurityEvent(ctx, userservice.SecurityEvent{UserID: alice.ID, Event: "password_changed"})
+	assertPgCode(t, err, "23514")
+
+	events, err := store.ListSecurityEvents(ctx, alice.ID, 10, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, userservice.SecurityImpersonatedAction, events[0].Event)
+		assert.Equal(t, "/user.UserService/UpdateUser", events[0].Method.String)
+		assert.Equal(t, "ticket 42", events[1].Reason.String)
+		assert.Equal(t, admin.ID, events[1].ActorID.UUID)
+	}
+	events, err = store.ListSecurityEvents(ctx, admin.ID, 10, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func testStoreSigningKeys(t *testing.T, store userservice.UserStore) {
+	now := time.Now()
+	older := auth.StoredKey{ID: "older", Algorithm: "ES256", Sealed: []byte("sealed"), CreatedAt: now.Add(-2 * time.Hour)}
+	newer := auth.StoredKey{ID: "newer", Algorithm: "ES256", Sealed: []byte("sealed"), CreatedAt: now}
+
+	added, err := store.AddSigningKey(ctx, older, now.Add(-3*time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, added)
+	added, err = store.AddSigningKey(ctx, newer, now.Add(-3*time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, added, "the older key is still fresh")
+	added, err = store.AddSigningKey(ctx, newer, now.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	keys, err := store.SigningKeys(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, "newer", keys[0].ID)
+		assert.True(t, keys[0].RetiredAt.IsZero())
+		assert.Equal(t, []byte("sealed"), keys[0].Sealed)
+		assert.True(t, keys[1].RetiredAt.Equal(keys[0].CreatedAt), "the older key retires when the newer one starts")
+	}
+
+	assert.NoError(t, store.DeleteSigningKeys(ctx, now.Add(time.Minute)))
+	keys, err = store.SigningKeys(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, "newer", keys[0].ID)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/shatwik7/polycrate/services/user_service/auth"
 )
 
 type CreateUserInput struct {
@@ -14,6 +15,7 @@ type CreateUserInput struct {
 	ProfilePictureUrl string
 	Bio               string
 	Password          string
+	InviteCode        string
 }
 
 type UpdateUserInput struct {
@@ -21,11 +23,16 @@ type UpdateUserInput struct {
 	FullName          string
 	ProfilePictureUrl string
 	Bio               string
+	// Version is the version of the user the update is based on. The
+	// update fails with ErrVersionConflict if the user has moved on since;
+	// zero applies it regardless.
+	Version int64
 }
 
 type LoginInput struct {
 	Email    string
 	Password string
+	Client   ClientInfo
 }
 
 type ChangePasswordInput struct {
@@ -33,6 +40,50 @@ type ChangePasswordInput struct {
 	NewPassword string
 }
 
+type ListUsersInput struct {
+	Limit             int
+	Offset            int
+	PageToken         string
+	IncludeTotalCount bool
+}
+
+type SearchByUsernameInput struct {
+	Username          string
+	Limit             int
+	Offset            int
+	PageToken         string
+	IncludeTotalCount bool
+}
+
+type SearchUsersInput struct {
+	Query  string
+	Limit  int
+	Offset int
+	Prefix bool
+}
+
+type SearchHighlight struct {
+	Field    string
+	Fragment string
+}
+
+type UserSearchResult struct {
+	User       User
+	Score      float64
+	Highlights []SearchHighlight
+}
+
+type UserBatch struct {
+	Users   map[uuid.UUID]User
+	Missing []uuid.UUID
+}
+
+type UserPage struct {
+	Users         []User
+	NextPageToken string
+	TotalCount    int64
+}
+
 type User struct {
 	ID                uuid.UUID
 	Username          string
@@ -44,6 +95,128 @@ type User struct {
 	Location          sql.NullString
 	CreatedAt         time.Time
 	UpdatedAt         time.Time
+	Role              auth.Role
+	// Version goes up by one whenever UpdatedAt changes.
+	Version int64
+}
+
+type ModerationActionType string
+
+const (
+	ModerationSuspend ModerationActionType = "suspend"
+	ModerationLift    ModerationActionType = "lift"
+	ModerationBan     ModerationActionType = "ban"
+)
+
+type ModerationInput struct {
+	UserID    uuid.UUID
+	Moderator auth.Caller
+	Reason    string
+	Notes     string
+	Until     time.Time
+}
+
+type ModerationAction struct {
+	ID          uuid.UUID
+	UserID      uuid.UUID
+	ModeratorID uuid.UUID
+	Action      ModerationActionType
+	Reason      string
+	Notes       string
+	ExpiresAt   sql.NullTime
+	CreatedAt   time.Time
+}
+
+// AccountStanding is what login and token verification need to know to
+// decide whether an account may act at all.
+type AccountStanding struct {
+	IsActive       bool
+	SuspendedUntil sql.NullTime
+	BannedAt       sql.NullTime
+}
+
+type MonthlyDownloads struct {
+	Month     time.Time
+	Downloads int64
+}
+
+type UserStats struct {
+	UserID           uuid.UUID
+	PublicAssets     int64
+	TotalDownloads   int64
+	TotalLikes       int64
+	Followers        int64
+	JoinedAt         time.Time
+	MonthlyDownloads []MonthlyDownloads
+}
+
+type Invitation struct {
+	ID         uuid.UUID
+	IssuerID   uuid.NullUUID
+	MaxUses    int
+	Uses       int
+	Email      sql.NullString
+	ExpiresAt  sql.NullTime
+	RevokedAt  sql.NullTime
+	CreatedAt  time.Time
+	InviteeIDs []uuid.UUID
+}
+
+type CreateInvitationInput struct {
+	Issuer    auth.Caller
+	MaxUses   int
+	ExpiresAt time.Time
+	Email     string
+}
+
+type ListInvitationsInput struct {
+	// IssuerID restricts the list to one issuer; uuid.Nil lists everyone's.
+	IssuerID uuid.UUID
+	Limit    int
+	Offset   int
+}
+
+type LoginEvent struct {
+	ID          uuid.UUID
+	UserID      uuid.UUID
+	IP          sql.NullString
+	UserAgent   sql.NullString
+	DeviceHash  string
+	Outcome     LoginOutcome
+	NewDevice   bool
+	NewLocation bool
+	CreatedAt   time.Time
+}
+
+type SecurityEventType string
+
+const (
+	SecurityImpersonationStarted SecurityEventType = "impersonation_started"
+	SecurityImpersonatedAction   SecurityEventType = "impersonated_action"
+)
+
+type SecurityEvent struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	ActorID   uuid.NullUUID
+	Event     SecurityEventType
+	Method    sql.NullString
+	Reason    sql.NullString
+	CreatedAt time.Time
+}
+
+type ImpersonationInput struct {
+	UserID uuid.UUID
+	Admin  auth.Caller
+	Reason string
+}
+
+// Notification is an email queued for the notification worker.
+type Notification struct {
+	UserID      uuid.UUID
+	Destination string
+	Subject     string
+	Message     string
 }
 
 type UserCredential struct {
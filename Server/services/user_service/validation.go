@@ -0,0 +1,325 @@
+package userservice
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	userpb "github.com/shatwik7/polycrate/lib/protos/user"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	MaxUsernameLength = 50
+	MinUsernameLength = 3
+	MaxEmailLength    = 255
+	MaxFullNameLength = 100
+	MaxBioLength      = 1000
+	MaxURLLength      = 2048
+	MinPasswordLength = 8
+	// bcrypt ignores everything past 72 bytes.
+	MaxPasswordLength = 72
+	MaxSearchLength   = 100
+	MaxReasonLength   = 500
+	MaxNotesLength    = 5000
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Rule checks a single field value and returns a description of the
+// problem, or "" when the value is acceptable.
+type Rule func(v protoreflect.Value) string
+
+// FieldRules lists the rules for one field, identified by its proto name.
+// Rules run in order and stop at the first violation.
+type FieldRules struct {
+	Field string
+	Rules []Rule
+}
+
+// requestRules holds the validation rules for every UserService request
+// message. TestEveryRequestHasRules keeps it in sync with user.proto.
+var requestRules = map[protoreflect.FullName][]FieldRules{
+	name(&userpb.CreateUserRequest{}): {
+		{"username", []Rule{required, length(MinUsernameLength, MaxUsernameLength), matches(usernamePattern, "may only contain letters, digits, '_', '.' and '-'")}},
+		{"email", []Rule{required, maxLength(MaxEmailLength), email}},
+		{"full_name", []Rule{maxLength(MaxFullNameLength)}},
+		{"profile_picture_url", []Rule{optional(httpURL)}},
+		{"bio", []Rule{maxLength(MaxBioLength)}},
+		{"password", []Rule{required, password}},
+		{"invite_code", []Rule{maxLength(MaxInviteCodeLength)}},
+	},
+	name(&userpb.UpdateUserRequest{}): {
+		{"id", []Rule{required, uuidString}},
+		{"full_name", []Rule{maxLength(MaxFullNameLength)}},
+		{"profile_picture_url", []Rule{optional(httpURL)}},
+		{"bio", []Rule{maxLength(MaxBioLength)}},
+	},
+	name(&userpb.DeleteUserRequest{}): {
+		{"id", []Rule{required, uuidString}},
+	},
+	name(&userpb.GetUserRequest{}): {
+		{"id", []Rule{required, uuidString}},
+	},
+	name(&userpb.BatchGetUsersRequest{}): {
+		{"ids", []Rule{maxItems(MaxBatchGetUsers), each(uuidString)}},
+	},
+	name(&userpb.ListUsersRequest{}): {
+		{"limit", []Rule{nonNegative}},
+		{"offset", []Rule{nonNegative}},
+	},
+	name(&userpb.SearchByEmailRequest{}): {
+		{"email", []Rule{required, maxLength(MaxEmailLength), email}},
+	},
+	name(&userpb.SearchByUsernameRequest{}): {
+		{"username", []Rule{required, maxLength(MaxUsernameLength)}},
+		{"limit", []Rule{nonNegative}},
+		{"offset", []Rule{nonNegative}},
+	},
+	name(&userpb.SearchUsersRequest{}): {
+		{"query", []Rule{required, maxLength(MaxSearchLength)}},
+		{"limit", []Rule{nonNegative}},
+		{"offset", []Rule{nonNegative}},
+	},
+	name(&userpb.LoginRequest{}): {
+		{"email", []Rule{required, maxLength(MaxEmailLength)}},
+		{"password", []Rule{required, maxLength(MaxPasswordLength)}},
+		{"device_id", []Rule{maxLength(MaxDeviceIDLength)}},
+	},
+	name(&userpb.ValidateRequest{}): {
+		{"email", []Rule{required, maxLength(MaxEmailLength)}},
+		{"password", []Rule{required, maxLength(MaxPasswordLength)}},
+	},
+	name(&userpb.ChangePasswordRequest{}): {
+		{"id", []Rule{required, uuidString}},
+		{"new_password", []Rule{required, password}},
+	},
+	name(&userpb.DeactivateUserRequest{}): {
+		{"id", []Rule{required, uuidString}},
+	},
+	name(&userpb.SuspendUserRequest{}): {
+		{"id", []Rule{required, uuidString}},
+		{"reason", []Rule{required, maxLength(MaxReasonLength)}},
+		{"until", []Rule{required}},
+		{"notes", []Rule{maxLength(MaxNotesLength)}},
+	},
+	name(&userpb.LiftSuspensionRequest{}): {
+		{"id", []Rule{required, uuidString}},
+		{"reason", []Rule{required, maxLength(MaxReasonLength)}},
+		{"notes", []Rule{maxLength(MaxNotesLength)}},
+	},
+	name(&userpb.GetUserStatsRequest{}): {
+		{"id", []Rule{required, uuidString}},
+		{"months", []Rule{nonNegative}},
+	},
+	name(&userpb.BanUserRequest{}): {
+		{"id", []Rule{required, uuidString}},
+		{"reason", []Rule{required, maxLength(MaxReasonLength)}},
+		{"notes", []Rule{maxLength(MaxNotesLength)}},
+	},
+	name(&userpb.CreateInvitationRequest{}): {
+		{"max_uses", []Rule{nonNegative, atMost(MaxInvitationUses)}},
+		{"email", []Rule{maxLength(MaxEmailLength), optional(email)}},
+	},
+	name(&userpb.ListInvitationsRequest{}): {
+		{"issuer_id", []Rule{optional(uuidString)}},
+		{"limit", []Rule{nonNegative}},
+		{"offset", []Rule{nonNegative}},
+	},
+	name(&userpb.RevokeInvitationRequest{}): {
+		{"id", []Rule{required, uuidString}},
+	},
+	name(&userpb.GetJWKSRequest{}): {},
+	name(&userpb.ImpersonateUserRequest{}): {
+		{"id", []Rule{required, uuidString}},
+		{"reason", []Rule{required, maxLength(MaxReasonLength)}},
+	},
+	name(&userpb.ListSecurityEventsRequest{}): {
+		{"id", []Rule{required, uuidString}},
+		{"limit", []Rule{nonNegative}},
+		{"offset", []Rule{nonNegative}},
+	},
+	name(&userpb.ListLoginHistoryRequest{}): {
+		{"id", []Rule{required, uuidString}},
+		{"limit", []Rule{nonNegative}},
+		{"offset", []Rule{nonNegative}},
+	},
+}
+
+func name(m proto.Message) protoreflect.FullName {
+	return m.ProtoReflect().Descriptor().FullName()
+}
+
+// ValidateRequest checks msg against its registered rules and returns a
+// *ValidationError listing every invalid field, or nil.
+func ValidateRequest(msg proto.Message) error {
+	m := msg.ProtoReflect()
+	rules, ok := requestRules[m.Descriptor().FullName()]
+	if !ok {
+		return nil
+	}
+	var violations []FieldViolation
+	for _, fr := range rules {
+		fd := m.Descriptor().Fields().ByName(protoreflect.Name(fr.Field))
+		if fd == nil {
+			panic(fmt.Sprintf("validation rule for unknown field %s.%s", m.Descriptor().FullName(), fr.Field))
+		}
+		for _, rule := range fr.Rules {
+			if desc := rule(m.Get(fd)); desc != "" {
+				violations = append(violations, FieldViolation{Field: fr.Field, Description: desc})
+				break
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return &ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+// ValidationInterceptor rejects requests that fail ValidateRequest with
+// InvalidArgument before they reach a handler.
+func ValidationInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if msg, ok := req.(proto.Message); ok {
+			if err := ValidateRequest(msg); err != nil {
+				return nil, toStatus(err)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// ------------------- Rules -------------------
+
+func required(v protoreflect.Value) string {
+	switch x := v.Interface().(type) {
+	case string:
+		if x == "" {
+			return "is required"
+		}
+	case protoreflect.Message:
+		if !x.IsValid() {
+			return "is required"
+		}
+	}
+	return ""
+}
+
+func optional(rule Rule) Rule {
+	return func(v protoreflect.Value) string {
+		if v.String() == "" {
+			return ""
+		}
+		return rule(v)
+	}
+}
+
+func maxLength(n int) Rule {
+	return func(v protoreflect.Value) string {
+		if utf8.RuneCountInString(v.String()) > n {
+			return fmt.Sprintf("must be at most %d characters", n)
+		}
+		return ""
+	}
+}
+
+func length(lo, hi int) Rule {
+	return func(v protoreflect.Value) string {
+		if n := utf8.RuneCountInString(v.String()); n < lo || n > hi {
+			return fmt.Sprintf("must be between %d and %d characters", lo, hi)
+		}
+		return ""
+	}
+}
+
+func matches(re *regexp.Regexp, description string) Rule {
+	return func(v protoreflect.Value) string {
+		if !re.MatchString(v.String()) {
+			return description
+		}
+		return ""
+	}
+}
+
+func email(v protoreflect.Value) string {
+	addr, err := mail.ParseAddress(v.String())
+	if err != nil || addr.Address != v.String() {
+		return "must be a valid email address"
+	}
+	return ""
+}
+
+func httpURL(v protoreflect.Value) string {
+	s := v.String()
+	if len(s) > MaxURLLength {
+		return fmt.Sprintf("must be at most %d characters", MaxURLLength)
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "must be an absolute http or https URL"
+	}
+	return ""
+}
+
+func uuidString(v protoreflect.Value) string {
+	if _, err := uuid.Parse(v.String()); err != nil {
+		return "must be a valid UUID"
+	}
+	return ""
+}
+
+func password(v protoreflect.Value) string {
+	n := len(v.String())
+	if n < MinPasswordLength {
+		return fmt.Sprintf("must be at least %d characters", MinPasswordLength)
+	}
+	if n > MaxPasswordLength {
+		return fmt.Sprintf("must be at most %d bytes", MaxPasswordLength)
+	}
+	return ""
+}
+
+func nonNegative(v protoreflect.Value) string {
+	if v.Int() < 0 {
+		return "must not be negative"
+	}
+	return ""
+}
+
+func atMost(n int64) Rule {
+	return func(v protoreflect.Value) string {
+		if v.Int() > n {
+			return fmt.Sprintf("must be at most %d", n)
+		}
+		return ""
+	}
+}
+
+func maxItems(n int) Rule {
+	return func(v protoreflect.Value) string {
+		if v.List().Len() > n {
+			return fmt.Sprintf("must contain at most %d items", n)
+		}
+		return ""
+	}
+}
+
+// each applies rule to every element of a repeated field.
+func each(rule Rule) Rule {
+	return func(v protoreflect.Value) string {
+		list := v.List()
+		for i := 0; i < list.Len(); i++ {
+			if desc := rule(list.Get(i)); desc != "" {
+				return fmt.Sprintf("item %d %s", i, desc)
+			}
+		}
+		return ""
+	}
+}
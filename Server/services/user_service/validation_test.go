@@ -0,0 +1,61 @@
+package userservice
+
+import (
+	"strings"
+	"testing"
+
+	userpb "github.com/shatwik7/polycrate/lib/protos/user"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestEveryRequestHasRules(t *testing.T) {
+	methods := userpb.File_user_proto.Services().ByName("UserService").Methods()
+	for i := 0; i < methods.Len(); i++ {
+		input := methods.Get(i).Input()
+		rules, ok := requestRules[input.FullName()]
+		assert.True(t, ok, "no validation rules for %s", input.FullName())
+		for _, fr := range rules {
+			assert.NotNil(t, input.Fields().ByName(protoreflect.Name(fr.Field)), "%s has no field %s", input.FullName(), fr.Field)
+		}
+	}
+}
+
+func TestValidateCreateUser(t *testing.T) {
+	valid := &userpb.CreateUserRequest{
+		Username:          "jane.doe",
+		Email:             "jane@example.com",
+		FullName:          "Jane Doe",
+		ProfilePictureUrl: "https://cdn.example.com/jane.png",
+		Password:          "correct horse",
+	}
+	assert.NoError(t, ValidateRequest(valid))
+
+	err := ValidateRequest(&userpb.CreateUserRequest{
+		Username:          "jane doe!",
+		Email:             "Jane <jane@example.com>",
+		FullName:          strings.Repeat("x", 200),
+		ProfilePictureUrl: "javascript:alert(1)",
+		Bio:               strings.Repeat("b", MaxBioLength+1),
+		Password:          "short",
+	})
+	var validation *ValidationError
+	assert.ErrorAs(t, err, &validation)
+	var fields []string
+	for _, v := range validation.Violations {
+		fields = append(fields, v.Field)
+	}
+	assert.Equal(t, []string{"username", "email", "full_name", "profile_picture_url", "bio", "password"}, fields)
+}
+
+func TestValidateRequiredAndUUID(t *testing.T) {
+	err := ValidateRequest(&userpb.CreateUserRequest{})
+	var validation *ValidationError
+	assert.ErrorAs(t, err, &validation)
+	assert.Equal(t, "is required", validation.Violations[0].Description)
+
+	assert.Error(t, ValidateRequest(&userpb.GetUserRequest{Id: "42"}))
+	assert.NoError(t, ValidateRequest(&userpb.GetUserRequest{Id: "6f1c1e9a-3b7e-4d43-9d5a-6c1f0d3c2b11"}))
+	assert.Error(t, ValidateRequest(&userpb.BatchGetUsersRequest{Ids: []string{"6f1c1e9a-3b7e-4d43-9d5a-6c1f0d3c2b11", "nope"}}))
+	assert.Error(t, ValidateRequest(&userpb.ListUsersRequest{Limit: -1}))
+}